@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+
+	"dns-switchy/config"
+	"dns-switchy/util"
+)
+
+// clientACL is the compiled `acl:` block. A nil *clientACL admits everyone.
+type clientACL struct {
+	allow        *util.IPSet
+	deny         *util.IPSet
+	defaultAllow bool
+	drop         bool
+}
+
+func newClientACL(c *config.ACLConfig) *clientACL {
+	if c == nil {
+		return nil
+	}
+	return &clientACL{
+		allow:        util.NewIPSet(c.Allow),
+		deny:         util.NewIPSet(c.Deny),
+		defaultAllow: c.Default == config.ACLAllow,
+		drop:         c.Action == config.ActionDrop,
+	}
+}
+
+// check decides whether the peer may query and names the deciding rule for
+// the log ("allow 192.168.0.0/16", "deny default", ...). The most specific
+// prefix wins; on a tie deny wins. Peers without an IP (/api/query, DoH over
+// the unix socket) are not subject to the ACL: the API has its own key and the
+// socket its own file permissions. rule is empty when no ACL applied.
+func (a *clientACL) check(addr net.Addr) (allowed bool, rule string) {
+	if a == nil {
+		return true, ""
+	}
+	ip, ok := util.AddrOf(addr)
+	if !ok {
+		return true, ""
+	}
+	deny, denied := a.deny.Lookup(ip)
+	allow, allowedBy := a.allow.Lookup(ip)
+	switch {
+	case denied && (!allowedBy || deny.Bits() >= allow.Bits()):
+		return false, config.ACLDeny + " " + deny.String()
+	case allowedBy:
+		return true, config.ACLAllow + " " + allow.String()
+	case a.defaultAllow:
+		return true, config.ACLAllow + " default"
+	default:
+		return false, config.ACLDeny + " default"
+	}
+}
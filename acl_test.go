@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"dns-switchy/config"
+	"dns-switchy/resolver"
+
+	"github.com/miekg/dns"
+)
+
+func mustACL(t *testing.T, body string) *clientACL {
+	t.Helper()
+	conf, err := config.ParseConfig(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	return newClientACL(conf.ACL)
+}
+
+func TestClientACLCheck(t *testing.T) {
+	acl := mustACL(t, `acl:
+  allow: [192.168.0.0/16, 192.168.5.7, "fd00::/8"]
+  deny: [192.168.5.0/24, 10.0.0.0/8]
+`)
+	tests := []struct {
+		addr        net.Addr
+		wantAllowed bool
+		wantRule    string
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("192.168.1.2")}, true, "allow 192.168.0.0/16"},
+		{&net.UDPAddr{IP: net.ParseIP("192.168.5.2")}, false, "deny 192.168.5.0/24"},
+		{&net.UDPAddr{IP: net.ParseIP("192.168.5.7")}, true, "allow 192.168.5.7/32"},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:10.1.1.1")}, false, "deny 10.0.0.0/8"},
+		{&net.TCPAddr{IP: net.ParseIP("fd12::1")}, true, "allow fd00::/8"},
+		{&net.UDPAddr{IP: net.ParseIP("203.0.113.1")}, false, "deny default"},
+		// No peer IP: /api/query and DoH over the unix socket.
+		{&FakeAddr{}, true, ""},
+		{&net.TCPAddr{}, true, ""},
+	}
+	for _, tt := range tests {
+		allowed, rule := acl.check(tt.addr)
+		if allowed != tt.wantAllowed || rule != tt.wantRule {
+			t.Errorf("check(%s) = %v, %q, want %v, %q", tt.addr, allowed, rule, tt.wantAllowed, tt.wantRule)
+		}
+	}
+
+	// Same prefix on both lists: deny wins.
+	tie := newClientACL(&config.ACLConfig{
+		Allow:   []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		Deny:    []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		Default: config.ACLAllow,
+	})
+	if allowed, rule := tie.check(&net.UDPAddr{IP: net.ParseIP("10.0.0.1")}); allowed || rule != "deny 10.0.0.0/8" {
+		t.Fatalf("tie check = %v, %q, want deny 10.0.0.0/8", allowed, rule)
+	}
+
+	var none *clientACL
+	if allowed, rule := none.check(&net.UDPAddr{IP: net.ParseIP("203.0.113.1")}); !allowed || rule != "" {
+		t.Fatalf("nil acl check = %v, %q, want allowed without rule", allowed, rule)
+	}
+}
+
+func TestDnsMsgHandlerACL(t *testing.T) {
+	logs := captureLog(t)
+	resolved := 0
+	server := newServerForTest([]resolver.DnsResolver{&testResolver{
+		acceptFn: func(*dns.Msg) bool { return true },
+		resolveFn: func(msg *dns.Msg) (*dns.Msg, error) {
+			resolved++
+			return makeAResponse(msg, "192.0.2.1"), nil
+		},
+	}})
+	cache := &fakeCache{getResult: *makeAResponse(makeQuery("example.com.", dns.TypeA), "192.0.2.9")}
+	server.dnsCache = cache
+	server.acl = mustACL(t, "acl:\n  allow: [192.168.0.0/16]\n")
+
+	query := func(ip string) *captureDNSResponseWriter {
+		writer := newCaptureDNSResponseWriter()
+		writer.peerAddr = &net.UDPAddr{IP: net.ParseIP(ip), Port: 5353}
+		msg := makeQuery("example.com.", dns.TypeA)
+		server.dnsMsgHandler(&DnsWriter{writer: writer, msg: msg, start: time.Now().UnixMilli(), tags: QueryTags{Listener: "lan"}}, msg)
+		return writer
+	}
+
+	denied := query("203.0.113.1")
+	if denied.msg == nil || denied.msg.Rcode != dns.RcodeRefused {
+		t.Fatalf("denied response = %v, want REFUSED", denied.msg)
+	}
+	if len(denied.msg.Answer) != 0 || resolved != 0 {
+		t.Fatalf("denied query answered (%v) or resolved (%d), want neither cache nor resolver", denied.msg.Answer, resolved)
+	}
+	var entry StructureLog
+	if err := json.Unmarshal([]byte(strings.TrimSpace(logs.String())), &entry); err != nil {
+		t.Fatalf("decode log line %q: %v", logs.String(), err)
+	}
+	if entry.ACL != "deny default" || entry.RCode != "REFUSED" || entry.Resolver != "acl" || entry.Listener != "lan" {
+		t.Fatalf("deny log = %+v, want acl/REFUSED/deny default on lan", entry)
+	}
+
+	allowed := query("192.168.1.2")
+	if allowed.msg == nil || len(allowed.msg.Answer) != 1 {
+		t.Fatalf("allowed response = %v, want cached answer", allowed.msg)
+	}
+	if !strings.Contains(logs.String(), `"acl":"allow 192.168.0.0/16"`) {
+		t.Fatalf("log %q does not record the allow decision", logs.String())
+	}
+
+	server.acl.drop = true
+	if dropped := query("203.0.113.1"); dropped.msg != nil {
+		t.Fatalf("dropped query answered %v, want no response", dropped.msg)
+	}
+	if !strings.Contains(logs.String(), `"dropped":true`) {
+		t.Fatalf("log %q does not record the drop", logs.String())
+	}
+}
+
+func TestDoHDroppedQueryGetsForbidden(t *testing.T) {
+	server := newServerForTest(nil)
+	server.acl = mustACL(t, "acl:\n  deny: [0.0.0.0/0]\n  action: drop\n")
+	req := httptest.NewRequest(http.MethodPost, "/dns-query", strings.NewReader(string(packMsg(t, makeQuery("example.com.", dns.TypeA)))))
+	req.Header.Set("Content-Type", dohMediaType)
+	req.RemoteAddr = "198.51.100.4:40000"
+	rec := httptest.NewRecorder()
+	server.dohHandler("doh").ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403", rec.Code)
+	}
+}
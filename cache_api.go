@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"dns-switchy/util"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultCacheListLimit = 100
+	maxCacheListLimit     = 1000
+)
+
+type cacheStatsResponse struct {
+	util.CacheStats
+	// Coalesced counts cache misses answered by another query's upstream
+	// exchange rather than their own (see flightGroup).
+	Coalesced uint64 `json:"coalesced"`
+}
+
+// apiCacheStatsHandler serves GET /api/cache/stats: size, limits, hit/miss and
+// eviction counters of the global cache, plus the coalesced-query count.
+func (s *DnsSwitchyServer) apiCacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cache, ok := s.dnsCache.(util.StatsCache)
+	if !ok {
+		http.Error(w, "cache not enabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, cacheStatsResponse{CacheStats: cache.Stats(), Coalesced: s.flights.Coalesced()})
+}
+
+type cacheEntryView struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	DO       bool   `json:"do,omitempty"`
+	CD       bool   `json:"cd,omitempty"`
+	ECS      string `json:"ecs,omitempty"`
+	TTL      int64  `json:"ttl"`             // seconds until expiry, 0 once stale
+	Stale    bool   `json:"stale,omitempty"` // expired, kept for serve-stale
+	Resolver string `json:"resolver,omitempty"`
+}
+
+type cacheListResponse struct {
+	Total   int              `json:"total"`
+	Offset  int              `json:"offset"`
+	Limit   int              `json:"limit"`
+	Entries []cacheEntryView `json:"entries"`
+}
+
+// apiCacheHandler serves /api/cache: GET lists entries sorted by name and
+// type, DELETE removes them by exact name, by suffix or all at once.
+func (s *DnsSwitchyServer) apiCacheHandler(w http.ResponseWriter, r *http.Request) {
+	cache, ok := s.dnsCache.(util.InspectableCache)
+	if !ok {
+		http.Error(w, "cache not enabled", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.handleCacheList(w, r, cache)
+	case http.MethodDelete:
+		s.handleCacheDelete(w, r, cache)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleCacheList takes optional suffix, type, offset and limit parameters.
+func (s *DnsSwitchyServer) handleCacheList(w http.ResponseWriter, r *http.Request, cache util.InspectableCache) {
+	query := r.URL.Query()
+	var qtype uint16
+	if text := query.Get("type"); text != "" {
+		var ok bool
+		if qtype, ok = dns.StringToType[strings.ToUpper(text)]; !ok {
+			http.Error(w, "Invalid type", http.StatusBadRequest)
+			return
+		}
+	}
+	offset, err := intParam(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+	limit, err := intParam(query.Get("limit"), defaultCacheListLimit)
+	if err != nil || limit <= 0 {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+	limit = min(limit, maxCacheListLimit)
+	suffix := normalizeCacheName(query.Get("suffix"))
+
+	var matched []util.CacheEntryInfo
+	for _, entry := range cache.Entries() {
+		if qtype != 0 && entry.Key.Qtype != qtype {
+			continue
+		}
+		if suffix != "" && !dns.IsSubDomain(suffix, entry.Key.Name) {
+			continue
+		}
+		matched = append(matched, entry)
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		a, b := matched[i].Key, matched[j].Key
+		switch {
+		case a.Name != b.Name:
+			return a.Name < b.Name
+		case a.Qtype != b.Qtype:
+			return a.Qtype < b.Qtype
+		case a.DO != b.DO:
+			return !a.DO
+		case a.CD != b.CD:
+			return !a.CD
+		}
+		return a.ECS < b.ECS
+	})
+	resp := cacheListResponse{Total: len(matched), Offset: offset, Limit: limit, Entries: []cacheEntryView{}}
+	// Clamp before adding: a huge offset must not overflow offset+limit.
+	start := min(offset, len(matched))
+	for _, entry := range matched[start : start+min(limit, len(matched)-start)] {
+		view := cacheEntryView{
+			Name:     entry.Key.Name,
+			Type:     dns.TypeToString[entry.Key.Qtype],
+			DO:       entry.Key.DO,
+			CD:       entry.Key.CD,
+			ECS:      entry.Key.ECS,
+			Resolver: entry.Owner,
+		}
+		if entry.Remaining > 0 {
+			// Round up so an entry with 300ms left does not read as expired.
+			view.TTL = int64((entry.Remaining + time.Second - 1) / time.Second)
+		} else {
+			view.Stale = true
+		}
+		resp.Entries = append(resp.Entries, view)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleCacheDelete takes exactly one of name (every entry of that name),
+// suffix (the name and everything under it) or all=true.
+func (s *DnsSwitchyServer) handleCacheDelete(w http.ResponseWriter, r *http.Request, cache util.InspectableCache) {
+	query := r.URL.Query()
+	name, suffix := normalizeCacheName(query.Get("name")), normalizeCacheName(query.Get("suffix"))
+	all := query.Get("all") == "true"
+	var match func(key util.CacheKey) bool
+	switch {
+	case name != "" && suffix == "" && !all:
+		match = func(key util.CacheKey) bool { return key.Name == name }
+	case suffix != "" && name == "" && !all:
+		match = func(key util.CacheKey) bool { return dns.IsSubDomain(suffix, key.Name) }
+	case all && name == "" && suffix == "":
+		match = func(util.CacheKey) bool { return true }
+	default:
+		http.Error(w, "Need exactly one of name, suffix or all=true", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"deleted": cache.Delete(match)})
+}
+
+// normalizeCacheName brings a name into the form cache keys use (see
+// checkAndUnify); empty stays empty.
+func normalizeCacheName(name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return ""
+	}
+	return strings.ToLower(dns.Fqdn(name))
+}
+
+func intParam(text string, fallback int) (int, error) {
+	if text == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(text)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"dns-switchy/config"
+	"dns-switchy/resolver"
+	"dns-switchy/util"
+
+	"github.com/miekg/dns"
+)
+
+func TestAPICacheStats(t *testing.T) {
+	server := newServerForTest([]resolver.DnsResolver{&testResolver{
+		acceptFn:  func(*dns.Msg) bool { return true },
+		resolveFn: func(msg *dns.Msg) (*dns.Msg, error) { return makeAResponse(msg, "192.0.2.1"), nil },
+	}})
+	server.dnsCache = util.NewDnsCacheWithConfig(time.Minute, config.CacheConfig{MaxEntries: 1})
+	for _, name := range []string{"a.example.", "b.example.", "b.example."} {
+		msg := makeQuery(name, dns.TypeA)
+		server.dnsMsgHandler(&DnsWriter{writer: newCaptureDNSResponseWriter(), msg: msg, start: time.Now().UnixMilli()}, msg)
+	}
+
+	rec := httptest.NewRecorder()
+	server.httpMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/cache/stats", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	var stats cacheStatsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("decode %q: %v", rec.Body.String(), err)
+	}
+	if stats.Entries != 1 || stats.MaxEntries != 1 || stats.Evicted != 1 || stats.Hits != 1 || stats.Misses != 2 {
+		t.Fatalf("stats = %+v, want 1/1 entries, 1 eviction, 1 hit, 2 misses", stats)
+	}
+	if stats.Coalesced != 0 {
+		t.Fatalf("coalesced = %d, want 0 for sequential queries", stats.Coalesced)
+	}
+
+	server.dnsCache = &util.NoCache{}
+	rec = httptest.NewRecorder()
+	server.httpMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/cache/stats", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status without cache = %d, want 404", rec.Code)
+	}
+}
+
+func TestAPICacheListAndDelete(t *testing.T) {
+	proxy := &namedResolver{name: "proxy", testResolver: testResolver{
+		acceptFn:  func(*dns.Msg) bool { return true },
+		resolveFn: func(msg *dns.Msg) (*dns.Msg, error) { return makeAResponse(msg, "192.0.2.1"), nil },
+	}}
+	server := newServerForTest([]resolver.DnsResolver{proxy})
+	server.dnsCache = util.NewDnsCache(time.Minute)
+	server.apiKey = "secret"
+	for _, name := range []string{"www.example.com.", "example.com.", "example.org.", "mail.example.com."} {
+		msg := makeQuery(name, dns.TypeA)
+		server.dnsMsgHandler(&DnsWriter{writer: newCaptureDNSResponseWriter(), msg: msg, start: time.Now().UnixMilli()}, msg)
+	}
+	aaaa := makeQuery("example.com.", dns.TypeAAAA)
+	server.dnsCache.Set(util.KeyOf(aaaa), *aaaa, 0)
+
+	call := func(method, target string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set(apiKeyHeader, "secret")
+		rec := httptest.NewRecorder()
+		server.httpMux().ServeHTTP(rec, req)
+		return rec
+	}
+	list := func(target string) cacheListResponse {
+		t.Helper()
+		rec := call(http.MethodGet, target)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s status = %d, want 200: %s", target, rec.Code, rec.Body.String())
+		}
+		var resp cacheListResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode %q: %v", rec.Body.String(), err)
+		}
+		return resp
+	}
+
+	rec := httptest.NewRecorder()
+	server.httpMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/cache", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status without key = %d, want 401", rec.Code)
+	}
+
+	resp := list("/api/cache?suffix=Example.com&limit=2&offset=1")
+	if resp.Total != 4 || len(resp.Entries) != 2 {
+		t.Fatalf("list = %+v, want 2 of 4 entries under example.com", resp)
+	}
+	// Sorted by name then type: example.com. A, example.com. AAAA, mail..., www...
+	if e := resp.Entries[0]; e.Name != "example.com." || e.Type != "AAAA" || e.Resolver != "" {
+		t.Fatalf("entries[0] = %+v, want example.com. AAAA without a resolver", e)
+	}
+	if e := resp.Entries[1]; e.Name != "mail.example.com." || e.Type != "A" || e.Resolver != "proxy" || e.TTL != 60 || e.Stale {
+		t.Fatalf("entries[1] = %+v, want mail.example.com. A from proxy with ttl 60", e)
+	}
+	if resp := list("/api/cache?offset=9223372036854775800"); resp.Total != 5 || len(resp.Entries) != 0 {
+		t.Fatalf("list past the end = %+v, want no entries of 5", resp)
+	}
+	if resp := list("/api/cache?type=aaaa"); resp.Total != 1 {
+		t.Fatalf("type filter total = %d, want 1", resp.Total)
+	}
+	for _, target := range []string{"/api/cache?type=bogus", "/api/cache?limit=0", "/api/cache?offset=-1"} {
+		if rec := call(http.MethodGet, target); rec.Code != http.StatusBadRequest {
+			t.Fatalf("GET %s status = %d, want 400", target, rec.Code)
+		}
+	}
+
+	deleted := func(target string, want int) {
+		t.Helper()
+		rec := call(http.MethodDelete, target)
+		var body map[string]int
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusOK || body["deleted"] != want {
+			t.Fatalf("DELETE %s = %d %s, want %d deleted", target, rec.Code, rec.Body.String(), want)
+		}
+	}
+	deleted("/api/cache?name=example.com", 2)
+	deleted("/api/cache?suffix=example.com", 2)
+	if resp := list("/api/cache"); resp.Total != 1 || resp.Entries[0].Name != "example.org." {
+		t.Fatalf("after deletes = %+v, want only example.org.", resp)
+	}
+	for _, target := range []string{"/api/cache", "/api/cache?name=a.com&suffix=b.com", "/api/cache?all=true&name=a.com"} {
+		if rec := call(http.MethodDelete, target); rec.Code != http.StatusBadRequest {
+			t.Fatalf("DELETE %s status = %d, want 400", target, rec.Code)
+		}
+	}
+	deleted("/api/cache?all=true", 1)
+	if stats := server.dnsCache.(util.StatsCache).Stats(); stats.Entries != 0 || stats.Bytes != 0 {
+		t.Fatalf("stats after flush = %+v, want empty", stats)
+	}
+
+	server.dnsCache = &util.NoCache{}
+	if rec := call(http.MethodGet, "/api/cache"); rec.Code != http.StatusNotFound {
+		t.Fatalf("status without cache = %d, want 404", rec.Code)
+	}
+}
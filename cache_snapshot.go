@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"dns-switchy/resolver"
+	"dns-switchy/util"
+)
+
+// cacheSnapshotVersion is bumped when the snapshot layout changes; a snapshot
+// of another version is ignored rather than misread.
+const cacheSnapshotVersion = 2
+
+type cacheSnapshot struct {
+	Version int                `json:"version"`
+	Records []util.CacheRecord `json:"records"`
+}
+
+// saveCacheSnapshot writes the cache's entries to path atomically (temp file
+// in the same directory + rename), so a crash mid-write leaves the previous
+// snapshot intact. Caches that cannot be snapshotted write nothing.
+func saveCacheSnapshot(cache util.Cache, path string) error {
+	pc, ok := cache.(util.PersistentCache)
+	if !ok {
+		return nil
+	}
+	b, err := json.Marshal(cacheSnapshot{Version: cacheSnapshotVersion, Records: pc.Records()})
+	if err != nil {
+		return fmt.Errorf("encode cache snapshot: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".dns-switchy-cache-*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temp cache snapshot: %w", err)
+	}
+	tmpName := tmp.Name()
+	if _, err = tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmpName)
+		return fmt.Errorf("write temp cache snapshot: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		_ = os.Remove(tmpName)
+		return fmt.Errorf("close temp cache snapshot: %w", err)
+	}
+	if err = os.Rename(tmpName, path); err != nil {
+		_ = os.Remove(tmpName)
+		return fmt.Errorf("rename temp cache snapshot: %w", err)
+	}
+	return nil
+}
+
+// loadCacheSnapshot fills cache from the snapshot at path, keeping only the
+// entries produced by one of resolvers: an answer routed by a resolver that
+// was since removed or renamed would otherwise outlive the routing change. A
+// missing file is not an error (first start, or persistence just enabled).
+func loadCacheSnapshot(cache util.Cache, path string, resolvers []resolver.DnsResolver) (int, error) {
+	pc, ok := cache.(util.PersistentCache)
+	if !ok {
+		return 0, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("read cache snapshot: %w", err)
+	}
+	var snapshot cacheSnapshot
+	if err = json.Unmarshal(b, &snapshot); err != nil {
+		return 0, fmt.Errorf("decode cache snapshot: %w", err)
+	}
+	if snapshot.Version != cacheSnapshotVersion {
+		return 0, fmt.Errorf("cache snapshot version %d, want %d", snapshot.Version, cacheSnapshotVersion)
+	}
+	owners := make(map[string]bool, len(resolvers))
+	for _, r := range resolvers {
+		owners[resolverName(r)] = true
+	}
+	return pc.Restore(snapshot.Records, func(owner string) bool { return owners[owner] }), nil
+}
+
+// resolverName is how a resolver is named in logs and cache snapshots.
+func resolverName(r resolver.DnsResolver) string {
+	return fmt.Sprintf("%s", r)
+}
+
+// saveCache writes the cache snapshot when persist-file is set. Failures are
+// logged only: losing a snapshot costs a slower warm-up, nothing more.
+func (s *DnsSwitchyServer) saveCache() {
+	if s.persistFile == "" {
+		return
+	}
+	if err := saveCacheSnapshot(s.dnsCache, s.persistFile); err != nil {
+		log.Printf("cache snapshot %s: %s", s.persistFile, err)
+	}
+}
+
+// persistCache saves the cache every interval until the returned stop func is
+// called.
+func (s *DnsSwitchyServer) persistCache(interval time.Duration) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.saveCache()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"dns-switchy/config"
+	"dns-switchy/resolver"
+	"dns-switchy/util"
+
+	"github.com/miekg/dns"
+)
+
+type namedResolver struct {
+	testResolver
+	name string
+}
+
+func (r *namedResolver) String() string {
+	return r.name
+}
+
+func TestCacheSnapshotSurvivesRestart(t *testing.T) {
+	answer := func(ip string) *namedResolver {
+		return &namedResolver{testResolver: testResolver{
+			acceptFn:  func(msg *dns.Msg) bool { return msg.Question[0].Name == "example.com." },
+			resolveFn: func(msg *dns.Msg) (*dns.Msg, error) { return makeAResponse(msg, ip), nil },
+			ttl:       time.Minute,
+		}}
+	}
+	proxy, direct := answer("192.0.2.1"), answer("192.0.2.2")
+	proxy.name, direct.name = "proxy", "direct"
+	direct.acceptFn = func(*dns.Msg) bool { return true }
+
+	server := newServerForTest([]resolver.DnsResolver{proxy, direct})
+	server.dnsCache = util.NewDnsCache(time.Minute)
+	server.persistFile = filepath.Join(t.TempDir(), "cache.json")
+	for _, name := range []string{"example.com.", "example.org."} {
+		writer := newCaptureDNSResponseWriter()
+		msg := makeQuery(name, dns.TypeA)
+		server.dnsMsgHandler(&DnsWriter{writer: writer, msg: msg, start: time.Now().UnixMilli()}, msg)
+	}
+	server.Shutdown()
+	if _, err := os.Stat(server.persistFile); err != nil {
+		t.Fatalf("snapshot not written on Shutdown: %v", err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(server.persistFile), ".dns-switchy-cache-*")); len(matches) != 0 {
+		t.Fatalf("temp files left behind: %v", matches)
+	}
+
+	// The new config dropped the proxy resolver: its answer must not come back.
+	cache := util.NewDnsCache(time.Minute)
+	n, err := loadCacheSnapshot(cache, server.persistFile, []resolver.DnsResolver{direct})
+	if err != nil || n != 1 {
+		t.Fatalf("loadCacheSnapshot() = %d, %v, want 1 entry", n, err)
+	}
+	if got := cache.Get(util.KeyOf(makeQuery("example.com.", dns.TypeA))); len(got.Answer) != 0 {
+		t.Fatalf("proxy answer restored without its resolver: %v", got)
+	}
+	got := cache.Get(util.KeyOf(makeQuery("example.org.", dns.TypeA)))
+	if len(got.Answer) != 1 || got.Answer[0].(*dns.A).A.String() != "192.0.2.2" {
+		t.Fatalf("restored direct answer = %v, want 192.0.2.2", got)
+	}
+
+	if n, err := loadCacheSnapshot(cache, filepath.Join(t.TempDir(), "missing.json"), nil); n != 0 || err != nil {
+		t.Fatalf("loadCacheSnapshot(missing) = %d, %v, want 0, nil", n, err)
+	}
+}
+
+func TestCreateRestoresCacheSnapshot(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cache.json")
+	conf := &config.SwitchyConfig{
+		TTL:       time.Minute,
+		Cache:     config.CacheConfig{MaxEntries: 10, PersistFile: file},
+		Resolvers: []config.ResolverConfig{&config.MockConfig{Answer: "192.0.2.7"}},
+	}
+	first, err := Create(conf)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	mock := first.gen.Load().resolvers[0]
+	q := makeQuery("example.com.", dns.TypeA)
+	first.cacheAnswer(mock, util.KeyOf(q), makeAResponse(q, "192.0.2.7"), time.Minute)
+	first.Shutdown()
+
+	second, err := Create(conf)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	defer second.Shutdown()
+	if got := second.dnsCache.Get(util.KeyOf(q)); len(got.Answer) != 1 {
+		t.Fatalf("Get() after restart = %v, want the snapshot entry", got)
+	}
+}
+
+func TestReloadServerWritesSnapshotOnce(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cache.json")
+	conf := &config.SwitchyConfig{
+		Addr:      reserveUDPAddr(t),
+		TTL:       time.Minute,
+		Cache:     config.CacheConfig{MaxEntries: 10, PersistFile: file},
+		Resolvers: []config.ResolverConfig{&config.MockConfig{Answer: "192.0.2.7"}},
+	}
+	first, err := reloadServer(nil, conf)
+	if err != nil {
+		t.Fatalf("initial reloadServer fail: %v", err)
+	}
+	q := makeQuery("example.com.", dns.TypeA)
+	first.cacheAnswer(first.gen.Load().resolvers[0], util.KeyOf(q), makeAResponse(q, "192.0.2.7"), time.Minute)
+
+	second, err := reloadServer(first, conf)
+	if err != nil {
+		t.Fatalf("reloadServer fail: %v", err)
+	}
+	defer second.Shutdown()
+	if got := second.dnsCache.Get(util.KeyOf(q)); len(got.Answer) != 1 {
+		t.Fatalf("Get() after reload = %v, want the entry saved before Create", got)
+	}
+	// The snapshot taken before Create is the reload's only write; the retired
+	// server is shut down without writing it again.
+	if err = os.Remove(file); err != nil {
+		t.Fatalf("remove snapshot fail: %v", err)
+	}
+	retired := newServerForTest(nil)
+	retired.dnsCache = util.NewDnsCache(time.Minute)
+	retired.persistFile = file
+	retired.shutdown(false)
+	if _, err = os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("shutdown(false) wrote the snapshot: %v", err)
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"gopkg.in/yaml.v3"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -204,10 +206,184 @@ type SwitchyConfig struct {
 	Addr        string
 	TTL         time.Duration
 	Http        *HttpConfig
+	TLS         *TLSConfig
+	Quic        string // DoQ listen addr; serves with the TLS certificate
+	Listeners   []ListenerConfig
 	Resolvers   []ResolverConfig
 	NftSetTable string // 统一 nft 表/族，默认 "inet fw4"
 	// ApiKey 非空时，全部 /api/* 需带 X-Api-Key 头；缺省空 = 不鉴权（向后兼容）。
-	ApiKey string
+	ApiKey    string
+	ACL       *ACLConfig       // nil = 不限制来源
+	RateLimit *RateLimitConfig // nil = 不限速
+	// LeaseFile 是 dnsmasq 租约文件，source/clients 里的 MAC 与主机名经它查到 IP。
+	LeaseFile string
+	// Clients 是具名客户端组，resolver 的 source 可直接引用组名，日志与
+	// /api/query 也按组名标注来源。条目已校验为 CIDR/IP/MAC/租约主机名。
+	Clients map[string][]string
+	Cache   CacheConfig
+}
+
+// ACL defaults accepted in the `acl:` block.
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+)
+
+// Ways to turn away a query rejected by `acl:` or `rate_limit:`.
+const (
+	ActionRefuse = "refuse"
+	ActionDrop   = "drop"
+)
+
+// ACLConfig 限制哪些来源网段可以查询。匹配按最长前缀：allow 与 deny 中最具体的
+// 那条生效，同样长度时 deny 优先；都不命中时按 Default。被拒绝的查询按 Action
+// 回 REFUSED 或直接丢弃。
+type ACLConfig struct {
+	Allow   []netip.Prefix
+	Deny    []netip.Prefix
+	Default string // allow | deny
+	Action  string // refuse | drop
+}
+
+// RateLimitConfig 是按来源的令牌桶限速。QPS/Burst 作用于单个来源 IP，
+// PrefixQPS/PrefixBurst 作用于来源所在的 /IPv4Prefix 或 /IPv6Prefix 网段；
+// 任一为 0 表示不启用该层。Allow 中的来源不受限速。
+type RateLimitConfig struct {
+	QPS         float64
+	Burst       int
+	PrefixQPS   float64
+	PrefixBurst int
+	IPv4Prefix  int
+	IPv6Prefix  int
+	Action      string // refuse | drop
+	Allow       []netip.Prefix
+}
+
+type _RateLimitConfig struct {
+	QPS         float64  `yaml:"qps,omitempty"`
+	Burst       int      `yaml:"burst,omitempty"`
+	PrefixQPS   float64  `yaml:"prefix_qps,omitempty"`
+	PrefixBurst int      `yaml:"prefix_burst,omitempty"`
+	IPv4Prefix  int      `yaml:"ipv4_prefix,omitempty"`
+	IPv6Prefix  int      `yaml:"ipv6_prefix,omitempty"`
+	Action      string   `yaml:"action,omitempty"`
+	Allow       []string `yaml:"allow,omitempty"`
+}
+
+const (
+	// defaultStaleTTL 是过期应答回给客户端的 TTL，取 RFC 8767 建议的 30s。
+	defaultStaleTTL = 30 * time.Second
+	// defaultCacheEntries 约合几 MB 内存，128 MB 的路由器也放得下。
+	defaultCacheEntries = 10000
+	// defaultPersistInterval 兼顾断电丢失的条目数与 flash 写入次数。
+	defaultPersistInterval = 15 * time.Minute
+	// defaultPrefetchHits 把只被问过一两次的名字排除在预取之外。
+	defaultPrefetchHits = 3
+)
+
+// CacheConfig 是全局缓存的可选行为。除条目数上限外，零值即原有行为：不配
+// `cache:` 时 normalizeCache 仍把 MaxEntries 设为 defaultCacheEntries，缓存按
+// LRU 淘汰，不再无限增长。ServeStale > 0 时过期条目再保留这么久：应答的
+// resolver 失败时改回过期应答（TTL 为 StaleTTL），同时在后台重新解析
+// （RFC 8767）。UpstreamTTL 时缓存时长取应答里最小的记录 TTL，
+// 夹在 [MinTTL, MaxTTL] 之间（MaxTTL 为 0 不设上限），命中时记录 TTL 扣掉已在
+// 缓存里的时间；resolver 与全局 ttl 只剩 -1s 禁用缓存的作用。MaxNegativeTTL > 0
+// 时 NXDOMAIN/NODATA 也缓存，时长按 RFC 2308 取权威段 SOA 的 TTL 与 MINIMUM 中
+// 较小者，不超过 MaxNegativeTTL。缓存按 LRU 淘汰，条目数不超过 MaxEntries、
+// 应答线格式总大小约不超过 MaxBytes（0 = 不限）。PersistFile 非空时缓存在
+// Shutdown 时、并每隔 PersistInterval（0 = 只在 Shutdown 时）写入该文件，下次
+// Create 时读回。Prefetch > 0 时，本轮有效期内命中不少于 PrefetchHits 次的条目
+// 在剩余有效期不足 Prefetch% 时后台刷新。
+type CacheConfig struct {
+	ServeStale      time.Duration
+	StaleTTL        time.Duration
+	UpstreamTTL     bool
+	MinTTL          time.Duration
+	MaxTTL          time.Duration
+	MaxNegativeTTL  time.Duration
+	MaxEntries      int
+	MaxBytes        int
+	PersistFile     string
+	PersistInterval time.Duration
+	Prefetch        int
+	PrefetchHits    int
+}
+
+type _CacheConfig struct {
+	ServeStale  time.Duration `yaml:"serve-stale,omitempty"`
+	StaleTTL    time.Duration `yaml:"stale-ttl,omitempty"`
+	UpstreamTTL bool          `yaml:"upstream-ttl,omitempty"`
+	MinTTL      time.Duration `yaml:"min-ttl,omitempty"`
+	MaxTTL      time.Duration `yaml:"max-ttl,omitempty"`
+	// MaxNegativeTTL 为 0（缺省）时不缓存否定应答。
+	MaxNegativeTTL time.Duration `yaml:"max-negative-ttl,omitempty"`
+	MaxEntries     int           `yaml:"max-entries,omitempty"` // 缺省 10000，-1 = 不限
+	MaxBytes       int           `yaml:"max-bytes,omitempty"`   // 缺省 0 = 不限
+	// PersistFile 相对路径按配置文件所在目录解析；空 = 不持久化。
+	PersistFile     string        `yaml:"persist-file,omitempty"`
+	PersistInterval time.Duration `yaml:"persist-interval,omitempty"` // 缺省 15m，-1s = 只在退出时写
+	Prefetch        int           `yaml:"prefetch,omitempty"`         // 剩余有效期百分比，0（缺省）= 不预取
+	PrefetchHits    int           `yaml:"prefetch-hits,omitempty"`    // 缺省 3
+}
+
+type _ACLConfig struct {
+	Allow   []string `yaml:"allow,omitempty"`
+	Deny    []string `yaml:"deny,omitempty"`
+	Default string   `yaml:"default,omitempty"`
+	Action  string   `yaml:"action,omitempty"`
+}
+
+// Listener protocols accepted in `listen:` entries.
+const (
+	ProtocolUDP   = "udp"
+	ProtocolTCP   = "tcp"
+	ProtocolTLS   = "tls"
+	ProtocolHTTPS = "https"
+	ProtocolQUIC  = "quic"
+)
+
+// ListenerConfig is one DNS listener. Label tags every query that arrives on
+// it (logs, per-listener policies); it defaults to "<protocol>://<addr>".
+type ListenerConfig struct {
+	Addr     string `yaml:"addr,omitempty"`
+	Protocol string `yaml:"protocol,omitempty"`
+	Label    string `yaml:"label,omitempty"`
+}
+
+func (l ListenerConfig) String() string {
+	return l.Protocol + "://" + l.Addr
+}
+
+// AllListeners expands the shorthand fields and the explicit `listen:` list
+// into the full set of listeners to bind:
+//   - addr     -> udp + tcp on the same address (omitted when only `listen:`
+//     entries are configured)
+//   - tls.addr -> tls
+//   - quic     -> quic
+func (c *SwitchyConfig) AllListeners() []ListenerConfig {
+	out := make([]ListenerConfig, 0, len(c.Listeners)+4)
+	if c.Addr != "" || len(c.Listeners) == 0 {
+		out = append(out,
+			withDefaultLabel(ListenerConfig{Addr: c.Addr, Protocol: ProtocolUDP}),
+			withDefaultLabel(ListenerConfig{Addr: c.Addr, Protocol: ProtocolTCP}))
+	}
+	if c.TLS != nil && c.TLS.Addr != "" {
+		out = append(out, withDefaultLabel(ListenerConfig{Addr: c.TLS.Addr, Protocol: ProtocolTLS}))
+	}
+	if c.Quic != "" {
+		out = append(out, withDefaultLabel(ListenerConfig{Addr: c.Quic, Protocol: ProtocolQUIC}))
+	}
+	for _, l := range c.Listeners {
+		out = append(out, withDefaultLabel(l))
+	}
+	return out
+}
+
+func withDefaultLabel(l ListenerConfig) ListenerConfig {
+	if l.Label == "" {
+		l.Label = l.String()
+	}
+	return l
 }
 
 // DefaultNftSetTable 是 add element 的目标表/族，对应路由器 fw4 的 inet 表。
@@ -237,13 +413,38 @@ func (h *HttpConfig) CreateListener() (net.Listener, error) {
 	return net.Listen(h.Network, h.Addr)
 }
 
+// TLSConfig is the DNS-over-TLS listener and the certificate shared by every
+// encrypted listener. Cert and Key are PEM files; relative paths are resolved
+// against the config file's directory. An empty Addr loads the certificate
+// without serving DoT (e.g. DoQ only).
+type TLSConfig struct {
+	Addr string `yaml:"addr,omitempty"`
+	Cert string `yaml:"cert,omitempty"`
+	Key  string `yaml:"key,omitempty"`
+}
+
+func (t *TLSConfig) String() string {
+	if t == nil {
+		return ""
+	}
+	return t.Addr
+}
+
 type _SwitchyConfig struct {
 	Addr        string                   `yaml:"addr,omitempty"`
 	TTL         time.Duration            `yaml:"ttl,omitempty"`
 	Http        string                   `yaml:"http,omitempty"`
+	TLS         *TLSConfig               `yaml:"tls,omitempty"`
+	Quic        string                   `yaml:"quic,omitempty"`
+	Listen      []ListenerConfig         `yaml:"listen,omitempty"`
 	Resolvers   []map[string]interface{} `yaml:"resolvers,omitempty"`
 	NftSetTable string                   `yaml:"nftset_table,omitempty"`
 	ApiKey      string                   `yaml:"api_key,omitempty"`
+	ACL         *_ACLConfig              `yaml:"acl,omitempty"`
+	RateLimit   *_RateLimitConfig        `yaml:"rate_limit,omitempty"`
+	LeaseFile   string                   `yaml:"lease_file,omitempty"`
+	Clients     map[string][]string      `yaml:"clients,omitempty"`
+	Cache       _CacheConfig             `yaml:"cache,omitempty"`
 }
 
 type ResolverType string
@@ -263,8 +464,9 @@ type ResolverConfig interface {
 }
 
 type FilterConfig struct {
-	Rule      []string `yaml:"rule,omitempty"`
-	QueryType []string `yaml:"queryType,omitempty"`
+	Rule         []string `yaml:"rule,omitempty"`
+	QueryType    []string `yaml:"queryType,omitempty"`
+	SourceConfig `yaml:",inline"`
 }
 
 func (f FilterConfig) Type() ResolverType {
@@ -278,6 +480,12 @@ type NftSetConfig struct {
 	NftSetTTL time.Duration `yaml:"nftset_ttl,omitempty"` // 元素 timeout，须 ≥ 该 resolver 生效缓存 TTL
 }
 
+// SourceConfig 让 resolver 只处理来自这些客户端的查询：CIDR、单个 IP、MAC（经
+// lease_file 查 DHCP 租约）或 clients 里的组名（解析时展开）。缺省不限来源。
+type SourceConfig struct {
+	Source []string `yaml:"source,omitempty"`
+}
+
 type FileConfig struct {
 	Location        string            `yaml:"location,omitempty"`
 	RefreshInterval time.Duration     `yaml:"refreshInterval,omitempty"`
@@ -285,6 +493,7 @@ type FileConfig struct {
 	ExtraContent    string            `yaml:"extraContent,omitempty"`
 	ExtraConfig     map[string]string `yaml:"extraConfig,omitempty"`
 	NftSetConfig    `yaml:",inline"`
+	SourceConfig    `yaml:",inline"`
 }
 
 func (h FileConfig) Type() ResolverType {
@@ -292,15 +501,38 @@ func (h FileConfig) Type() ResolverType {
 }
 
 type ForwardConfig struct {
-	Name           string        `yaml:"name,omitempty"`
-	TTL            time.Duration `yaml:"ttl,omitempty"`
-	BreakOnFail    bool          `yaml:"break-on-fail,omitempty"`
-	Rule           []string      `yaml:"rule,omitempty"`
-	UpstreamConfig `yaml:",inline"`
-	Upstreams      []UpstreamConfig `yaml:"upstreams,omitempty"`
-	NftSetConfig   `yaml:",inline"`
+	Name             string        `yaml:"name,omitempty"`
+	TTL              time.Duration `yaml:"ttl,omitempty"`
+	BreakOnFail      bool          `yaml:"break-on-fail,omitempty"`
+	Rule             []string      `yaml:"rule,omitempty"`
+	UpstreamConfig   `yaml:",inline"`
+	Upstreams        []UpstreamConfig `yaml:"upstreams,omitempty"`
+	Strategy         string           `yaml:"strategy,omitempty"`          // 多个上游时怎么选，缺省 race
+	FailThreshold    int              `yaml:"fail-threshold,omitempty"`    // 单个上游连续失败几次判死，缺省 5
+	RecoverThreshold int              `yaml:"recover-threshold,omitempty"` // 死掉的上游连续探测成功几次复活，缺省 5
+	Probe            *ProbeConfig     `yaml:"probe,omitempty"`             // 主动探测上游，不设则只靠客户端查询判断健康
+	ExpectIP         []string         `yaml:"expect-ip,omitempty"`         // A/AAAA 答案须落在这些网段内，否则当失败；支持 include:
+	BogusIP          []string         `yaml:"bogus-ip,omitempty"`          // A/AAAA 答案落在这些网段内就当失败；支持 include:
+	NftSetConfig     `yaml:",inline"`
+	SourceConfig     `yaml:",inline"`
 }
 
+// ProbeConfig 让 forward 每隔 Interval 用一条自己的查询探测每个上游。
+type ProbeConfig struct {
+	Interval time.Duration `yaml:"interval,omitempty"` // 探测间隔，必填
+	Name     string        `yaml:"name,omitempty"`     // 探测查询的域名，缺省 "."
+	Type     string        `yaml:"type,omitempty"`     // 探测查询的类型，缺省 NS
+}
+
+// 多上游的选择策略。除 race 外都是一次只问一个上游，失败了再按顺序问下一个。
+const (
+	StrategyRace          = "race"                // 全部并发，取最先成功的应答
+	StrategySequential    = "sequential-fallback" // 按配置顺序
+	StrategyRoundRobin    = "round-robin"         // 轮流做第一个
+	StrategyWeighted      = "weighted-random"     // 按 weight 随机选第一个
+	StrategyLowestLatency = "lowest-latency"      // 平滑 RTT 最低的先问
+)
+
 type DnsConfig struct {
 	ServerIP []net.IP      `yaml:"serverIP,omitempty"`
 	Timeout  time.Duration `yaml:"timeout,omitempty"`
@@ -313,10 +545,13 @@ func (f ForwardConfig) Type() ResolverType {
 type UpstreamConfig struct {
 	Url    string    `yaml:"url,omitempty"`
 	Config DnsConfig `yaml:"config,omitempty"`
+	Weight int       `yaml:"weight,omitempty"` // weighted-random 的权重，缺省 1
 }
 
 type PreloaderConfig struct {
 	ForwardConfig `yaml:",inline"`
+	MaxEntries    int           `yaml:"max-entries,omitempty"`  // 预加载的名字上限，缺省 1000，-1 = 不限
+	IdleTimeout   time.Duration `yaml:"idle-timeout,omitempty"` // 多久没有客户端查询就不再刷新，缺省 24h，-1s = 一直刷新
 }
 
 func (p PreloaderConfig) Type() ResolverType {
@@ -324,9 +559,10 @@ func (p PreloaderConfig) Type() ResolverType {
 }
 
 type MockConfig struct {
-	Rule      []string `yaml:"rule,omitempty"`
-	QueryType []string `yaml:"queryType,omitempty"`
-	Answer    string
+	Rule         []string `yaml:"rule,omitempty"`
+	QueryType    []string `yaml:"queryType,omitempty"`
+	Answer       string
+	SourceConfig `yaml:",inline"`
 }
 
 func (m MockConfig) Type() ResolverType {
@@ -336,11 +572,12 @@ func (m MockConfig) Type() ResolverType {
 // MdnsConfig 配置 mDNS 桥接 resolver(querier-only,见 docs/adr/0001)。
 // Interface 必填:组播组加错接口是静默故障(永远 miss),必须显式指定 LAN 口。
 type MdnsConfig struct {
-	Interface   string        `yaml:"interface,omitempty"`    // 组播出入接口,必填,如 br-lan
-	TTL         time.Duration `yaml:"ttl,omitempty"`          // 命中 A 记录的正缓存,默认 1m
-	NegativeTTL time.Duration `yaml:"negative-ttl,omitempty"` // miss 的负缓存,默认 30s
-	Timeout     time.Duration `yaml:"timeout,omitempty"`      // 组播等待窗口,默认 1s
-	Rule        []string      `yaml:"rule,omitempty"`         // 缺省 [local]
+	Interface    string        `yaml:"interface,omitempty"`    // 组播出入接口,必填,如 br-lan
+	TTL          time.Duration `yaml:"ttl,omitempty"`          // 命中 A 记录的正缓存,默认 1m
+	NegativeTTL  time.Duration `yaml:"negative-ttl,omitempty"` // miss 的负缓存,默认 30s
+	Timeout      time.Duration `yaml:"timeout,omitempty"`      // 组播等待窗口,默认 1s
+	Rule         []string      `yaml:"rule,omitempty"`         // 缺省 [local]
+	SourceConfig `yaml:",inline"`
 }
 
 func (m MdnsConfig) Type() ResolverType {
@@ -354,6 +591,14 @@ func ParseConfig(contentReader io.Reader) (*SwitchyConfig, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error parsing config file: %s", err)
 	}
+	leaseFile := strings.TrimSpace(_config.LeaseFile)
+	if leaseFile != "" {
+		leaseFile = resolveLocalPath(leaseFile, basePath)
+	}
+	clients, err := normalizeClients(_config.Clients, leaseFile != "")
+	if err != nil {
+		return nil, err
+	}
 	resolverConfigs := make([]ResolverConfig, 0, len(_config.Resolvers))
 	for index, resolver := range _config.Resolvers {
 		resolverType, err := extractResolverType(resolver, index)
@@ -385,6 +630,15 @@ func ParseConfig(contentReader io.Reader) (*SwitchyConfig, error) {
 		if err = normalizeResolverRules(filter, basePath); err != nil {
 			return nil, err
 		}
+		if err = normalizeResolverSource(filter, clients, leaseFile != ""); err != nil {
+			return nil, fmt.Errorf("resolver[%d]: %w", index, err)
+		}
+		if err = validateForward(filter); err != nil {
+			return nil, fmt.Errorf("resolver[%d]: %w", index, err)
+		}
+		if err = normalizeAnswerIP(filter, basePath); err != nil {
+			return nil, fmt.Errorf("resolver[%d]: %w", index, err)
+		}
 		resolverConfigs = append(resolverConfigs, filter)
 	}
 	httpConfig, err := ParseHttpAddr(_config.Http)
@@ -402,17 +656,486 @@ func ParseConfig(contentReader io.Reader) (*SwitchyConfig, error) {
 	if _config.ApiKey != "" && apiKey == "" {
 		return nil, fmt.Errorf("api_key is whitespace-only; remove the key entirely to disable auth")
 	}
+	tlsConfig, err := normalizeTLSConfig(_config.TLS, basePath)
+	if err != nil {
+		return nil, err
+	}
+	quicAddr := strings.TrimSpace(_config.Quic)
+	if quicAddr != "" && tlsConfig == nil {
+		return nil, fmt.Errorf("quic: requires a tls block with cert and key")
+	}
+	listeners, err := normalizeListeners(_config.Listen, tlsConfig != nil)
+	if err != nil {
+		return nil, err
+	}
+	acl, err := normalizeACL(_config.ACL)
+	if err != nil {
+		return nil, err
+	}
+	rateLimit, err := normalizeRateLimit(_config.RateLimit)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := normalizeCache(_config.Cache, basePath)
+	if err != nil {
+		return nil, err
+	}
 	warnNftSetTTL(resolverConfigs, _config.TTL)
 	return &SwitchyConfig{
 		Addr:        _config.Addr,
 		TTL:         _config.TTL,
 		Http:        httpConfig,
+		TLS:         tlsConfig,
+		Quic:        quicAddr,
+		Listeners:   listeners,
 		Resolvers:   resolverConfigs,
 		NftSetTable: nftSetTable,
 		ApiKey:      apiKey,
+		ACL:         acl,
+		RateLimit:   rateLimit,
+		LeaseFile:   leaseFile,
+		Clients:     clients,
+		Cache:       cache,
 	}, nil
 }
 
+// normalizeTLSConfig requires cert/key once a tls block is present and resolves
+// them against basePath, so the fsnotify watcher and the loader see the same
+// absolute files.
+func normalizeTLSConfig(tc *TLSConfig, basePath string) (*TLSConfig, error) {
+	if tc == nil {
+		return nil, nil
+	}
+	out := &TLSConfig{
+		Addr: strings.TrimSpace(tc.Addr),
+		Cert: strings.TrimSpace(tc.Cert),
+		Key:  strings.TrimSpace(tc.Key),
+	}
+	if out.Cert == "" || out.Key == "" {
+		return nil, fmt.Errorf("tls: cert and key are required")
+	}
+	out.Cert = resolveLocalPath(out.Cert, basePath)
+	out.Key = resolveLocalPath(out.Key, basePath)
+	return out, nil
+}
+
+// normalizeListeners validates `listen:` entries: addr is required, protocol is
+// one of udp/tcp/tls/https/quic (default udp), and the encrypted protocols need
+// the tls certificate.
+func normalizeListeners(entries []ListenerConfig, hasCert bool) ([]ListenerConfig, error) {
+	out := make([]ListenerConfig, 0, len(entries))
+	for i, l := range entries {
+		l.Addr = strings.TrimSpace(l.Addr)
+		l.Protocol = strings.ToLower(strings.TrimSpace(l.Protocol))
+		l.Label = strings.TrimSpace(l.Label)
+		if l.Addr == "" {
+			return nil, fmt.Errorf("listen[%d]: addr is required", i)
+		}
+		if l.Protocol == "" {
+			l.Protocol = ProtocolUDP
+		}
+		switch l.Protocol {
+		case ProtocolUDP, ProtocolTCP:
+		case ProtocolTLS, ProtocolHTTPS, ProtocolQUIC:
+			if !hasCert {
+				return nil, fmt.Errorf("listen[%d]: protocol %s requires a tls block with cert and key", i, l.Protocol)
+			}
+		default:
+			return nil, fmt.Errorf("listen[%d]: unknown protocol %q", i, l.Protocol)
+		}
+		out = append(out, l)
+	}
+	return out, nil
+}
+
+// normalizeACL parses the CIDR lists and fills the defaults: with an allow list
+// the default is deny (an allowlist), otherwise allow; the action is refuse.
+func normalizeACL(ac *_ACLConfig) (*ACLConfig, error) {
+	if ac == nil {
+		return nil, nil
+	}
+	out := &ACLConfig{
+		Default: strings.ToLower(strings.TrimSpace(ac.Default)),
+		Action:  strings.ToLower(strings.TrimSpace(ac.Action)),
+	}
+	var err error
+	if out.Allow, err = parsePrefixes("acl.allow", ac.Allow); err != nil {
+		return nil, err
+	}
+	if out.Deny, err = parsePrefixes("acl.deny", ac.Deny); err != nil {
+		return nil, err
+	}
+	switch out.Default {
+	case "":
+		out.Default = ACLAllow
+		if len(out.Allow) > 0 {
+			out.Default = ACLDeny
+		}
+	case ACLAllow, ACLDeny:
+	default:
+		return nil, fmt.Errorf("acl.default: unknown value %q, want allow or deny", ac.Default)
+	}
+	switch out.Action {
+	case "":
+		out.Action = ActionRefuse
+	case ActionRefuse, ActionDrop:
+	default:
+		return nil, fmt.Errorf("acl.action: unknown value %q, want refuse or drop", ac.Action)
+	}
+	return out, nil
+}
+
+// normalizeRateLimit validates the rates and fills the defaults: burst is twice
+// the rate (at least 1), prefixes are /24 and /56, the action is refuse.
+func normalizeRateLimit(rc *_RateLimitConfig) (*RateLimitConfig, error) {
+	if rc == nil {
+		return nil, nil
+	}
+	out := &RateLimitConfig{
+		QPS:         rc.QPS,
+		Burst:       rc.Burst,
+		PrefixQPS:   rc.PrefixQPS,
+		PrefixBurst: rc.PrefixBurst,
+		IPv4Prefix:  rc.IPv4Prefix,
+		IPv6Prefix:  rc.IPv6Prefix,
+		Action:      strings.ToLower(strings.TrimSpace(rc.Action)),
+	}
+	if out.QPS < 0 || out.PrefixQPS < 0 || out.Burst < 0 || out.PrefixBurst < 0 {
+		return nil, fmt.Errorf("rate_limit: qps and burst must not be negative")
+	}
+	if out.QPS == 0 && out.PrefixQPS == 0 {
+		return nil, fmt.Errorf("rate_limit: qps or prefix_qps is required")
+	}
+	if out.Burst == 0 {
+		out.Burst = defaultBurst(out.QPS)
+	}
+	if out.PrefixBurst == 0 {
+		out.PrefixBurst = defaultBurst(out.PrefixQPS)
+	}
+	if out.IPv4Prefix == 0 {
+		out.IPv4Prefix = 24
+	}
+	if out.IPv6Prefix == 0 {
+		out.IPv6Prefix = 56
+	}
+	if out.IPv4Prefix < 1 || out.IPv4Prefix > 32 {
+		return nil, fmt.Errorf("rate_limit.ipv4_prefix: %d out of range 1-32", out.IPv4Prefix)
+	}
+	if out.IPv6Prefix < 1 || out.IPv6Prefix > 128 {
+		return nil, fmt.Errorf("rate_limit.ipv6_prefix: %d out of range 1-128", out.IPv6Prefix)
+	}
+	switch out.Action {
+	case "":
+		out.Action = ActionRefuse
+	case ActionRefuse, ActionDrop:
+	default:
+		return nil, fmt.Errorf("rate_limit.action: unknown value %q, want refuse or drop", rc.Action)
+	}
+	var err error
+	if out.Allow, err = parsePrefixes("rate_limit.allow", rc.Allow); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func defaultBurst(qps float64) int {
+	return max(1, int(math.Ceil(qps*2)))
+}
+
+// normalizeCache validates the `cache:` block, fills the defaults and resolves
+// persist-file against basePath.
+func normalizeCache(cc _CacheConfig, basePath string) (CacheConfig, error) {
+	out := CacheConfig{
+		ServeStale:     cc.ServeStale,
+		StaleTTL:       cc.StaleTTL,
+		UpstreamTTL:    cc.UpstreamTTL,
+		MinTTL:         cc.MinTTL,
+		MaxTTL:         cc.MaxTTL,
+		MaxNegativeTTL: cc.MaxNegativeTTL,
+		MaxEntries:     cc.MaxEntries,
+		MaxBytes:       cc.MaxBytes,
+	}
+	if file := strings.TrimSpace(cc.PersistFile); file != "" {
+		out.PersistFile = resolveLocalPath(file, basePath)
+		switch {
+		case cc.PersistInterval == 0:
+			out.PersistInterval = defaultPersistInterval
+		case cc.PersistInterval > 0:
+			out.PersistInterval = cc.PersistInterval
+		}
+	}
+	if out.ServeStale < 0 || out.StaleTTL < 0 || out.MinTTL < 0 || out.MaxTTL < 0 || out.MaxNegativeTTL < 0 {
+		return CacheConfig{}, fmt.Errorf("cache: durations must not be negative")
+	}
+	if (out.MinTTL > 0 || out.MaxTTL > 0) && !out.UpstreamTTL {
+		return CacheConfig{}, fmt.Errorf("cache: min-ttl and max-ttl require upstream-ttl")
+	}
+	if out.MaxTTL > 0 && out.MinTTL > out.MaxTTL {
+		return CacheConfig{}, fmt.Errorf("cache: min-ttl %s exceeds max-ttl %s", out.MinTTL, out.MaxTTL)
+	}
+	if out.StaleTTL == 0 {
+		out.StaleTTL = defaultStaleTTL
+	}
+	switch {
+	case out.MaxEntries == 0:
+		out.MaxEntries = defaultCacheEntries
+	case out.MaxEntries == -1:
+		out.MaxEntries = 0
+	case out.MaxEntries < 0:
+		return CacheConfig{}, fmt.Errorf("cache.max-entries: %d, want a positive count or -1", out.MaxEntries)
+	}
+	if out.MaxBytes < 0 {
+		return CacheConfig{}, fmt.Errorf("cache.max-bytes: must not be negative")
+	}
+	if out.StaleTTL < time.Second {
+		return CacheConfig{}, fmt.Errorf("cache.stale-ttl: %s is below 1s", out.StaleTTL)
+	}
+	if cc.Prefetch < 0 || cc.Prefetch > 99 {
+		return CacheConfig{}, fmt.Errorf("cache.prefetch: %d, want a percentage between 1 and 99", cc.Prefetch)
+	}
+	if cc.PrefetchHits < 0 || cc.PrefetchHits > 0 && cc.Prefetch == 0 {
+		return CacheConfig{}, fmt.Errorf("cache.prefetch-hits: want a positive count together with prefetch")
+	}
+	if out.Prefetch = cc.Prefetch; out.Prefetch > 0 {
+		out.PrefetchHits = cc.PrefetchHits
+		if out.PrefetchHits == 0 {
+			out.PrefetchHits = defaultPrefetchHits
+		}
+	}
+	return out, nil
+}
+
+// normalizeClients validates every group entry as a CIDR, IP, MAC or lease
+// hostname and canonicalises it, so the runtime matchers never see a bad
+// entry. Hostnames are only allowed here: in a resolver's `source:` a bare
+// name is a group name.
+func normalizeClients(groups map[string][]string, hasLeases bool) (map[string][]string, error) {
+	if len(groups) == 0 {
+		return nil, nil
+	}
+	out := make(map[string][]string, len(groups))
+	for name, entries := range groups {
+		if strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("clients: group name is required")
+		}
+		group := make([]string, 0, len(entries))
+		for i, entry := range entries {
+			canonical, ok := parseSourceEntry(entry)
+			if !ok {
+				if canonical, ok = ParseLeaseHostname(entry); !ok {
+					return nil, fmt.Errorf("clients.%s[%d]: %q is not a CIDR, IP, MAC or hostname", name, i, entry)
+				}
+				if !hasLeases {
+					return nil, fmt.Errorf("clients.%s[%d]: hostname %s requires lease_file", name, i, canonical)
+				}
+			}
+			if _, isMAC := ParseMAC(canonical); isMAC && !hasLeases {
+				return nil, fmt.Errorf("clients.%s[%d]: MAC %s requires lease_file", name, i, canonical)
+			}
+			group = append(group, canonical)
+		}
+		out[name] = group
+	}
+	return out, nil
+}
+
+// validateForward rejects an unknown strategy, a negative upstream weight, a
+// negative health threshold or a probe without interval on forward-like
+// resolvers.
+func validateForward(resolverConfig ResolverConfig) error {
+	var fc *ForwardConfig
+	switch c := resolverConfig.(type) {
+	case *ForwardConfig:
+		fc = c
+	case *PreloaderConfig:
+		fc = &c.ForwardConfig
+	default:
+		return nil
+	}
+	switch fc.Strategy {
+	case "", StrategyRace, StrategySequential, StrategyRoundRobin, StrategyWeighted, StrategyLowestLatency:
+	default:
+		return fmt.Errorf("unknown strategy %q", fc.Strategy)
+	}
+	if fc.FailThreshold < 0 || fc.RecoverThreshold < 0 {
+		return fmt.Errorf("fail-threshold and recover-threshold must not be negative")
+	}
+	if fc.Probe != nil && fc.Probe.Interval <= 0 {
+		return fmt.Errorf("probe.interval must be positive")
+	}
+	for _, uc := range append([]UpstreamConfig{fc.UpstreamConfig}, fc.Upstreams...) {
+		if uc.Weight < 0 {
+			return fmt.Errorf("upstream %q: weight must not be negative", uc.Url)
+		}
+	}
+	return nil
+}
+
+// normalizeAnswerIP expands include: lines in a forward's expect-ip and
+// bogus-ip lists (the same way as rules) and rewrites every entry as a
+// canonical CIDR. An expect-ip list that expands to nothing would reject
+// every answer, which is never what was meant.
+func normalizeAnswerIP(resolverConfig ResolverConfig, basePath string) error {
+	var fc *ForwardConfig
+	switch c := resolverConfig.(type) {
+	case *ForwardConfig:
+		fc = c
+	case *PreloaderConfig:
+		fc = &c.ForwardConfig
+	default:
+		return nil
+	}
+	for _, list := range []struct {
+		field   string
+		entries *[]string
+	}{{"expect-ip", &fc.ExpectIP}, {"bogus-ip", &fc.BogusIP}} {
+		if *list.entries == nil {
+			continue
+		}
+		expanded, err := parseRule(*list.entries, nil, basePath)
+		if err != nil {
+			return fmt.Errorf("%s: %w", list.field, err)
+		}
+		if len(expanded) == 0 {
+			return fmt.Errorf("%s: no prefix after expanding includes", list.field)
+		}
+		prefixes, err := parsePrefixes(list.field, expanded)
+		if err != nil {
+			return err
+		}
+		out := make([]string, len(prefixes))
+		for i, p := range prefixes {
+			out[i] = p.String()
+		}
+		*list.entries = out
+	}
+	return nil
+}
+
+// normalizeResolverSource expands group names in a resolver's `source:` list
+// into the group's entries. A resolver left with an empty list after expansion
+// (an empty group) would match nobody, which is never what was meant.
+func normalizeResolverSource(resolverConfig ResolverConfig, clients map[string][]string, hasLeases bool) error {
+	var sc *SourceConfig
+	switch c := resolverConfig.(type) {
+	case *FilterConfig:
+		sc = &c.SourceConfig
+	case *FileConfig:
+		sc = &c.SourceConfig
+	case *ForwardConfig:
+		sc = &c.SourceConfig
+	case *PreloaderConfig:
+		sc = &c.SourceConfig
+	case *MockConfig:
+		sc = &c.SourceConfig
+	case *MdnsConfig:
+		sc = &c.SourceConfig
+	default:
+		return nil
+	}
+	if len(sc.Source) == 0 {
+		return nil
+	}
+	expanded := make([]string, 0, len(sc.Source))
+	for i, entry := range sc.Source {
+		if canonical, ok := parseSourceEntry(entry); ok {
+			if _, isMAC := ParseMAC(canonical); isMAC && !hasLeases {
+				return fmt.Errorf("source[%d]: MAC %s requires lease_file", i, canonical)
+			}
+			expanded = append(expanded, canonical)
+			continue
+		}
+		group, ok := clients[strings.TrimSpace(entry)]
+		if !ok {
+			return fmt.Errorf("source[%d]: %q is not a CIDR, IP, MAC or clients group", i, entry)
+		}
+		expanded = append(expanded, group...)
+	}
+	if len(expanded) == 0 {
+		return fmt.Errorf("source: %v matches no client", sc.Source)
+	}
+	sc.Source = expanded
+	return nil
+}
+
+// parseSourceEntry canonicalises a CIDR/IP ("192.168.1.5/32") or a MAC
+// ("aa:bb:cc:dd:ee:ff"); ok is false for anything else (e.g. a group name).
+func parseSourceEntry(entry string) (string, bool) {
+	if p, err := ParsePrefix(entry); err == nil {
+		return p.String(), true
+	}
+	return ParseMAC(entry)
+}
+
+// ParseMAC accepts a 48-bit MAC in any notation net.ParseMAC knows and returns
+// it in lower-case colon form, as dnsmasq writes it to the lease file.
+func ParseMAC(text string) (string, bool) {
+	mac, err := net.ParseMAC(strings.TrimSpace(text))
+	if err != nil || len(mac) != 6 {
+		return "", false
+	}
+	return mac.String(), true
+}
+
+// ParseLeaseHostname accepts a host name as dnsmasq records it in the lease
+// file (letters, digits, '-', '_' and '.') and returns it lower-cased: DHCP
+// clients choose their own name and its case.
+func ParseLeaseHostname(text string) (string, bool) {
+	name := strings.ToLower(strings.TrimSpace(text))
+	if name == "" {
+		return "", false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+func parsePrefixes(field string, entries []string) ([]netip.Prefix, error) {
+	out := make([]netip.Prefix, 0, len(entries))
+	for i, entry := range entries {
+		p, err := ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s[%d]: %w", field, i, err)
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// ParsePrefix accepts a CIDR or a bare address (as a host prefix).
+func ParsePrefix(text string) (netip.Prefix, error) {
+	text = strings.TrimSpace(text)
+	if strings.Contains(text, "/") {
+		p, err := netip.ParsePrefix(text)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if p.Addr().Is4In6() {
+			if p.Bits() < 96 {
+				return netip.Prefix{}, fmt.Errorf("netip.ParsePrefix(%q): IPv4-mapped prefix shorter than /96", text)
+			}
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(text)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func resolveLocalPath(path string, basePath string) string {
+	if basePath != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(basePath, path)
+	}
+	return filepath.Clean(path)
+}
+
 // warnNftSetTTL 校验 nftset 元素 timeout 不短于该 resolver 的生效缓存 TTL（计划 §3.2）：
 // 集合只在 cache-miss 时刷新，若 nftset_ttl 短于缓存 TTL，缓存命中期内集合条目可能
 // 提前过期、漏标流量。非致命，仅记日志告警，以免热重载时因配置时序问题中断加载。
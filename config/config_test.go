@@ -5,6 +5,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -753,3 +754,495 @@ resolvers:
 		})
 	}
 }
+
+func TestParseConfigTLS(t *testing.T) {
+	basePath := BasePath
+	BasePath = "/etc/dns-switchy"
+	t.Cleanup(func() { BasePath = basePath })
+
+	parsed, err := ParseConfig(strings.NewReader(`
+addr: ":53"
+tls:
+  addr: ":853"
+  cert: certs/fullchain.pem
+  key: /etc/ssl/private/dns.key
+`))
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	want := &TLSConfig{
+		Addr: ":853",
+		Cert: "/etc/dns-switchy/certs/fullchain.pem",
+		Key:  "/etc/ssl/private/dns.key",
+	}
+	if !reflect.DeepEqual(parsed.TLS, want) {
+		t.Fatalf("TLS = %+v, want %+v", parsed.TLS, want)
+	}
+
+	for name, body := range map[string]string{
+		"missing cert":     "tls:\n  addr: \":853\"\n  key: b.pem\n",
+		"missing key":      "tls:\n  addr: \":853\"\n  cert: a.pem\n",
+		"quic without tls": "quic: \":853\"\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseConfig(strings.NewReader(body)); err == nil {
+				t.Fatal("ParseConfig() error = nil, want tls validation error")
+			}
+		})
+	}
+}
+
+func TestParseConfigQuicReusesTLSCertificate(t *testing.T) {
+	parsed, err := ParseConfig(strings.NewReader(`
+addr: ":53"
+quic: " :853 "
+tls:
+  cert: /etc/ssl/dns.pem
+  key: /etc/ssl/dns.key
+`))
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	if parsed.Quic != ":853" {
+		t.Fatalf("Quic = %q, want %q", parsed.Quic, ":853")
+	}
+	if parsed.TLS == nil || parsed.TLS.Addr != "" || parsed.TLS.Cert != "/etc/ssl/dns.pem" {
+		t.Fatalf("TLS = %+v, want cert-only block", parsed.TLS)
+	}
+}
+
+func TestParseConfigListen(t *testing.T) {
+	parsed, err := ParseConfig(strings.NewReader(`
+addr: ":53"
+tls:
+  addr: ":853"
+  cert: /etc/ssl/dns.pem
+  key: /etc/ssl/dns.key
+listen:
+  - addr: "[fd00::1]:53"
+    label: lan6
+  - addr: 192.168.2.1:53
+    protocol: TCP
+    label: guest
+  - addr: ":443"
+    protocol: https
+`))
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	want := []ListenerConfig{
+		{Addr: ":53", Protocol: ProtocolUDP, Label: "udp://:53"},
+		{Addr: ":53", Protocol: ProtocolTCP, Label: "tcp://:53"},
+		{Addr: ":853", Protocol: ProtocolTLS, Label: "tls://:853"},
+		{Addr: "[fd00::1]:53", Protocol: ProtocolUDP, Label: "lan6"},
+		{Addr: "192.168.2.1:53", Protocol: ProtocolTCP, Label: "guest"},
+		{Addr: ":443", Protocol: ProtocolHTTPS, Label: "https://:443"},
+	}
+	if got := parsed.AllListeners(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("AllListeners() = %+v, want %+v", got, want)
+	}
+}
+
+func TestAllListenersAddrShorthand(t *testing.T) {
+	onlyListen := &SwitchyConfig{Listeners: []ListenerConfig{{Addr: "10.0.0.1:53", Protocol: ProtocolUDP}}}
+	if got := onlyListen.AllListeners(); len(got) != 1 || got[0].Addr != "10.0.0.1:53" {
+		t.Fatalf("AllListeners() with only listen = %+v, want the single entry", got)
+	}
+	bare := &SwitchyConfig{}
+	if got := bare.AllListeners(); len(got) != 2 || got[0].Protocol != ProtocolUDP || got[1].Protocol != ProtocolTCP {
+		t.Fatalf("AllListeners() with nothing configured = %+v, want default udp+tcp", got)
+	}
+}
+
+func TestParseConfigListenRejectsInvalidEntries(t *testing.T) {
+	for name, body := range map[string]string{
+		"missing addr":      "listen:\n  - protocol: udp\n",
+		"unknown protocol":  "listen:\n  - addr: \":53\"\n    protocol: sctp\n",
+		"tls without cert":  "listen:\n  - addr: \":853\"\n    protocol: tls\n",
+		"https without tls": "listen:\n  - addr: \":443\"\n    protocol: https\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseConfig(strings.NewReader(body)); err == nil {
+				t.Fatal("ParseConfig() error = nil, want listen validation error")
+			}
+		})
+	}
+}
+func TestParsePrefix(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{" 192.168.1.0/24 ", "192.168.1.0/24", false},
+		{"192.168.1.7/24", "192.168.1.0/24", false},
+		{"::ffff:192.168.1.0/120", "192.168.1.0/24", false},
+		{"fd00::1", "fd00::1/128", false},
+		{"192.168.1.300", "", true},
+		{"10.0.0.0/33", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePrefix(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePrefix(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("ParsePrefix(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseConfigACL(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		wantAllow   []string
+		wantDeny    []string
+		wantDefault string
+		wantAction  string
+	}{
+		{
+			name:        "allowlist defaults to deny and refuse",
+			body:        "acl:\n  allow: [192.168.0.0/16, \"fd00::/8\"]\n",
+			wantAllow:   []string{"192.168.0.0/16", "fd00::/8"},
+			wantDefault: ACLDeny,
+			wantAction:  ActionRefuse,
+		},
+		{
+			name:        "denylist defaults to allow",
+			body:        "acl:\n  deny: [203.0.113.7]\n  action: DROP\n",
+			wantDeny:    []string{"203.0.113.7/32"},
+			wantDefault: ACLAllow,
+			wantAction:  ActionDrop,
+		},
+		{
+			name:        "explicit default wins",
+			body:        "acl:\n  allow: [10.0.0.0/8]\n  default: allow\n",
+			wantAllow:   []string{"10.0.0.0/8"},
+			wantDefault: ACLAllow,
+			wantAction:  ActionRefuse,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := ParseConfig(strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("ParseConfig() error = %v", err)
+			}
+			if conf.ACL == nil {
+				t.Fatal("ACL = nil, want parsed acl")
+			}
+			if got := prefixStrings(conf.ACL.Allow); !reflect.DeepEqual(got, tt.wantAllow) {
+				t.Fatalf("ACL.Allow = %v, want %v", got, tt.wantAllow)
+			}
+			if got := prefixStrings(conf.ACL.Deny); !reflect.DeepEqual(got, tt.wantDeny) {
+				t.Fatalf("ACL.Deny = %v, want %v", got, tt.wantDeny)
+			}
+			if conf.ACL.Default != tt.wantDefault || conf.ACL.Action != tt.wantAction {
+				t.Fatalf("ACL default/action = %s/%s, want %s/%s", conf.ACL.Default, conf.ACL.Action, tt.wantDefault, tt.wantAction)
+			}
+		})
+	}
+
+	conf, err := ParseConfig(strings.NewReader("addr: \":53\"\n"))
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	if conf.ACL != nil {
+		t.Fatalf("ACL = %+v, want nil without an acl block", conf.ACL)
+	}
+}
+
+func TestParseConfigACLRejectsInvalidEntries(t *testing.T) {
+	for name, body := range map[string]string{
+		"bad cidr":        "acl:\n  allow: [10.0.0.0/40]\n",
+		"bad address":     "acl:\n  deny: [not-an-ip]\n",
+		"unknown action":  "acl:\n  action: reject\n",
+		"unknown default": "acl:\n  default: maybe\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseConfig(strings.NewReader(body)); err == nil {
+				t.Fatal("ParseConfig() error = nil, want acl validation error")
+			}
+		})
+	}
+}
+
+func prefixStrings(prefixes []netip.Prefix) []string {
+	if len(prefixes) == 0 {
+		return nil
+	}
+	out := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		out = append(out, p.String())
+	}
+	return out
+}
+
+func TestParseConfigRateLimit(t *testing.T) {
+	conf, err := ParseConfig(strings.NewReader("rate_limit:\n  qps: 20.5\n  prefix_qps: 100\n  prefix_burst: 150\n  allow: [192.168.1.2]\n"))
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	rl := conf.RateLimit
+	if rl == nil {
+		t.Fatal("RateLimit = nil, want parsed rate_limit")
+	}
+	if rl.QPS != 20.5 || rl.Burst != 41 || rl.PrefixQPS != 100 || rl.PrefixBurst != 150 {
+		t.Fatalf("rates = %+v, want qps 20.5 burst 41 prefix 100/150", rl)
+	}
+	if rl.IPv4Prefix != 24 || rl.IPv6Prefix != 56 || rl.Action != ActionRefuse {
+		t.Fatalf("defaults = /%d /%d %s, want /24 /56 refuse", rl.IPv4Prefix, rl.IPv6Prefix, rl.Action)
+	}
+	if got := prefixStrings(rl.Allow); !reflect.DeepEqual(got, []string{"192.168.1.2/32"}) {
+		t.Fatalf("Allow = %v, want [192.168.1.2/32]", got)
+	}
+}
+
+func TestParseConfigRateLimitRejectsInvalidEntries(t *testing.T) {
+	for name, body := range map[string]string{
+		"no rate":         "rate_limit:\n  burst: 10\n",
+		"negative qps":    "rate_limit:\n  qps: -1\n",
+		"ipv4 prefix":     "rate_limit:\n  qps: 1\n  ipv4_prefix: 33\n",
+		"ipv6 prefix":     "rate_limit:\n  qps: 1\n  ipv6_prefix: 129\n",
+		"unknown action":  "rate_limit:\n  qps: 1\n  action: slow\n",
+		"bad allow entry": "rate_limit:\n  qps: 1\n  allow: [lan]\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseConfig(strings.NewReader(body)); err == nil {
+				t.Fatal("ParseConfig() error = nil, want rate_limit validation error")
+			}
+		})
+	}
+}
+
+func TestParseConfigCache(t *testing.T) {
+	conf, err := ParseConfig(strings.NewReader("cache:\n  serve-stale: 1h\n"))
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	if want := (CacheConfig{ServeStale: time.Hour, StaleTTL: 30 * time.Second, MaxEntries: 10000}); conf.Cache != want {
+		t.Fatalf("Cache = %+v, want %+v", conf.Cache, want)
+	}
+	if conf, err = ParseConfig(strings.NewReader("cache:\n  upstream-ttl: true\n  min-ttl: 30s\n  max-ttl: 24h\n")); err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	if c := conf.Cache; !c.UpstreamTTL || c.MinTTL != 30*time.Second || c.MaxTTL != 24*time.Hour {
+		t.Fatalf("Cache = %+v, want upstream-ttl clamped to [30s, 24h]", c)
+	}
+	if conf, err = ParseConfig(strings.NewReader("cache:\n  max-negative-ttl: 5m\n")); err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	if conf.Cache.MaxNegativeTTL != 5*time.Minute {
+		t.Fatalf("MaxNegativeTTL = %s, want 5m", conf.Cache.MaxNegativeTTL)
+	}
+	if conf, err = ParseConfig(strings.NewReader("cache:\n  max-entries: -1\n  max-bytes: 4194304\n")); err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	if conf.Cache.MaxEntries != 0 || conf.Cache.MaxBytes != 4194304 {
+		t.Fatalf("limits = %d entries %d bytes, want unbounded entries and 4 MiB", conf.Cache.MaxEntries, conf.Cache.MaxBytes)
+	}
+	if conf, err = ParseConfig(strings.NewReader("cache:\n  prefetch: 10\n")); err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	if conf.Cache.Prefetch != 10 || conf.Cache.PrefetchHits != 3 {
+		t.Fatalf("prefetch = %d%% after %d hits, want 10%% after the default 3", conf.Cache.Prefetch, conf.Cache.PrefetchHits)
+	}
+	for name, body := range map[string]string{
+		"negative window": "cache:\n  serve-stale: -1h\n",
+		"short stale ttl": "cache:\n  serve-stale: 1h\n  stale-ttl: 500ms\n",
+		"clamp sans mode": "cache:\n  min-ttl: 1m\n",
+		"min above max":   "cache:\n  upstream-ttl: true\n  min-ttl: 1h\n  max-ttl: 1m\n",
+		"negative cap":    "cache:\n  max-negative-ttl: -1m\n",
+		"max entries":     "cache:\n  max-entries: -2\n",
+		"max bytes":       "cache:\n  max-bytes: -1\n",
+		"prefetch range":  "cache:\n  prefetch: 100\n",
+		"hits sans mode":  "cache:\n  prefetch-hits: 5\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseConfig(strings.NewReader(body)); err == nil {
+				t.Fatal("ParseConfig() error = nil, want cache validation error")
+			}
+		})
+	}
+}
+
+func TestParseConfigCachePersistFile(t *testing.T) {
+	dir := t.TempDir()
+	basePath := BasePath
+	BasePath = dir
+	defer func() {
+		BasePath = basePath
+	}()
+
+	for body, want := range map[string]CacheConfig{
+		"cache:\n  persist-file: cache.json\n":                          {PersistFile: filepath.Join(dir, "cache.json"), PersistInterval: 15 * time.Minute},
+		"cache:\n  persist-file: /tmp/c.json\n  persist-interval: 1h\n": {PersistFile: "/tmp/c.json", PersistInterval: time.Hour},
+		"cache:\n  persist-file: cache.json\n  persist-interval: -1s\n": {PersistFile: filepath.Join(dir, "cache.json")},
+		"cache:\n  persist-interval: 1h\n":                              {},
+	} {
+		conf, err := ParseConfig(strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("ParseConfig(%q) error = %v", body, err)
+		}
+		if got := conf.Cache; got.PersistFile != want.PersistFile || got.PersistInterval != want.PersistInterval {
+			t.Fatalf("ParseConfig(%q) persist = %q every %s, want %q every %s", body, got.PersistFile, got.PersistInterval, want.PersistFile, want.PersistInterval)
+		}
+	}
+}
+
+func TestParseConfigSourceExpandsClientGroups(t *testing.T) {
+	dir := t.TempDir()
+	basePath := BasePath
+	BasePath = dir
+	defer func() {
+		BasePath = basePath
+	}()
+
+	conf, err := ParseConfig(strings.NewReader(`
+lease_file: dhcp.leases
+clients:
+  kids: [192.168.1.50, "AA-BB-CC-00-00-01", Kid-Tablet]
+resolvers:
+  - type: forward
+    name: family
+    url: 1.1.1.3
+    source: [kids, 10.0.0.0/8]
+  - type: mock
+    answer: 0.0.0.0
+    source: [fd00::1]
+  - type: forward
+    name: default
+    url: 1.1.1.1
+`))
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	if want := filepath.Join(dir, "dhcp.leases"); conf.LeaseFile != want {
+		t.Fatalf("LeaseFile = %q, want %q", conf.LeaseFile, want)
+	}
+	wantKids := []string{"192.168.1.50/32", "aa:bb:cc:00:00:01", "kid-tablet"}
+	if !reflect.DeepEqual(conf.Clients["kids"], wantKids) {
+		t.Fatalf("Clients[kids] = %v, want %v", conf.Clients["kids"], wantKids)
+	}
+	family := conf.Resolvers[0].(*ForwardConfig)
+	if want := append(wantKids, "10.0.0.0/8"); !reflect.DeepEqual(family.Source, want) {
+		t.Fatalf("family source = %v, want %v", family.Source, want)
+	}
+	if got := conf.Resolvers[1].(*MockConfig).Source; !reflect.DeepEqual(got, []string{"fd00::1/128"}) {
+		t.Fatalf("mock source = %v, want [fd00::1/128]", got)
+	}
+	if got := conf.Resolvers[2].(*ForwardConfig).Source; got != nil {
+		t.Fatalf("default source = %v, want nil", got)
+	}
+}
+
+func TestParseConfigSourceRejectsInvalidEntries(t *testing.T) {
+	for name, body := range map[string]string{
+		"unknown group":         "resolvers:\n  - type: mock\n    source: [kids]\n",
+		"mac without lease":     "resolvers:\n  - type: mock\n    source: [aa:bb:cc:00:00:01]\n",
+		"group mac sans lease":  "clients:\n  kids: [aa:bb:cc:00:00:01]\n",
+		"group host sans lease": "clients:\n  kids: [kid-tablet]\n",
+		"bad group entry":       "lease_file: dhcp.leases\nclients:\n  kids: [\"kid tablet\"]\n",
+		"hostname as source":    "lease_file: dhcp.leases\nresolvers:\n  - type: mock\n    source: [kid-tablet]\n",
+		"empty group as source": "clients:\n  kids: []\nresolvers:\n  - type: mock\n    source: [kids]\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseConfig(strings.NewReader(body)); err == nil {
+				t.Fatal("ParseConfig() error = nil, want source validation error")
+			}
+		})
+	}
+}
+
+func TestParseConfigForwardStrategy(t *testing.T) {
+	conf, err := ParseConfig(strings.NewReader(`
+resolvers:
+  - type: forward-group
+    strategy: weighted-random
+    fail-threshold: 3
+    probe:
+      interval: 30s
+      name: www.example.com
+    upstreams:
+      - url: 1.1.1.1
+        weight: 3
+      - url: 8.8.8.8
+`))
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	fc := conf.Resolvers[0].(*ForwardConfig)
+	if fc.Strategy != StrategyWeighted || fc.Upstreams[0].Weight != 3 || fc.Upstreams[1].Weight != 0 {
+		t.Fatalf("strategy = %q, weights = %d, %d; want weighted-random, 3, 0", fc.Strategy, fc.Upstreams[0].Weight, fc.Upstreams[1].Weight)
+	}
+	if fc.FailThreshold != 3 || fc.RecoverThreshold != 0 {
+		t.Fatalf("thresholds = %d/%d, want 3/0", fc.FailThreshold, fc.RecoverThreshold)
+	}
+	if want := (&ProbeConfig{Interval: 30 * time.Second, Name: "www.example.com"}); !reflect.DeepEqual(fc.Probe, want) {
+		t.Fatalf("probe = %+v, want %+v", fc.Probe, want)
+	}
+
+	for name, body := range map[string]string{
+		"unknown strategy":    "resolvers:\n  - type: forward\n    url: 1.1.1.1\n    strategy: fastest\n",
+		"negative weight":     "resolvers:\n  - type: forward-group\n    upstreams:\n      - url: 1.1.1.1\n        weight: -1\n",
+		"preloader":           "resolvers:\n  - type: preloader\n    ttl: 1m\n    url: 1.1.1.1\n    strategy: random\n",
+		"negative recover":    "resolvers:\n  - type: forward\n    url: 1.1.1.1\n    recover-threshold: -1\n",
+		"probe sans interval": "resolvers:\n  - type: forward\n    url: 1.1.1.1\n    probe:\n      name: example.com\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseConfig(strings.NewReader(body)); err == nil {
+				t.Fatal("ParseConfig() error = nil, want forward validation error")
+			}
+		})
+	}
+}
+
+func TestParseConfigForwardAnswerIP(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "chnroute.txt"), []byte("# chnroute\n1.0.1.0/24\n\n 223.255.252.0/23 \n2001:250::/30\n"), 0600); err != nil {
+		t.Fatalf("write include file fail: %v", err)
+	}
+	basePath := BasePath
+	BasePath = dir
+	defer func() {
+		BasePath = basePath
+	}()
+
+	conf, err := ParseConfig(strings.NewReader(`
+resolvers:
+  - type: forward
+    url: 223.5.5.5
+    expect-ip:
+      - include:chnroute.txt
+    bogus-ip:
+      - 243.185.187.39
+      - 10.0.0.1/8
+`))
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	fc := conf.Resolvers[0].(*ForwardConfig)
+	if want := []string{"1.0.1.0/24", "223.255.252.0/23", "2001:250::/30"}; !reflect.DeepEqual(fc.ExpectIP, want) {
+		t.Fatalf("expect-ip = %#v, want %#v", fc.ExpectIP, want)
+	}
+	if want := []string{"243.185.187.39/32", "10.0.0.0/8"}; !reflect.DeepEqual(fc.BogusIP, want) {
+		t.Fatalf("bogus-ip = %#v, want %#v", fc.BogusIP, want)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "empty.txt"), []byte("# nothing yet\n"), 0600); err != nil {
+		t.Fatalf("write include file fail: %v", err)
+	}
+	for name, body := range map[string]string{
+		"invalid prefix": "resolvers:\n  - type: forward\n    url: 1.1.1.1\n    bogus-ip: [1.2.3]\n",
+		"empty include":  "resolvers:\n  - type: forward\n    url: 1.1.1.1\n    expect-ip: [include:empty.txt]\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseConfig(strings.NewReader(body)); err == nil {
+				t.Fatal("ParseConfig() error = nil, want answer ip error")
+			}
+		})
+	}
+}
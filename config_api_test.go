@@ -384,10 +384,10 @@ func TestConfigPostThroughRunningServerDoesNotDeadlock(t *testing.T) {
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("POST via running server status = %d, want 200; body=%s", resp.StatusCode, readAll(t, resp))
 	}
-	// httpServer/udpServer were never set on this test server; SwapResolvers must
-	// not have touched them (they remain nil), proving it does not Shutdown.
-	if server.httpServer != nil || server.udpServer != nil {
-		t.Fatal("SwapResolvers must not create/replace the HTTP/UDP servers")
+	// listeners were never set on this test server; SwapResolvers must not
+	// have touched them (they remain nil), proving it does not Shutdown.
+	if server.listeners != nil {
+		t.Fatal("SwapResolvers must not create/replace the HTTP/DNS listeners")
 	}
 }
 
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohMediaType is the RFC 8484 wire-format content type for both directions.
+const dohMediaType = "application/dns-message"
+
+// dohHandler serves RFC 8484 DNS-over-HTTPS on /dns-query. Unlike /api/query it
+// goes through dnsMsgHandler (cache included) and answers in wire format, so a
+// browser pointed at it gets exactly what a UDP client would. It is not behind
+// requireAPIKey: DoH clients cannot attach custom headers. label tags the
+// queries with the listener they arrived on.
+func (s *DnsSwitchyServer) dohHandler(label string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.serveDoH(w, r, label)
+	}
+}
+
+func (s *DnsSwitchyServer) serveDoH(w http.ResponseWriter, r *http.Request, label string) {
+	var raw []byte
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			http.Error(w, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+		// RFC 8484 mandates unpadded base64url; tolerate padding anyway.
+		decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+		if err != nil {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+		raw = decoded
+	case http.MethodPost:
+		// Media types are case-insensitive and may carry parameters.
+		if ct, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || !strings.EqualFold(ct, dohMediaType) {
+			http.Error(w, "content-type must be "+dohMediaType, http.StatusUnsupportedMediaType)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, dns.MaxMsgSize))
+		if err != nil {
+			http.Error(w, "read body: "+err.Error(), bodyErrStatus(err))
+			return
+		}
+		raw = body
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(raw); err != nil {
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+	wire := &dohResponseWriter{writer: w, remote: httpRemoteAddr(r)}
+	s.dnsMsgHandler(&DnsWriter{writer: wire, msg: msg, start: time.Now().UnixMilli(), tags: QueryTags{Listener: label}}, msg)
+}
+
+// httpRemoteAddr turns http.Request.RemoteAddr into a TCP address. Requests
+// over the unix-socket listener have no peer address; they get the zero
+// TCPAddr so log formatting (which strips ":port") keeps working.
+func httpRemoteAddr(r *http.Request) net.Addr {
+	if ap, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		return net.TCPAddrFromAddrPort(ap)
+	}
+	return &net.TCPAddr{}
+}
+
+// dohResponseWriter adapts an http.ResponseWriter to dns.ResponseWriter so the
+// regular DnsWriter (logging, id/flag copying) can be reused for DoH. Its
+// remote address is a *net.TCPAddr, so DnsWriter never truncates.
+type dohResponseWriter struct {
+	writer http.ResponseWriter
+	remote net.Addr
+}
+
+func (d *dohResponseWriter) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (d *dohResponseWriter) RemoteAddr() net.Addr {
+	return d.remote
+}
+
+func (d *dohResponseWriter) WriteMsg(msg *dns.Msg) error {
+	packed, err := msg.Pack()
+	if err != nil {
+		http.Error(d.writer, "pack dns message: "+err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	if ttl, ok := dohMaxAge(msg); ok {
+		d.writer.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	} else {
+		d.writer.Header().Set("Cache-Control", "no-cache")
+	}
+	_, err = d.Write(packed)
+	return err
+}
+
+func (d *dohResponseWriter) Write(packed []byte) (int, error) {
+	d.writer.Header().Set("Content-Type", dohMediaType)
+	return d.writer.Write(packed)
+}
+
+func (d *dohResponseWriter) drop() {
+	http.Error(d.writer, "forbidden", http.StatusForbidden)
+}
+
+func (d *dohResponseWriter) Close() error {
+	return nil
+}
+
+func (d *dohResponseWriter) TsigStatus() error {
+	return nil
+}
+
+func (d *dohResponseWriter) TsigTimersOnly(bool) {
+}
+
+func (d *dohResponseWriter) Hijack() {
+}
+
+// dohMaxAge derives the HTTP freshness lifetime from the response (RFC 8484
+// §5.1): the smallest answer TTL, or for a negative answer the SOA TTL capped
+// by its MINIMUM field. ok is false when nothing in the message carries a TTL
+// (errors, empty replies), in which case the caller marks it uncacheable.
+func dohMaxAge(resp *dns.Msg) (uint32, bool) {
+	var (
+		minTTL uint32
+		found  bool
+	)
+	for _, rr := range resp.Answer {
+		if ttl := rr.Header().Ttl; !found || ttl < minTTL {
+			minTTL, found = ttl, true
+		}
+	}
+	if found {
+		return minTTL, true
+	}
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return min(soa.Hdr.Ttl, soa.Minttl), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"dns-switchy/resolver"
+
+	"github.com/miekg/dns"
+)
+
+func newDoHTestServer(t *testing.T, cache *fakeCache) *httptest.Server {
+	t.Helper()
+	server := newServerForTest([]resolver.DnsResolver{&testResolver{
+		acceptFn:  func(*dns.Msg) bool { return true },
+		resolveFn: func(msg *dns.Msg) (*dns.Msg, error) { return makeAResponse(msg, "192.0.2.80"), nil },
+		ttl:       0,
+	}})
+	if cache != nil {
+		server.dnsCache = cache
+	}
+	ts := httptest.NewServer(server.httpMux())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func decodeDoHResponse(t *testing.T, resp *http.Response) *dns.Msg {
+	t.Helper()
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("status = %d, want 200; body %q", resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dohMediaType {
+		t.Fatalf("content-type = %q, want %q", ct, dohMediaType)
+	}
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body fail: %v", err)
+	}
+	msg := new(dns.Msg)
+	if err = msg.Unpack(raw); err != nil {
+		t.Fatalf("unpack response fail: %v", err)
+	}
+	return msg
+}
+
+func packedQuery(t *testing.T, name string) []byte {
+	t.Helper()
+	req := makeQuery(name, dns.TypeA)
+	req.Id = 0
+	return packMsg(t, req)
+}
+
+func TestDoHGet(t *testing.T) {
+	ts := newDoHTestServer(t, nil)
+	param := base64.RawURLEncoding.EncodeToString(packedQuery(t, "doh.example."))
+
+	resp, err := http.Get(ts.URL + "/dns-query?dns=" + param)
+	if err != nil {
+		t.Fatalf("GET fail: %v", err)
+	}
+	msg := decodeDoHResponse(t, resp)
+	if len(msg.Answer) != 1 || msg.Answer[0].(*dns.A).A.String() != "192.0.2.80" {
+		t.Fatalf("answer = %v, want 192.0.2.80", msg.Answer)
+	}
+	if got := resp.Header.Get("Cache-Control"); got != "max-age=60" {
+		t.Fatalf("Cache-Control = %q, want max-age=60", got)
+	}
+}
+
+func TestDoHPostUsesCache(t *testing.T) {
+	cached := *makeAResponse(makeQuery("cached.example.", dns.TypeA), "198.51.100.1")
+	cached.Answer[0].Header().Ttl = 42
+	ts := newDoHTestServer(t, &fakeCache{getResult: cached})
+
+	resp, err := http.Post(ts.URL+"/dns-query", dohMediaType, bytes.NewReader(packedQuery(t, "cached.example.")))
+	if err != nil {
+		t.Fatalf("POST fail: %v", err)
+	}
+	msg := decodeDoHResponse(t, resp)
+	if len(msg.Answer) != 1 || msg.Answer[0].(*dns.A).A.String() != "198.51.100.1" {
+		t.Fatalf("answer = %v, want cached 198.51.100.1", msg.Answer)
+	}
+	if got := resp.Header.Get("Cache-Control"); got != "max-age=42" {
+		t.Fatalf("Cache-Control = %q, want max-age=42", got)
+	}
+}
+
+func TestDoHRejectsBadRequests(t *testing.T) {
+	ts := newDoHTestServer(t, nil)
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		ct     string
+		body   []byte
+		want   int
+	}{
+		{name: "GetMissingParam", method: http.MethodGet, want: http.StatusBadRequest},
+		{name: "GetBadBase64", method: http.MethodGet, query: "?dns=***", want: http.StatusBadRequest},
+		{name: "GetNotDNS", method: http.MethodGet, query: "?dns=AAAA", want: http.StatusBadRequest},
+		{name: "PostWrongContentType", method: http.MethodPost, ct: "application/json", body: []byte("{}"), want: http.StatusUnsupportedMediaType},
+		{name: "PostMissingContentType", method: http.MethodPost, body: packedQuery(t, "doh.example."), want: http.StatusUnsupportedMediaType},
+		{name: "PostContentTypeWithParams", method: http.MethodPost, ct: "Application/DNS-Message; charset=binary", body: packedQuery(t, "doh.example."), want: http.StatusOK},
+		{name: "Put", method: http.MethodPut, want: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, ts.URL+"/dns-query"+tt.query, bytes.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("new request fail: %v", err)
+			}
+			if tt.ct != "" {
+				req.Header.Set("Content-Type", tt.ct)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request fail: %v", err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestDoHMaxAgeNegativeUsesSOAMinimum(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.Rcode = dns.RcodeNameError
+	resp.Ns = []dns.RR{&dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Minttl: 300,
+	}}
+	if ttl, ok := dohMaxAge(resp); !ok || ttl != 300 {
+		t.Fatalf("dohMaxAge() = %d, %v; want 300, true", ttl, ok)
+	}
+	if _, ok := dohMaxAge(new(dns.Msg)); ok {
+		t.Fatal("dohMaxAge(empty) ok = true, want false")
+	}
+}
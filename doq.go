@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// doqALPN is the RFC 9250 ALPN token.
+	doqALPN = "doq"
+	// RFC 9250 §8.4 error codes.
+	doqNoError       quic.ApplicationErrorCode = 0x0
+	doqProtocolError quic.ApplicationErrorCode = 0x2
+	// doqReadTimeout bounds how long a client may take to send its query once
+	// the stream is open.
+	doqReadTimeout = 5 * time.Second
+	// doqIdleTimeout closes connections with no stream activity.
+	doqIdleTimeout = 30 * time.Second
+)
+
+// doqServer is a minimal RFC 9250 DNS-over-QUIC listener. Each bidirectional
+// stream carries exactly one length-prefixed query and its response; the
+// stream is handed to handler through a dns.ResponseWriter so it lands in the
+// same dnsMsgHandler as every other transport.
+type doqServer struct {
+	addr    string
+	tlsConf *tls.Config
+	handler dns.Handler
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	listener *quic.Listener
+	conns    map[*quic.Conn]struct{}
+	wg       sync.WaitGroup
+}
+
+func newDoqServer(addr string, tlsConf *tls.Config, handler dns.Handler) *doqServer {
+	conf := tlsConf.Clone()
+	conf.NextProtos = []string{doqALPN}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &doqServer{
+		addr:    addr,
+		tlsConf: conf,
+		handler: handler,
+		ctx:     ctx,
+		cancel:  cancel,
+		conns:   make(map[*quic.Conn]struct{}),
+	}
+}
+
+// ListenAndServe binds addr and serves until Shutdown. Like dns.Server it
+// returns nil after a Shutdown and an error on bind/accept failure, so it fits
+// retry().
+func (d *doqServer) ListenAndServe() error {
+	if d.ctx.Err() != nil {
+		return nil
+	}
+	listener, err := quic.ListenAddr(d.addr, d.tlsConf, &quic.Config{MaxIdleTimeout: doqIdleTimeout})
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	if d.ctx.Err() != nil {
+		d.mu.Unlock()
+		return listener.Close()
+	}
+	d.listener = listener
+	d.mu.Unlock()
+	for {
+		conn, err := listener.Accept(d.ctx)
+		if err != nil {
+			if d.ctx.Err() != nil {
+				return nil
+			}
+			// Free the port for retry's next ListenAddr.
+			d.mu.Lock()
+			if d.listener == listener {
+				d.listener = nil
+			}
+			d.mu.Unlock()
+			_ = listener.Close()
+			return err
+		}
+		// Registration happens under mu after re-checking ctx, so Shutdown
+		// (which cancels before taking mu) either sees this conn or it is
+		// closed here; wg.Add never races wg.Wait.
+		d.mu.Lock()
+		if d.ctx.Err() != nil {
+			d.mu.Unlock()
+			_ = conn.CloseWithError(doqNoError, "")
+			return nil
+		}
+		d.conns[conn] = struct{}{}
+		d.wg.Add(1)
+		d.mu.Unlock()
+		go d.serveConn(conn)
+	}
+}
+
+// Shutdown stops accepting, closes every open connection with DOQ_NO_ERROR and
+// waits for in-flight streams to finish.
+func (d *doqServer) Shutdown() error {
+	d.cancel()
+	d.mu.Lock()
+	listener := d.listener
+	conns := make([]*quic.Conn, 0, len(d.conns))
+	for conn := range d.conns {
+		conns = append(conns, conn)
+	}
+	d.mu.Unlock()
+	var err error
+	if listener != nil {
+		err = listener.Close()
+	}
+	for _, conn := range conns {
+		_ = conn.CloseWithError(doqNoError, "")
+	}
+	d.wg.Wait()
+	return err
+}
+
+func (d *doqServer) forgetConn(conn *quic.Conn) {
+	d.mu.Lock()
+	delete(d.conns, conn)
+	d.mu.Unlock()
+}
+
+func (d *doqServer) serveConn(conn *quic.Conn) {
+	defer d.wg.Done()
+	defer d.forgetConn(conn)
+	var streams sync.WaitGroup
+	defer streams.Wait()
+	for {
+		stream, err := conn.AcceptStream(d.ctx)
+		if err != nil {
+			return
+		}
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			d.serveStream(conn, stream)
+		}()
+	}
+}
+
+func (d *doqServer) serveStream(conn *quic.Conn, stream *quic.Stream) {
+	_ = stream.SetReadDeadline(time.Now().Add(doqReadTimeout))
+	msg, err := readDoqMsg(stream)
+	if err != nil {
+		log.Printf("[%s] doq read fail: %v", conn.RemoteAddr(), err)
+		_ = conn.CloseWithError(doqProtocolError, "bad query")
+		return
+	}
+	// RFC 9250 §4.2.1: the message ID must be 0 on DoQ.
+	if msg.Id != 0 {
+		_ = conn.CloseWithError(doqProtocolError, "non-zero message id")
+		return
+	}
+	d.handler.ServeDNS(&doqResponseWriter{conn: conn, stream: stream}, msg)
+	_ = stream.Close()
+}
+
+func readDoqMsg(r io.Reader) (*dns.Msg, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return nil, errors.New("empty message")
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(buf); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// doqResponseWriter writes one length-prefixed response onto the query's
+// stream. It is a streamWriter: the peer address is UDP, but DoQ carries full
+// 64 KiB messages and must never set TC.
+type doqResponseWriter struct {
+	conn   *quic.Conn
+	stream *quic.Stream
+}
+
+func (d *doqResponseWriter) LocalAddr() net.Addr {
+	return d.conn.LocalAddr()
+}
+
+func (d *doqResponseWriter) RemoteAddr() net.Addr {
+	return d.conn.RemoteAddr()
+}
+
+func (d *doqResponseWriter) WriteMsg(msg *dns.Msg) error {
+	packed, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = d.Write(packed)
+	return err
+}
+
+func (d *doqResponseWriter) Write(packed []byte) (int, error) {
+	buf := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(buf, uint16(len(packed)))
+	copy(buf[2:], packed)
+	return d.stream.Write(buf)
+}
+
+func (d *doqResponseWriter) Close() error {
+	return d.stream.Close()
+}
+
+func (d *doqResponseWriter) TsigStatus() error {
+	return nil
+}
+
+func (d *doqResponseWriter) TsigTimersOnly(bool) {
+}
+
+func (d *doqResponseWriter) Hijack() {
+}
+
+func (d *doqResponseWriter) streamTransport() {
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"dns-switchy/config"
+	"dns-switchy/resolver"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+func TestStartServesDoQ(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "doq.example")
+	quicAddr := reserveUDPAddr(t)
+	server, err := Create(&config.SwitchyConfig{
+		Addr: reserveUDPAddr(t),
+		TLS:  &config.TLSConfig{Cert: certFile, Key: keyFile},
+		Quic: quicAddr,
+	})
+	if err != nil {
+		t.Fatalf("Create fail: %v", err)
+	}
+	server.installGen([]resolver.DnsResolver{&testResolver{
+		acceptFn:  func(*dns.Msg) bool { return true },
+		resolveFn: func(msg *dns.Msg) (*dns.Msg, error) { return largeReplyFor(msg), nil },
+	}})
+	server.Start()
+	t.Cleanup(server.Shutdown)
+
+	up, err := upstream.AddressToUpstream("quic://"+quicAddr, &upstream.Options{
+		InsecureSkipVerify: true,
+		Timeout:            time.Second,
+	})
+	if err != nil {
+		t.Fatalf("create doq upstream fail: %v", err)
+	}
+	t.Cleanup(func() { _ = up.Close() })
+
+	req := makeQuery("doq.example.", dns.TypeA)
+	var resp *dns.Msg
+	for range 20 {
+		resp, err = up.Exchange(req)
+		if err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("DoQ exchange fail: %v", err)
+	}
+	if resp.Truncated {
+		t.Fatal("DoQ response has TC bit set, want full answer")
+	}
+	if want := len(largeReplyFor(req).Answer); len(resp.Answer) != want {
+		t.Fatalf("answer count = %d, want %d", len(resp.Answer), want)
+	}
+}
+
+func TestReadDoqMsgRejectsEmptyAndShort(t *testing.T) {
+	if _, err := readDoqMsg(bytes.NewReader([]byte{0, 0})); err == nil {
+		t.Fatal("readDoqMsg(empty) error = nil, want error")
+	}
+	if _, err := readDoqMsg(bytes.NewReader([]byte{0, 12, 1, 2})); err == nil {
+		t.Fatal("readDoqMsg(short) error = nil, want error")
+	}
+	packed := packMsg(t, makeQuery("ok.example.", dns.TypeA))
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(packed)))
+	msg, err := readDoqMsg(bytes.NewReader(append(framed, packed...)))
+	if err != nil {
+		t.Fatalf("readDoqMsg() error = %v", err)
+	}
+	if msg.Question[0].Name != "ok.example." {
+		t.Fatalf("question = %s, want ok.example.", msg.Question[0].Name)
+	}
+}
+
+func TestDoqServerShutdownBeforeListen(t *testing.T) {
+	d := newDoqServer(reserveUDPAddr(t), &tls.Config{}, dns.HandlerFunc(func(dns.ResponseWriter, *dns.Msg) {}))
+	if err := d.Shutdown(); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	if err := d.ListenAndServe(); err != nil {
+		t.Fatalf("ListenAndServe() after Shutdown = %v, want nil", err)
+	}
+}
+
+func TestDoqServerAcceptFailureFreesListener(t *testing.T) {
+	d := newDoqServer(reserveUDPAddr(t), &tls.Config{}, dns.HandlerFunc(func(dns.ResponseWriter, *dns.Msg) {}))
+	t.Cleanup(func() { _ = d.Shutdown() })
+	served := make(chan error, 1)
+	go func() { served <- d.ListenAndServe() }()
+	var listener *quic.Listener
+	deadline := time.Now().Add(time.Second)
+	for listener == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("ListenAndServe did not bind")
+		}
+		time.Sleep(time.Millisecond)
+		d.mu.Lock()
+		listener = d.listener
+		d.mu.Unlock()
+	}
+	// Fail Accept without a Shutdown, as a socket error would.
+	_ = listener.Close()
+	if err := <-served; err == nil {
+		t.Fatal("ListenAndServe() after accept failure = nil, want the error for retry")
+	}
+	d.mu.Lock()
+	stale := d.listener
+	d.mu.Unlock()
+	if stale != nil {
+		t.Fatal("failed listener left in place")
+	}
+	// retry's next round binds the same address again once quic-go has
+	// released the socket, which it does asynchronously.
+	go func() {
+		var err error
+		for range 50 {
+			if err = d.ListenAndServe(); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		served <- err
+	}()
+	deadline = time.Now().Add(time.Second)
+	for rebound := false; !rebound; {
+		if time.Now().After(deadline) {
+			t.Fatal("ListenAndServe did not bind again")
+		}
+		time.Sleep(time.Millisecond)
+		d.mu.Lock()
+		rebound = d.listener != nil
+		d.mu.Unlock()
+	}
+	if err := d.Shutdown(); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("ListenAndServe() after rebind = %v, want nil", err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"dns-switchy/resolver"
+	"dns-switchy/util"
+
+	"github.com/miekg/dns"
+)
+
+var errFlightAborted = errors.New("upstream exchange aborted")
+
+// flightKey identifies upstream exchanges that can be shared: the same
+// resolver asked for the same cache key (see util.CacheKey), since the answer
+// to a DO, CD or ECS query must not be handed to a query without them.
+type flightKey struct {
+	upstream resolver.DnsResolver
+	key      util.CacheKey
+}
+
+type flight struct {
+	done    chan struct{}
+	waiters int
+	resp    *dns.Msg // a private copy for the waiters, taken only if there are any
+	err     error
+}
+
+// flightGroup coalesces concurrent identical upstream exchanges
+// (singleflight): when a popular name expires, the first cache miss asks
+// upstream and the misses that arrive meanwhile wait for its answer instead
+// of sending their own. A nil *flightGroup resolves every query on its own.
+type flightGroup struct {
+	mu        sync.Mutex
+	flights   map[flightKey]*flight
+	coalesced atomic.Uint64
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[flightKey]*flight)}
+}
+
+// resolve asks upstream for msg, or joins an identical exchange already in
+// flight. shared is true for a joined exchange: the caller gets a copy of the
+// answer carrying its own message ID, and must leave storing it (cache,
+// nftset) to the query that asked.
+func (g *flightGroup) resolve(upstream resolver.DnsResolver, msg *dns.Msg) (resp *dns.Msg, shared bool, err error) {
+	if g == nil {
+		resp, err = upstream.Resolve(msg)
+		return resp, false, err
+	}
+	key := flightKey{upstream: upstream, key: util.KeyOf(msg)}
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		f.waiters++
+		g.mu.Unlock()
+		g.coalesced.Add(1)
+		<-f.done
+		if f.err != nil {
+			return nil, true, f.err
+		}
+		resp = f.resp.Copy()
+		resp.Id = msg.Id
+		return resp, true, nil
+	}
+	f := &flight{done: make(chan struct{}), err: errFlightAborted}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	// Deferred so a panicking resolver still releases its waiters.
+	defer func() {
+		g.mu.Lock()
+		delete(g.flights, key)
+		if f.waiters > 0 && resp != nil {
+			// The caller's writer may modify resp while waiters copy it.
+			f.resp = resp.Copy()
+		}
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	resp, err = upstream.Resolve(msg)
+	f.err = err
+	if err == nil && resp == nil {
+		f.err = errFlightAborted
+	}
+	return resp, false, err
+}
+
+// Coalesced is how many queries were answered by joining another query's
+// upstream exchange.
+func (g *flightGroup) Coalesced() uint64 {
+	if g == nil {
+		return 0
+	}
+	return g.coalesced.Load()
+}
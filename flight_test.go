@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dns-switchy/resolver"
+	"dns-switchy/util"
+
+	"github.com/miekg/dns"
+)
+
+func TestDnsMsgHandlerCoalescesConcurrentMisses(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int32
+	server := newServerForTest([]resolver.DnsResolver{&testResolver{
+		acceptFn: func(*dns.Msg) bool { return true },
+		resolveFn: func(msg *dns.Msg) (*dns.Msg, error) {
+			calls.Add(1)
+			<-release
+			return makeAResponse(msg, "192.0.2.1"), nil
+		},
+	}})
+	server.dnsCache = util.NewDnsCache(time.Minute)
+	server.flights = newFlightGroup()
+
+	const clients = 5
+	writers := make([]*captureDNSResponseWriter, clients+1)
+	var wg sync.WaitGroup
+	for i := range writers {
+		writers[i] = newCaptureDNSResponseWriter()
+		msg := makeQuery("example.com.", dns.TypeA)
+		msg.Id = uint16(100 + i)
+		if i == clients {
+			msg.SetEdns0(1232, true) // DO set: a separate exchange
+		}
+		wg.Add(1)
+		go func(writer *captureDNSResponseWriter, msg *dns.Msg) {
+			defer wg.Done()
+			server.dnsMsgHandler(&DnsWriter{writer: writer, msg: msg, start: time.Now().UnixMilli()}, msg)
+		}(writers[i], msg)
+	}
+	deadline := time.Now().Add(time.Second)
+	for server.flights.Coalesced() < clients-1 || calls.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("coalesced %d, upstream calls %d; want %d and 2 before release", server.flights.Coalesced(), calls.Load(), clients-1)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 2 {
+		t.Fatalf("upstream calls = %d, want 2 (one plain, one DO)", calls.Load())
+	}
+	if got := server.flights.Coalesced(); got != clients-1 {
+		t.Fatalf("Coalesced() = %d, want %d", got, clients-1)
+	}
+	for i, writer := range writers {
+		if writer.msg == nil || len(writer.msg.Answer) != 1 || writer.msg.Id != uint16(100+i) {
+			t.Fatalf("client %d response = %v, want one answer with id %d", i, writer.msg, 100+i)
+		}
+	}
+	if len(server.flights.flights) != 0 {
+		t.Fatalf("flights left in the group: %v", server.flights.flights)
+	}
+}
@@ -4,9 +4,9 @@ go 1.26.1
 
 require (
 	github.com/AdguardTeam/dnsproxy v0.81.0
-	github.com/XGFan/go-utils v0.0.0-20240318151539-025ddda1ce33
 	github.com/fsnotify/fsnotify v1.9.0
 	github.com/miekg/dns v1.1.72
+	github.com/quic-go/quic-go v0.59.0
 	golang.org/x/net v0.52.0
 	gopkg.in/yaml.v3 v3.0.1
 )
@@ -17,7 +17,6 @@ require (
 	github.com/ameshkov/dnsstamps v1.0.3 // indirect
 	github.com/kr/text v0.2.0 // indirect
 	github.com/quic-go/qpack v0.6.0 // indirect
-	github.com/quic-go/quic-go v0.59.0 // indirect
 	golang.org/x/crypto v0.49.0 // indirect
 	golang.org/x/exp v0.0.0-20260312153236-7ab1446f8b90 // indirect
 	golang.org/x/mod v0.34.0 // indirect
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dns-switchy/config"
+
+	"github.com/miekg/dns"
+)
+
+// protocolHTTP keys the plain `http:` listener (API, panel and DoH) alongside
+// the DNS listeners from config.AllListeners.
+const protocolHTTP = "http"
+
+// dnsListener is one bound transport. Every protocol is reduced to a blocking
+// serve (run under retry) and a shutdown. The socket is not tied to a server:
+// queries are dispatched to target, and a full reload hands the listener to the
+// next server (see takeListeners) when its protocol and address are unchanged,
+// so a ttl edit never drops the port.
+type dnsListener struct {
+	key      string // protocol://addr, identifies the socket across reloads
+	label    atomic.Pointer[string]
+	target   atomic.Pointer[DnsSwitchyServer]
+	serve    func() error
+	shutdown func() error
+	stopped  atomic.Bool
+	done     chan struct{} // closed once the serve loop has exited
+}
+
+func (l *dnsListener) String() string {
+	if label := l.currentLabel(); label != l.key {
+		return fmt.Sprintf("%s(%s)", label, l.key)
+	}
+	return l.key
+}
+
+func (l *dnsListener) currentLabel() string {
+	return *l.label.Load()
+}
+
+// attach points the listener at s under the given label. Queries already in
+// flight finish on the server they started on.
+func (l *dnsListener) attach(s *DnsSwitchyServer, label string) {
+	l.label.Store(&label)
+	l.target.Store(s)
+}
+
+func (l *dnsListener) start() {
+	go func() {
+		defer close(l.done)
+		retry(func() error {
+			if l.stopped.Load() {
+				return nil
+			}
+			return l.serve()
+		})
+	}()
+}
+
+// alive reports whether the serve loop is still running; a listener that gave
+// up after retry is rebound rather than handed over.
+func (l *dnsListener) alive() bool {
+	select {
+	case <-l.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// stop closes the socket and waits for the serve loop to exit.
+func (l *dnsListener) stop() {
+	l.stopped.Store(true)
+	_ = l.shutdown()
+	<-l.done
+}
+
+func (l *dnsListener) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s := l.target.Load()
+	if s == nil || s.certs == nil {
+		return nil, errors.New("no tls certificate")
+	}
+	return s.certs.getCertificate(hello)
+}
+
+func (l *dnsListener) ServeDNS(writer dns.ResponseWriter, msg *dns.Msg) {
+	l.target.Load().dnsMsgHandler(&DnsWriter{writer: writer, msg: msg, start: time.Now().UnixMilli(), tags: QueryTags{Listener: l.currentLabel()}}, msg)
+}
+
+func (l *dnsListener) serveDoH(w http.ResponseWriter, r *http.Request) {
+	l.target.Load().serveDoH(w, r, l.currentLabel())
+}
+
+func (l *dnsListener) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	l.target.Load().httpHandler.ServeHTTP(w, r)
+}
+
+func newListener(lc config.ListenerConfig) (*dnsListener, error) {
+	l := &dnsListener{key: lc.String(), done: make(chan struct{})}
+	switch lc.Protocol {
+	case config.ProtocolUDP, config.ProtocolTCP:
+		l.serve, l.shutdown = l.dnsServer(&dns.Server{Net: lc.Protocol, Addr: lc.Addr})
+	case config.ProtocolTLS:
+		l.serve, l.shutdown = l.dnsServer(&dns.Server{Net: "tcp-tls", Addr: lc.Addr, TLSConfig: serverTLSConfig(l.getCertificate)})
+	case config.ProtocolQUIC:
+		srv := newDoqServer(lc.Addr, serverTLSConfig(l.getCertificate), l)
+		l.serve, l.shutdown = srv.ListenAndServe, srv.Shutdown
+	case config.ProtocolHTTPS:
+		// A dedicated DoH listener serves only /dns-query; the API and panel
+		// stay on the plain `http:` listener.
+		mux := http.NewServeMux()
+		mux.HandleFunc("/dns-query", l.serveDoH)
+		tlsConf := serverTLSConfig(l.getCertificate)
+		tlsConf.NextProtos = []string{"h2", "http/1.1"}
+		l.serve, l.shutdown = httpServer(mux, func() (net.Listener, error) {
+			ln, err := net.Listen("tcp", lc.Addr)
+			if err != nil {
+				return nil, err
+			}
+			return tls.NewListener(ln, tlsConf), nil
+		})
+	default:
+		return nil, fmt.Errorf("%s: unknown protocol", lc)
+	}
+	return l, nil
+}
+
+func newHTTPListener(hc *config.HttpConfig) *dnsListener {
+	l := &dnsListener{key: protocolHTTP + "://" + hc.String(), done: make(chan struct{})}
+	l.serve, l.shutdown = httpServer(http.HandlerFunc(l.serveHTTP), hc.CreateListener)
+	return l
+}
+
+// dnsServer wires a dns.Server to l. dns.Server.Shutdown fails on a server
+// that has not finished binding, so shutdown first waits for the bind (or for
+// the serve loop to give up).
+func (l *dnsListener) dnsServer(srv *dns.Server) (serve, shutdown func() error) {
+	started := make(chan struct{})
+	var once sync.Once
+	srv.Handler = l
+	srv.ReusePort, srv.ReuseAddr = true, true
+	srv.NotifyStartedFunc = func() { once.Do(func() { close(started) }) }
+	shutdown = func() error {
+		select {
+		case <-started:
+			return srv.Shutdown()
+		case <-l.done:
+			return nil
+		}
+	}
+	return srv.ListenAndServe, shutdown
+}
+
+func httpServer(handler http.Handler, listen func() (net.Listener, error)) (serve, shutdown func() error) {
+	srv := &http.Server{Handler: handler}
+	serve = func() error {
+		ln, err := listen()
+		if err != nil {
+			return err
+		}
+		err = srv.Serve(ln)
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	}
+	shutdown = func() error {
+		return srv.Shutdown(context.Background())
+	}
+	return serve, shutdown
+}
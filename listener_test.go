@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dns-switchy/config"
+	"dns-switchy/resolver"
+
+	"github.com/miekg/dns"
+)
+
+// syncBuffer is a log sink that is safe to read while listener goroutines
+// are still writing to it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func captureLog(t *testing.T) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	writer, flags := log.Writer(), log.Flags()
+	log.SetOutput(buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(writer)
+		log.SetFlags(flags)
+	})
+	return buf
+}
+
+func exchangeWithRetry(t *testing.T, client *dns.Client, req *dns.Msg, addr string) *dns.Msg {
+	t.Helper()
+	var (
+		resp *dns.Msg
+		err  error
+	)
+	for range 20 {
+		resp, _, err = client.Exchange(req, addr)
+		if err == nil {
+			return resp
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("exchange with %s fail: %v", addr, err)
+	return nil
+}
+
+func TestListenersTagQueriesWithLabel(t *testing.T) {
+	logs := captureLog(t)
+	lanAddr, guestAddr := reserveUDPAddr(t), reserveUDPAddr(t)
+	server := newServerForTest([]resolver.DnsResolver{&testResolver{
+		acceptFn:  func(*dns.Msg) bool { return true },
+		resolveFn: func(msg *dns.Msg) (*dns.Msg, error) { return makeAResponse(msg, "192.0.2.1"), nil },
+	}})
+	server.config = &config.SwitchyConfig{Listeners: []config.ListenerConfig{
+		{Addr: lanAddr, Protocol: config.ProtocolUDP, Label: "lan"},
+		{Addr: guestAddr, Protocol: config.ProtocolTCP, Label: "guest"},
+	}}
+	server.Start()
+	t.Cleanup(server.Shutdown)
+
+	exchangeWithRetry(t, &dns.Client{Net: "udp", Timeout: time.Second}, makeQuery("lan.example.", dns.TypeA), lanAddr)
+	exchangeWithRetry(t, &dns.Client{Net: "tcp", Timeout: time.Second}, makeQuery("guest.example.", dns.TypeA), guestAddr)
+
+	want := map[string]string{"lan.example.": "lan", "guest.example.": "guest"}
+	for _, line := range strings.Split(logs.String(), "\n") {
+		var entry StructureLog
+		if json.Unmarshal([]byte(line), &entry) != nil || entry.Question == "" {
+			continue
+		}
+		if label, ok := want[entry.Question]; ok {
+			if entry.Listener != label {
+				t.Fatalf("%s logged listener %q, want %q", entry.Question, entry.Listener, label)
+			}
+			delete(want, entry.Question)
+		}
+	}
+	if len(want) != 0 {
+		t.Fatalf("missing log lines for %v in %q", want, logs.String())
+	}
+}
+
+func TestHTTPSListenerServesDoH(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "doh.example")
+	addr := reserveUDPAddr(t)
+	server, err := Create(&config.SwitchyConfig{
+		TLS:       &config.TLSConfig{Cert: certFile, Key: keyFile},
+		Listeners: []config.ListenerConfig{{Addr: addr, Protocol: config.ProtocolHTTPS, Label: "doh"}},
+	})
+	if err != nil {
+		t.Fatalf("Create fail: %v", err)
+	}
+	server.installGen([]resolver.DnsResolver{&testResolver{
+		acceptFn:  func(*dns.Msg) bool { return true },
+		resolveFn: func(msg *dns.Msg) (*dns.Msg, error) { return makeAResponse(msg, "192.0.2.44"), nil },
+	}})
+	server.Start()
+	t.Cleanup(server.Shutdown)
+
+	client := &http.Client{Timeout: time.Second, Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	url := "https://" + addr + "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(packedQuery(t, "doh.example."))
+	var resp *http.Response
+	for range 20 {
+		resp, err = client.Get(url)
+		if err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("DoH over https listener fail: %v", err)
+	}
+	msg := decodeDoHResponse(t, resp)
+	if len(msg.Answer) != 1 || msg.Answer[0].(*dns.A).A.String() != "192.0.2.44" {
+		t.Fatalf("answer = %v, want 192.0.2.44", msg.Answer)
+	}
+}
+
+func TestReloadServerHandsOverUnchangedListeners(t *testing.T) {
+	addr := reserveUDPAddr(t)
+	mockConfig := func(answer string) *config.SwitchyConfig {
+		return &config.SwitchyConfig{
+			Addr:      addr,
+			Resolvers: []config.ResolverConfig{&config.MockConfig{Answer: answer}},
+		}
+	}
+	answerOf := func(resp *dns.Msg) string {
+		if len(resp.Answer) != 1 {
+			t.Fatalf("answer = %v, want one A record", resp.Answer)
+		}
+		return resp.Answer[0].(*dns.A).A.String()
+	}
+
+	first, err := reloadServer(nil, mockConfig("192.0.2.1"))
+	if err != nil {
+		t.Fatalf("initial reloadServer fail: %v", err)
+	}
+	running := first
+	t.Cleanup(func() { running.Shutdown() })
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	if got := answerOf(exchangeWithRetry(t, &dns.Client{}, req, addr)); got != "192.0.2.1" {
+		t.Fatalf("first answer = %s, want 192.0.2.1", got)
+	}
+	before := make(map[string]*dnsListener)
+	for _, l := range first.listeners {
+		before[l.key] = l
+	}
+
+	running, err = reloadServer(first, mockConfig("192.0.2.2"))
+	if err != nil {
+		t.Fatalf("reloadServer fail: %v", err)
+	}
+	if len(running.listeners) != len(before) {
+		t.Fatalf("listeners after reload = %v, want %d", running.listeners, len(before))
+	}
+	for _, l := range running.listeners {
+		if before[l.key] != l {
+			t.Fatalf("listener %s was rebound, want it handed over", l)
+		}
+		if !l.alive() {
+			t.Fatalf("listener %s stopped by old server Shutdown", l)
+		}
+	}
+	if first.listeners != nil {
+		t.Fatalf("old server still owns %v", first.listeners)
+	}
+	// The same socket now answers from the new server's resolvers.
+	for _, c := range []*dns.Client{{Net: "udp"}, {Net: "tcp"}} {
+		if got := answerOf(exchangeWithRetry(t, c, req, addr)); got != "192.0.2.2" {
+			t.Fatalf("%s answer after reload = %s, want 192.0.2.2", c.Net, got)
+		}
+	}
+}
+
+func TestReloadServerNeverRefusesDuringReload(t *testing.T) {
+	addr := reserveUDPAddr(t)
+	mockConfig := func(answer string) *config.SwitchyConfig {
+		return &config.SwitchyConfig{
+			Addr:      addr,
+			Resolvers: []config.ResolverConfig{&config.MockConfig{Answer: answer}},
+		}
+	}
+	running, err := reloadServer(nil, mockConfig("192.0.2.1"))
+	if err != nil {
+		t.Fatalf("initial reloadServer fail: %v", err)
+	}
+	t.Cleanup(func() { running.Shutdown() })
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	exchangeWithRetry(t, &dns.Client{}, req, addr)
+
+	stop := make(chan struct{})
+	var refused, answered atomic.Int32
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := &dns.Client{Timeout: time.Second}
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				resp, _, err := client.Exchange(req, addr)
+				switch {
+				case err != nil:
+				case resp.Rcode == dns.RcodeRefused:
+					refused.Add(1)
+				default:
+					answered.Add(1)
+				}
+			}
+		}()
+	}
+	for i := range 20 {
+		if running, err = reloadServer(running, mockConfig(fmt.Sprintf("192.0.2.%d", i+2))); err != nil {
+			t.Fatalf("reloadServer fail: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+	if refused.Load() != 0 || answered.Load() == 0 {
+		t.Fatalf("during reloads %d queries answered, %d REFUSED; want none refused", answered.Load(), refused.Load())
+	}
+
+	// A query that reached a server after its Shutdown, the window the listener
+	// leaves open, is answered by the successor rather than refused.
+	prev := running
+	if running, err = reloadServer(prev, mockConfig("192.0.2.99")); err != nil {
+		t.Fatalf("reloadServer fail: %v", err)
+	}
+	writer := newCaptureDNSResponseWriter()
+	prev.dnsMsgHandler(&DnsWriter{writer: writer, msg: req.Copy(), start: time.Now().UnixMilli()}, req.Copy())
+	if writer.msg == nil || writer.msg.Rcode != dns.RcodeSuccess || len(writer.msg.Answer) != 1 ||
+		writer.msg.Answer[0].(*dns.A).A.String() != "192.0.2.99" {
+		t.Fatalf("late query on the retired server = %v, want the successor's 192.0.2.99", writer.msg)
+	}
+}
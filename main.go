@@ -9,8 +9,11 @@ import (
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
 	"path/filepath"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -66,32 +69,60 @@ func main() {
 		configChan <- newConfig
 	})
 
+	// procd stop, reboot and opkg upgrade all end with SIGTERM: shut down
+	// properly so the cache snapshot gets written.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
 	var runningServer *DnsSwitchyServer
-	for newConfig := range configChan {
-		runningServer, err = reloadServer(runningServer, newConfig)
-		if err != nil {
-			if runningServer == nil {
-				passOrFatal(err)
+	for {
+		select {
+		case sig := <-signals:
+			log.Printf("Received %s, exiting", sig)
+			if runningServer != nil {
+				runningServer.Shutdown()
 			}
-			log.Printf("Create new server fail: %s", err)
-			continue
+			return
+		case newConfig := <-configChan:
+			runningServer, err = reloadServer(runningServer, newConfig)
+			if err != nil {
+				if runningServer == nil {
+					passOrFatal(err)
+				}
+				log.Printf("Create new server fail: %s", err)
+				continue
+			}
+			// Wire the controller <-> server both ways after each (re)build so web
+			// writes and resolvers-only swaps target the live server.
+			runningServer.configCtl = controller
+			controller.SetServer(runningServer)
 		}
-		// Wire the controller <-> server both ways after each (re)build so web
-		// writes and resolvers-only swaps target the live server.
-		runningServer.configCtl = controller
-		controller.SetServer(runningServer)
 	}
 }
 
 func reloadServer(runningServer *DnsSwitchyServer, conf *config.SwitchyConfig) (*DnsSwitchyServer, error) {
+	// Snapshot first so the new server's Create restores what the running one
+	// has cached up to now, not what the last periodic save saw.
+	if runningServer != nil {
+		runningServer.saveCache()
+	}
 	newServer, err := Create(conf)
 	if err != nil {
 		return runningServer, err
 	}
+	// Sockets whose protocol and address survive the edit are handed over
+	// rather than rebound, so clients see no gap; only the old server's
+	// resolvers and cert watcher are torn down.
 	if runningServer != nil {
-		runningServer.Shutdown()
+		newServer.takeListeners(runningServer)
 	}
 	newServer.Start()
+	if runningServer != nil {
+		// A query the listener handed to runningServer just before Start
+		// retargeted it may reach the resolver chain after Shutdown.
+		runningServer.successor.Store(newServer)
+		runningServer.shutdown(false)
+	}
 	return newServer, nil
 }
 
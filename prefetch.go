@@ -0,0 +1,23 @@
+package main
+
+import (
+	"dns-switchy/util"
+
+	"github.com/miekg/dns"
+)
+
+// getCached looks key up in the global cache. due is true when the cache
+// picked the entry for prefetch: it is popular and about to expire.
+func (s *DnsSwitchyServer) getCached(key util.CacheKey) (cached dns.Msg, due bool) {
+	if pc, ok := s.dnsCache.(util.PrefetchCache); ok {
+		return pc.GetPrefetch(key)
+	}
+	return s.dnsCache.Get(key), false
+}
+
+// prefetch refreshes a popular entry before it expires, so its next client
+// does not wait on upstream. The cache hands each entry out once; a failed
+// prefetch just lets it expire (or go stale) as usual.
+func (s *DnsSwitchyServer) prefetch(msg *dns.Msg) {
+	s.refresh(msg, func(bool) {})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dns-switchy/config"
+	"dns-switchy/resolver"
+	"dns-switchy/util"
+
+	"github.com/miekg/dns"
+)
+
+func TestDnsMsgHandlerPrefetchesPopularNames(t *testing.T) {
+	var calls atomic.Int32
+	server := newServerForTest([]resolver.DnsResolver{&testResolver{
+		acceptFn: func(*dns.Msg) bool { return true },
+		resolveFn: func(msg *dns.Msg) (*dns.Msg, error) {
+			return makeAResponse(msg, fmt.Sprintf("192.0.2.%d", calls.Add(1))), nil
+		},
+		ttl: 200 * time.Millisecond,
+	}})
+	server.dnsCache = util.NewDnsCacheWithConfig(time.Minute, config.CacheConfig{Prefetch: 50, PrefetchHits: 1})
+	query := func() string {
+		t.Helper()
+		writer := newCaptureDNSResponseWriter()
+		msg := makeQuery("example.com.", dns.TypeA)
+		server.dnsMsgHandler(&DnsWriter{writer: writer, msg: msg, start: time.Now().UnixMilli()}, msg)
+		if writer.msg == nil || len(writer.msg.Answer) != 1 {
+			t.Fatalf("response = %v, want one answer", writer.msg)
+		}
+		return writer.msg.Answer[0].(*dns.A).A.String()
+	}
+
+	query()
+	time.Sleep(120 * time.Millisecond) // into the last half of the lifetime
+	if got := query(); got != "192.0.2.1" {
+		t.Fatalf("answer before prefetch = %s, want the cached 192.0.2.1", got)
+	}
+	q := util.KeyOf(makeQuery("example.com.", dns.TypeA))
+	deadline := time.Now().Add(time.Second)
+	for cached := server.dnsCache.Get(q); len(cached.Answer) == 0 || cached.Answer[0].(*dns.A).A.String() != "192.0.2.2"; cached = server.dnsCache.Get(q) {
+		if time.Now().After(deadline) {
+			t.Fatal("popular entry was not prefetched")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := query(); got != "192.0.2.2" || calls.Load() != 2 {
+		t.Fatalf("answer after prefetch = %s with %d upstream calls, want cached 192.0.2.2 and 2", got, calls.Load())
+	}
+}
+
+func TestPrefetchSharesExchangeWithClientMiss(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	server := newServerForTest([]resolver.DnsResolver{&testResolver{
+		acceptFn: func(*dns.Msg) bool { return true },
+		resolveFn: func(msg *dns.Msg) (*dns.Msg, error) {
+			if calls.Add(1) > 1 {
+				<-release
+			}
+			return makeAResponse(msg, "192.0.2.1"), nil
+		},
+		ttl: 200 * time.Millisecond,
+	}})
+	server.dnsCache = util.NewDnsCacheWithConfig(time.Minute, config.CacheConfig{Prefetch: 50, PrefetchHits: 1})
+	server.flights = newFlightGroup()
+	query := func(writer *captureDNSResponseWriter) {
+		msg := makeQuery("example.com.", dns.TypeA)
+		server.dnsMsgHandler(&DnsWriter{writer: writer, msg: msg, start: time.Now().UnixMilli()}, msg)
+	}
+
+	query(newCaptureDNSResponseWriter())
+	time.Sleep(120 * time.Millisecond)   // into the last half of the lifetime
+	query(newCaptureDNSResponseWriter()) // hands the entry out for prefetch
+	deadline := time.Now().Add(time.Second)
+	for calls.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("prefetch did not reach upstream")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// A client miss while the prefetch is still waiting on upstream joins it.
+	server.dnsCache.Clear()
+	writer := newCaptureDNSResponseWriter()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		query(writer)
+	}()
+	for server.flights.Coalesced() < 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("client miss did not join the prefetch exchange")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	<-done
+	if writer.msg == nil || len(writer.msg.Answer) != 1 || calls.Load() != 2 {
+		t.Fatalf("client response = %v with %d upstream calls, want one answer and 2 calls", writer.msg, calls.Load())
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"dns-switchy/config"
+	"dns-switchy/util"
+)
+
+const (
+	// rateLimitSweepInterval is how often idle buckets are dropped so spoofed
+	// or one-off sources do not grow the maps without bound.
+	rateLimitSweepInterval = time.Minute
+	// rateLimitTopSources caps the per-source list in /api/ratelimit.
+	rateLimitTopSources = 100
+	// rateLimitMaxBuckets caps each bucket map between sweeps; once it is
+	// full, new sources share one overflow bucket instead of getting their own.
+	rateLimitMaxBuckets = 10000
+	// rateLimitOverflow names the shared bucket in logs and /api/ratelimit.
+	rateLimitOverflow = "overflow"
+)
+
+// tokenBucket refills at rate tokens per second up to burst; one query costs
+// one token.
+type tokenBucket struct {
+	tokens  float64
+	last    time.Time
+	limited uint64
+}
+
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+}
+
+// rateLimiter is the compiled `rate_limit:` block: a bucket per source IP and
+// one per source prefix (/24, /56 by default). A query passes only if every
+// enabled bucket has a token, and only then are tokens taken, so a source that
+// is already limited does not also drain its neighbours' prefix bucket.
+type rateLimiter struct {
+	conf  config.RateLimitConfig
+	allow *util.IPSet
+	drop  bool
+	now   func() time.Time
+
+	mu         sync.Mutex
+	maxBuckets int
+	clients    map[netip.Addr]*tokenBucket
+	prefixes   map[netip.Prefix]*tokenBucket
+	lastSweep  time.Time
+	passed     uint64
+	limited    uint64
+	exempt     uint64
+}
+
+func newRateLimiter(c *config.RateLimitConfig) *rateLimiter {
+	if c == nil {
+		return nil
+	}
+	return &rateLimiter{
+		conf:       *c,
+		allow:      util.NewIPSet(c.Allow),
+		drop:       c.Action == config.ActionDrop,
+		now:        time.Now,
+		maxBuckets: rateLimitMaxBuckets,
+		clients:    make(map[netip.Addr]*tokenBucket),
+		prefixes:   make(map[netip.Prefix]*tokenBucket),
+		lastSweep:  time.Now(),
+	}
+}
+
+// take charges one query to addr. When it is over the limit, bucket names the
+// source IP or prefix whose bucket ran dry. Peers without an IP are never
+// limited.
+func (r *rateLimiter) take(addr net.Addr) (ok bool, bucket string) {
+	if r == nil {
+		return true, ""
+	}
+	ip, hasIP := util.AddrOf(addr)
+	if !hasIP {
+		return true, ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.allow.Contains(ip) {
+		r.exempt++
+		return true, ""
+	}
+	now := r.now()
+	if now.Sub(r.lastSweep) >= rateLimitSweepInterval {
+		r.sweep(now)
+	}
+	var client, prefix *tokenBucket
+	if r.conf.QPS > 0 {
+		key := bucketKey(r.clients, ip, netip.Addr{}, r.maxBuckets)
+		client = bucketFor(r.clients, key, float64(r.conf.Burst), now)
+		client.refill(now, r.conf.QPS, float64(r.conf.Burst))
+		if client.tokens < 1 {
+			client.limited++
+			r.limited++
+			return false, addrBucketName(key)
+		}
+	}
+	if r.conf.PrefixQPS > 0 {
+		key := bucketKey(r.prefixes, r.prefixOf(ip), netip.Prefix{}, r.maxBuckets)
+		prefix = bucketFor(r.prefixes, key, float64(r.conf.PrefixBurst), now)
+		prefix.refill(now, r.conf.PrefixQPS, float64(r.conf.PrefixBurst))
+		if prefix.tokens < 1 {
+			prefix.limited++
+			r.limited++
+			return false, prefixBucketName(key)
+		}
+	}
+	if client != nil {
+		client.tokens--
+	}
+	if prefix != nil {
+		prefix.tokens--
+	}
+	r.passed++
+	return true, ""
+}
+
+func (r *rateLimiter) prefixOf(ip netip.Addr) netip.Prefix {
+	bits := r.conf.IPv6Prefix
+	if ip.Is4() {
+		bits = r.conf.IPv4Prefix
+	}
+	p, _ := ip.Prefix(bits)
+	return p
+}
+
+// bucketKey returns key, or overflow when key has no bucket yet and the map
+// is already at max, so a flood of spoofed sources between sweeps shares one
+// bucket instead of growing the map. The zero Addr and Prefix never come from
+// a real source and serve as the overflow key.
+func bucketKey[K comparable](buckets map[K]*tokenBucket, key, overflow K, max int) K {
+	if _, ok := buckets[key]; !ok && len(buckets) >= max {
+		return overflow
+	}
+	return key
+}
+
+func addrBucketName(ip netip.Addr) string {
+	if !ip.IsValid() {
+		return rateLimitOverflow
+	}
+	return ip.String()
+}
+
+func prefixBucketName(p netip.Prefix) string {
+	if !p.IsValid() {
+		return rateLimitOverflow
+	}
+	return p.String()
+}
+
+// bucketFor returns the bucket for key, creating a full one for a new source.
+func bucketFor[K comparable](buckets map[K]*tokenBucket, key K, burst float64, now time.Time) *tokenBucket {
+	b, ok := buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		buckets[key] = b
+	}
+	return b
+}
+
+// sweep drops buckets that have refilled completely: a new bucket for the
+// same source would start in the same state. Their per-source counters go
+// with them, so /api/ratelimit lists recent offenders only.
+func (r *rateLimiter) sweep(now time.Time) {
+	r.lastSweep = now
+	for ip, b := range r.clients {
+		if b.refill(now, r.conf.QPS, float64(r.conf.Burst)); b.tokens >= float64(r.conf.Burst) {
+			delete(r.clients, ip)
+		}
+	}
+	for p, b := range r.prefixes {
+		if b.refill(now, r.conf.PrefixQPS, float64(r.conf.PrefixBurst)); b.tokens >= float64(r.conf.PrefixBurst) {
+			delete(r.prefixes, p)
+		}
+	}
+}
+
+type rateLimitSource struct {
+	Source  string `json:"source"`
+	Limited uint64 `json:"limited"`
+}
+
+type rateLimitStats struct {
+	Passed  uint64            `json:"passed"`
+	Limited uint64            `json:"limited"`
+	Exempt  uint64            `json:"exempt"`
+	Tracked int               `json:"tracked"`
+	Sources []rateLimitSource `json:"sources"`
+}
+
+// stats snapshots the counters. Sources lists the IPs and prefixes that have
+// been limited, most limited first.
+func (r *rateLimiter) stats() rateLimitStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := rateLimitStats{
+		Passed:  r.passed,
+		Limited: r.limited,
+		Exempt:  r.exempt,
+		Tracked: len(r.clients) + len(r.prefixes),
+		Sources: []rateLimitSource{},
+	}
+	for ip, b := range r.clients {
+		if b.limited > 0 {
+			out.Sources = append(out.Sources, rateLimitSource{Source: addrBucketName(ip), Limited: b.limited})
+		}
+	}
+	for p, b := range r.prefixes {
+		if b.limited > 0 {
+			out.Sources = append(out.Sources, rateLimitSource{Source: prefixBucketName(p), Limited: b.limited})
+		}
+	}
+	sort.Slice(out.Sources, func(i, j int) bool {
+		if out.Sources[i].Limited != out.Sources[j].Limited {
+			return out.Sources[i].Limited > out.Sources[j].Limited
+		}
+		return out.Sources[i].Source < out.Sources[j].Source
+	})
+	if len(out.Sources) > rateLimitTopSources {
+		out.Sources = out.Sources[:rateLimitTopSources]
+	}
+	return out
+}
+
+// apiRateLimitHandler serves GET /api/ratelimit.
+func (s *DnsSwitchyServer) apiRateLimitHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.limiter == nil {
+		http.Error(w, "rate limit not enabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.limiter.stats())
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"dns-switchy/config"
+	"dns-switchy/resolver"
+
+	"github.com/miekg/dns"
+)
+
+func newTestRateLimiter(t *testing.T, body string) (*rateLimiter, *time.Time) {
+	t.Helper()
+	conf, err := config.ParseConfig(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	limiter := newRateLimiter(conf.RateLimit)
+	now := time.Unix(1700000000, 0)
+	limiter.now = func() time.Time { return now }
+	limiter.lastSweep = now
+	return limiter, &now
+}
+
+func udpFrom(ip string) net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP(ip), Port: 40000}
+}
+
+func TestRateLimiterPerClientBucket(t *testing.T) {
+	limiter, now := newTestRateLimiter(t, "rate_limit:\n  qps: 1\n  burst: 2\n")
+	for i := range 2 {
+		if ok, _ := limiter.take(udpFrom("192.168.1.10")); !ok {
+			t.Fatalf("query %d limited, want burst of 2", i)
+		}
+	}
+	if ok, bucket := limiter.take(udpFrom("192.168.1.10")); ok || bucket != "192.168.1.10" {
+		t.Fatalf("third query = %v, %q, want limited by 192.168.1.10", ok, bucket)
+	}
+	if ok, _ := limiter.take(udpFrom("192.168.1.11")); !ok {
+		t.Fatal("other client limited, want its own bucket")
+	}
+	*now = now.Add(time.Second)
+	if ok, _ := limiter.take(udpFrom("192.168.1.10")); !ok {
+		t.Fatal("query after 1s refill limited, want one token back")
+	}
+	if ok, _ := limiter.take(&FakeAddr{}); !ok {
+		t.Fatal("/api/query peer limited, want peers without IP exempt")
+	}
+}
+
+func TestRateLimiterPrefixBucket(t *testing.T) {
+	limiter, _ := newTestRateLimiter(t, "rate_limit:\n  qps: 1\n  burst: 1\n  prefix_qps: 1\n  prefix_burst: 3\n")
+	// A limited client does not drain its prefix bucket.
+	limiter.take(udpFrom("10.0.0.1"))
+	for range 5 {
+		if ok, _ := limiter.take(udpFrom("10.0.0.1")); ok {
+			t.Fatal("10.0.0.1 passed with an empty client bucket")
+		}
+	}
+	for _, ip := range []string{"10.0.0.2", "10.0.0.3"} {
+		if ok, bucket := limiter.take(udpFrom(ip)); !ok {
+			t.Fatalf("%s limited by %s, want prefix tokens left", ip, bucket)
+		}
+	}
+	if ok, bucket := limiter.take(udpFrom("10.0.0.4")); ok || bucket != "10.0.0.0/24" {
+		t.Fatalf("fourth client in /24 = %v, %q, want limited by 10.0.0.0/24", ok, bucket)
+	}
+	if ok, _ := limiter.take(udpFrom("10.0.1.4")); !ok {
+		t.Fatal("client in another /24 limited")
+	}
+	if ok, _ := limiter.take(udpFrom("2001:db8:0:1::1")); !ok {
+		t.Fatal("first IPv6 client limited")
+	}
+	limiter.take(udpFrom("2001:db8:0:2::1"))
+	limiter.take(udpFrom("2001:db8:0:3::1"))
+	if ok, bucket := limiter.take(udpFrom("2001:db8:0:4::1")); ok || bucket != "2001:db8::/56" {
+		t.Fatalf("fourth client in /56 = %v, %q, want limited by 2001:db8::/56", ok, bucket)
+	}
+}
+
+func TestRateLimiterAllowlistStatsAndSweep(t *testing.T) {
+	limiter, now := newTestRateLimiter(t, "rate_limit:\n  qps: 1\n  burst: 1\n  allow: [192.168.1.1]\n")
+	for range 10 {
+		if ok, _ := limiter.take(udpFrom("192.168.1.1")); !ok {
+			t.Fatal("allowlisted source limited")
+		}
+	}
+	limiter.take(udpFrom("192.168.1.20"))
+	limiter.take(udpFrom("192.168.1.20"))
+	limiter.take(udpFrom("192.168.1.20"))
+	limiter.take(udpFrom("192.168.1.30"))
+	limiter.take(udpFrom("192.168.1.30"))
+
+	stats := limiter.stats()
+	if stats.Passed != 2 || stats.Limited != 3 || stats.Exempt != 10 || stats.Tracked != 2 {
+		t.Fatalf("stats = %+v, want passed 2, limited 3, exempt 10, tracked 2", stats)
+	}
+	want := []rateLimitSource{{Source: "192.168.1.20", Limited: 2}, {Source: "192.168.1.30", Limited: 1}}
+	if len(stats.Sources) != 2 || stats.Sources[0] != want[0] || stats.Sources[1] != want[1] {
+		t.Fatalf("sources = %+v, want %+v", stats.Sources, want)
+	}
+
+	*now = now.Add(rateLimitSweepInterval)
+	limiter.take(udpFrom("192.168.1.40"))
+	if got := limiter.stats().Tracked; got != 1 {
+		t.Fatalf("tracked after sweep = %d, want only the new source", got)
+	}
+}
+
+func TestDnsMsgHandlerRateLimit(t *testing.T) {
+	logs := captureLog(t)
+	server := newServerForTest([]resolver.DnsResolver{&testResolver{
+		acceptFn:  func(*dns.Msg) bool { return true },
+		resolveFn: func(msg *dns.Msg) (*dns.Msg, error) { return makeAResponse(msg, "192.0.2.1"), nil },
+	}})
+	server.limiter, _ = newTestRateLimiter(t, "rate_limit:\n  qps: 1\n  burst: 1\n")
+
+	query := func() *captureDNSResponseWriter {
+		writer := newCaptureDNSResponseWriter()
+		msg := makeQuery("example.com.", dns.TypeA)
+		server.dnsMsgHandler(&DnsWriter{writer: writer, msg: msg, start: time.Now().UnixMilli()}, msg)
+		return writer
+	}
+	if first := query(); first.msg == nil || len(first.msg.Answer) != 1 {
+		t.Fatalf("first response = %v, want answer", first.msg)
+	}
+	if limited := query(); limited.msg == nil || limited.msg.Rcode != dns.RcodeRefused {
+		t.Fatalf("limited response = %v, want REFUSED", limited.msg)
+	}
+	if !strings.Contains(logs.String(), `"resolver":"ratelimit"`) || !strings.Contains(logs.String(), `"rateLimit":"127.0.0.1"`) {
+		t.Fatalf("log %q does not record the rate limit", logs.String())
+	}
+
+	server.limiter.drop = true
+	if dropped := query(); dropped.msg != nil {
+		t.Fatalf("dropped response = %v, want none", dropped.msg)
+	}
+
+	ts := httptest.NewServer(server.httpMux())
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/api/ratelimit")
+	if err != nil {
+		t.Fatalf("GET /api/ratelimit fail: %v", err)
+	}
+	defer resp.Body.Close()
+	var stats rateLimitStats
+	if err = json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatalf("decode stats: %v", err)
+	}
+	if stats.Passed != 1 || stats.Limited != 2 || len(stats.Sources) != 1 || stats.Sources[0].Source != "127.0.0.1" {
+		t.Fatalf("stats = %+v, want 1 passed, 2 limited from 127.0.0.1", stats)
+	}
+}
+
+func TestAPIRateLimitDisabled(t *testing.T) {
+	server := newServerForTest(nil)
+	ts := httptest.NewServer(server.httpMux())
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/api/ratelimit")
+	if err != nil {
+		t.Fatalf("GET /api/ratelimit fail: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404 without rate_limit", resp.StatusCode)
+	}
+}
+
+func TestRateLimiterCapsBuckets(t *testing.T) {
+	limiter, _ := newTestRateLimiter(t, "rate_limit:\n  qps: 1\n  burst: 1\n  prefix_qps: 100\n  prefix_burst: 100\n")
+	limiter.maxBuckets = 3
+	for _, ip := range []string{"10.0.0.1", "10.0.1.1", "10.0.2.1"} {
+		if ok, bucket := limiter.take(udpFrom(ip)); !ok {
+			t.Fatalf("%s limited by %s, want its own bucket", ip, bucket)
+		}
+	}
+	// Past the cap, new sources share one overflow bucket per map.
+	if ok, bucket := limiter.take(udpFrom("10.0.3.1")); !ok {
+		t.Fatalf("first overflow source limited by %s", bucket)
+	}
+	for _, ip := range []string{"10.0.4.1", "10.0.5.1", "10.0.6.1"} {
+		if ok, bucket := limiter.take(udpFrom(ip)); ok || bucket != rateLimitOverflow {
+			t.Fatalf("%s = %v, %q, want limited by %q", ip, ok, bucket, rateLimitOverflow)
+		}
+	}
+	if ok, bucket := limiter.take(udpFrom("10.0.0.1")); ok || bucket != "10.0.0.1" {
+		t.Fatalf("tracked source = %v, %q, want limited by its own bucket", ok, bucket)
+	}
+	stats := limiter.stats()
+	if stats.Tracked != 8 {
+		t.Fatalf("tracked = %d, want 4 clients and 4 prefixes", stats.Tracked)
+	}
+	if len(stats.Sources) == 0 || stats.Sources[0] != (rateLimitSource{Source: rateLimitOverflow, Limited: 3}) {
+		t.Fatalf("sources = %+v, want overflow first with 3", stats.Sources)
+	}
+}
@@ -1,6 +1,7 @@
 package resolver
 
 import (
+	"dns-switchy/config"
 	"github.com/miekg/dns"
 	"time"
 )
@@ -18,6 +19,34 @@ type NftSetAware interface {
 	NftSetSpec() (set4 string, ttl time.Duration)
 }
 
+// UpstreamAware 由带上游的 resolver（forward、forward-group、preloader）实现，
+// 按配置顺序报告每个上游的健康与延迟。
+type UpstreamAware interface {
+	UpstreamStats() []UpstreamStats
+}
+
+// TypeOf 返回 r 对应的配置类型。filter 就是不带 answer 的 mock；forward 与
+// forward-group 构造出同一种 resolver，统一报 forward。不认识的 resolver 返回空串。
+func TypeOf(r DnsResolver) config.ResolverType {
+	switch r := r.(type) {
+	case *Preloader:
+		return config.PRELOADER
+	case *Forward:
+		return config.FORWARD
+	case *FileResolver:
+		return config.FILE
+	case *Mock:
+		if r.Answer == "" {
+			return config.FILTER
+		}
+		return config.MOCK
+	case *Mdns:
+		return config.MDNS
+	default:
+		return ""
+	}
+}
+
 type NoCache struct {
 }
 
@@ -2,6 +2,8 @@ package resolver
 
 import (
 	"testing"
+
+	"dns-switchy/config"
 )
 
 func TestResolverNoCacheTTLReturnsMinusOne(t *testing.T) {
@@ -9,3 +11,21 @@ func TestResolverNoCacheTTLReturnsMinusOne(t *testing.T) {
 		t.Fatalf("NoCache{}.TTL() = %v, want -1", got)
 	}
 }
+
+func TestTypeOf(t *testing.T) {
+	for _, tt := range []struct {
+		r    DnsResolver
+		want config.ResolverType
+	}{
+		{&Forward{}, config.FORWARD},
+		{&Preloader{}, config.PRELOADER},
+		{&FileResolver{}, config.FILE},
+		{&Mock{Answer: "0.0.0.0"}, config.MOCK},
+		{&Mock{}, config.FILTER},
+		{&Mdns{}, config.MDNS},
+	} {
+		if got := TypeOf(tt.r); got != tt.want {
+			t.Fatalf("TypeOf(%T) = %q, want %q", tt.r, got, tt.want)
+		}
+	}
+}
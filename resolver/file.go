@@ -2,6 +2,7 @@ package resolver
 
 import (
 	"dns-switchy/config"
+	"dns-switchy/util"
 	"fmt"
 	"github.com/miekg/dns"
 	"log"
@@ -55,6 +56,7 @@ type DomainQuery struct {
 
 type FileResolver struct {
 	NoCache
+	sourceFilter
 	location      string
 	mu            sync.RWMutex
 	inMemory      QueryMap
@@ -162,13 +164,10 @@ type Lease struct {
 
 func (lease *Lease) Parse(content string) QueryMap {
 	inMemory := make(QueryMap)
-	for _, line := range LineSeparator.Split(content, -1) {
-		if strings.TrimSpace(line) != "" {
-			parts := BlankSeparator.Split(line, -1)
-			if len(parts) == 5 && parts[3] != "*" {
-				inMemory.put(parts[3], parts[2])
-				inMemory.put(parts[3]+"."+lease.domain, parts[2])
-			}
+	for _, entry := range util.ParseLeases(content) {
+		if entry.Hostname != "*" {
+			inMemory.put(entry.Hostname, entry.IP.String())
+			inMemory.put(entry.Hostname+"."+lease.domain, entry.IP.String())
 		}
 	}
 	return inMemory
@@ -9,23 +9,36 @@ import (
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/miekg/dns"
 	"log"
+	"math/rand/v2"
+	"net"
 	"net/netip"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var BreakError = errors.New("stop on fail")
 
+// RejectedError marks an answer turned down by expect-ip / bogus-ip: most
+// likely a poisoned reply, so the next resolver is asked instead.
+var RejectedError = errors.New("answer rejected")
+
 type Forward struct {
+	sourceFilter
 	Name string
 	upstream.Upstream
 	util.DomainMatcher
 	ttl         time.Duration
-	stat        ForwardStat
 	breakOnFail bool
 	nftSet      string
 	nftSetTTL   time.Duration
+	// expect-ip 按地址族拆开：只有 IPv4 网段（如 chnroute）时 AAAA 答案不检查。
+	expectIP4 *util.IPSet // nil = 不检查 A
+	expectIP6 *util.IPSet // nil = 不检查 AAAA
+	bogusIP   *util.IPSet
 }
 
 func (forward *Forward) TTL() time.Duration {
@@ -45,6 +58,15 @@ func (forward *Forward) String() string {
 	return forward.Name
 }
 
+// UpstreamStats reports the upstreams' health and latency; nil unless the
+// Forward was built by NewForward.
+func (forward *Forward) UpstreamStats() []UpstreamStats {
+	if mu, ok := forward.Upstream.(*MultiUpstream); ok {
+		return mu.Stats()
+	}
+	return nil
+}
+
 func (forward *Forward) Accept(msg *dns.Msg) bool {
 	question := msg.Question[0]
 	domain := strings.TrimRight(question.Name, ".")
@@ -52,98 +74,233 @@ func (forward *Forward) Accept(msg *dns.Msg) bool {
 }
 
 func (forward *Forward) Resolve(msg *dns.Msg) (*dns.Msg, error) {
-	if forward.stat.isAlive() {
-		resp, err := forward.Exchange(msg)
-		if changed, alive := forward.stat.checkStatus(err); changed && !alive {
-			log.Printf("%s is dead, will skip", forward.String())
-		}
-		if err != nil {
-			if forward.breakOnFail {
-				return resp, BreakError
-			}
+	resp, err := forward.Exchange(msg)
+	if err != nil {
+		if forward.breakOnFail {
+			return resp, BreakError
 		}
 		return resp, err
-	} else {
-		probe := msg.Copy()
-		go func(probe *dns.Msg) {
-			_, err := forward.Exchange(probe)
-			if changed, alive := forward.stat.checkStatus(err); changed && alive {
-				log.Printf("%s is alive, will cusome", forward.String())
-			}
-		}(probe)
-		if forward.breakOnFail {
-			return nil, BreakError
+	}
+	// A rejected answer always falls through, break-on-fail or not: the next
+	// resolver is the one expected to answer it.
+	if err = forward.checkAnswer(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// checkAnswer rejects an answer with an A/AAAA address outside expect-ip or
+// inside bogus-ip. An address is held against expect-ip only when the list has
+// prefixes of its family. The upstream itself answered fine, so its health is
+// left alone.
+func (forward *Forward) checkAnswer(resp *dns.Msg) error {
+	if forward.expectIP4 == nil && forward.expectIP6 == nil && forward.bogusIP == nil {
+		return nil
+	}
+	for _, rr := range resp.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			continue
+		}
+		addr = addr.Unmap()
+		expectIP := forward.expectIP6
+		if addr.Is4() {
+			expectIP = forward.expectIP4
+		}
+		if expectIP != nil && !expectIP.Contains(addr) {
+			return fmt.Errorf("%w: %s answered %s, not in expect-ip", RejectedError, forward, addr)
+		}
+		if forward.bogusIP.Contains(addr) {
+			return fmt.Errorf("%w: %s answered %s, in bogus-ip", RejectedError, forward, addr)
 		}
-		return nil, errors.New(forward.String() + ": too many fail, just skip")
 	}
+	return nil
 }
 
-type ForwardStat struct {
-	mu           sync.Mutex
+// rttSmoothing is how much a new sample moves an upstream's smoothed RTT
+// (1/8, as TCP does). A failed exchange counts as at least failureRTT so an
+// upstream that errors fast does not look like the fastest one.
+const (
+	rttSmoothing = 8
+	failureRTT   = time.Second
+)
+
+// rttWindow is how many recent successful RTTs an upstream keeps for its
+// latency percentiles.
+const rttWindow = 128
+
+const (
+	// defaultFailThreshold / defaultRecoverThreshold 是连续失败多少次判死、
+	// 死后连续探测成功多少次复活。
+	defaultFailThreshold    = 5
+	defaultRecoverThreshold = 5
+	// 死掉的上游先隔 probeBackoffMin 探一次，探测失败一次间隔翻倍，最长 probeBackoffMax。
+	probeBackoffMin = time.Second
+	probeBackoffMax = 5 * time.Minute
+)
+
+// errUpstreamsDown is returned without asking anyone when every upstream is
+// dead; the dead ones are still probed in the background.
+var errUpstreamsDown = errors.New("all upstreams down, just skip")
+
+// upstreamState is one upstream of a MultiUpstream with what it measured so
+// far and whether it is considered alive.
+type upstreamState struct {
+	upstream.Upstream
+	weight int
+
+	mu       sync.Mutex
+	srtt     time.Duration
+	queries  uint64
+	failures uint64
+	rtts     [rttWindow]time.Duration // ring of recent successful RTTs
+	rttCount int                      // samples ever taken; rtts[rttCount%rttWindow] is next
+
 	alive        bool
-	failCount    int
-	successCount int
+	failCount    int // consecutive failures while alive
+	successCount int // consecutive successful probes while dead
+	probing      bool
+	probeAt      time.Time // earliest next probe while dead
+	backoff      time.Duration
 }
 
-func (stat *ForwardStat) isAlive() bool {
-	stat.mu.Lock()
-	defer stat.mu.Unlock()
-	return stat.alive
+// UpstreamStats is what a MultiUpstream measured for one of its upstreams.
+// The percentiles cover the last rttWindow successful exchanges; all RTTs are
+// 0 until there is one.
+type UpstreamStats struct {
+	Address       string
+	Alive         bool
+	FailCount     int // consecutive failures while alive
+	SuccessCount  int // consecutive successful probes while dead
+	Queries       uint64
+	Failures      uint64
+	SRTT          time.Duration // smoothed, failures included
+	P50, P90, P99 time.Duration
 }
 
-func (stat *ForwardStat) snapshot() (alive bool, failCount int, successCount int) {
-	stat.mu.Lock()
-	defer stat.mu.Unlock()
-	return stat.alive, stat.failCount, stat.successCount
+func (us *upstreamState) record(rtt time.Duration, err error) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if err != nil {
+		us.failures++
+		rtt = max(rtt, failureRTT)
+	} else {
+		us.rtts[us.rttCount%rttWindow] = rtt
+		us.rttCount++
+	}
+	us.queries++
+	if us.queries == 1 {
+		us.srtt = rtt
+	} else {
+		us.srtt += (rtt - us.srtt) / rttSmoothing
+	}
 }
 
-func (stat *ForwardStat) checkStatus(e error) (changed bool, alive bool) {
-	stat.mu.Lock()
-	defer stat.mu.Unlock()
-
-	if stat.alive {
-		if e != nil {
-			stat.failCount += 1
-			if stat.failCount >= 5 {
-				stat.failCount = 0
-				stat.successCount = 0
-				stat.alive = false
-				changed = true
-			}
-		} else {
-			stat.failCount = 0
-		}
-	} else {
-		if e != nil {
-			stat.successCount = 0
-		} else {
-			stat.successCount += 1
-			if stat.successCount >= 5 {
-				stat.failCount = 0
-				stat.successCount = 0
-				stat.alive = true
-				changed = true
-			}
-		}
+// latency orders upstreams for lowest-latency; one never asked goes first so
+// it gets measured.
+func (us *upstreamState) latency() time.Duration {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if us.queries == 0 {
+		return -1
 	}
-	return changed, stat.alive
+	return us.srtt
 }
 
-// MultiUpstream races several upstreams concurrently (first success wins) and
-// tracks in-flight Exchange goroutines so Close() can wait for losers to exit
-// before tearing down the upstream connections (avoids Exchange-after-close).
+func (us *upstreamState) stats() UpstreamStats {
+	us.mu.Lock()
+	samples := append([]time.Duration(nil), us.rtts[:min(us.rttCount, rttWindow)]...)
+	stats := UpstreamStats{
+		Address:      us.Address(),
+		Alive:        us.alive,
+		FailCount:    us.failCount,
+		SuccessCount: us.successCount,
+		Queries:      us.queries,
+		Failures:     us.failures,
+		SRTT:         us.srtt,
+	}
+	us.mu.Unlock()
+	slices.Sort(samples)
+	stats.P50, stats.P90, stats.P99 = percentile(samples, 50), percentile(samples, 90), percentile(samples, 99)
+	return stats
+}
+
+// percentile is the nearest-rank p-th percentile of sorted samples.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[(len(sorted)*p+99)/100-1]
+}
+
+// MultiUpstream asks several upstreams according to its strategy (see
+// config.StrategyRace and friends). Race asks all of them concurrently (first
+// success wins) and tracks in-flight Exchange goroutines so Close() can wait
+// for losers to exit before tearing down the upstream connections (avoids
+// Exchange-after-close). The other strategies ask one upstream at a time and
+// fall back to the next on failure.
+//
+// Each upstream has its own health: after failThreshold consecutive failures
+// it is dead and left out of every strategy, while a copy of a client query is
+// sent to it now and then (exponential backoff) until recoverThreshold probes
+// in a row succeed. With active probes (see startProbe) a probe query of its
+// own is sent instead.
 type MultiUpstream struct {
-	upstreams []upstream.Upstream
-	wg        sync.WaitGroup
+	upstreams        []*upstreamState
+	strategy         string
+	failThreshold    int
+	recoverThreshold int
+	next             atomic.Uint32   // round-robin position
+	intn             func(n int) int // weighted-random pick
+	now              func() time.Time
+	wg               sync.WaitGroup // racing losers and probes
+
+	probe     *dns.Question // set when probing actively
+	probeStop chan struct{}
+	probeDone chan struct{}
 }
 
 func NewMultiUpstream(upstreams []upstream.Upstream) *MultiUpstream {
-	return &MultiUpstream{upstreams: upstreams}
+	return newMultiUpstream(upstreams, nil, config.StrategyRace)
+}
+
+// newMultiUpstream pairs upstreams with weights (missing or 0 = 1).
+func newMultiUpstream(upstreams []upstream.Upstream, weights []int, strategy string) *MultiUpstream {
+	states := make([]*upstreamState, len(upstreams))
+	for i, u := range upstreams {
+		weight := 1
+		if i < len(weights) && weights[i] > 0 {
+			weight = weights[i]
+		}
+		states[i] = &upstreamState{Upstream: u, weight: weight, alive: true}
+	}
+	return &MultiUpstream{
+		upstreams:        states,
+		strategy:         strategy,
+		failThreshold:    defaultFailThreshold,
+		recoverThreshold: defaultRecoverThreshold,
+		intn:             rand.IntN,
+		now:              time.Now,
+	}
 }
 
 func (mu *MultiUpstream) Close() error {
+	if mu.probeStop != nil {
+		close(mu.probeStop)
+		<-mu.probeDone
+	}
 	// Wait for all in-flight racing Exchange goroutines (the losers that are
-	// still blocked inside up.Exchange) to return before closing upstreams.
+	// still blocked inside up.Exchange) and probes to return before closing
+	// upstreams.
 	mu.wg.Wait()
 	for _, u := range mu.upstreams {
 		_ = u.Close()
@@ -152,28 +309,161 @@ func (mu *MultiUpstream) Close() error {
 }
 
 func (mu *MultiUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	candidates := mu.candidates(m)
+	if len(candidates) == 0 {
+		return nil, errUpstreamsDown
+	}
 	if len(mu.upstreams) == 1 {
 		// Single upstream: synchronous, no goroutine, already covered by the
 		// caller's lifecycle (outer RCU). No WaitGroup tracking needed.
-		return mu.upstreams[0].Exchange(m)
+		return mu.exchange(candidates[0], m)
+	}
+	switch mu.strategy {
+	case config.StrategySequential, config.StrategyRoundRobin, config.StrategyWeighted, config.StrategyLowestLatency:
+		// Synchronous like the single upstream case.
+		var lastErr error
+		for _, us := range mu.order(candidates) {
+			resp, err := mu.exchange(us, m)
+			if err == nil {
+				return resp, nil
+			}
+			lastErr = err
+		}
+		return nil, fmt.Errorf("all upstreams fail: %w", lastErr)
+	default:
+		return mu.race(m, candidates)
+	}
+}
+
+// candidates returns the alive upstreams and, unless probing actively, sends
+// a copy of m to each dead one whose next probe is due.
+func (mu *MultiUpstream) candidates(m *dns.Msg) []*upstreamState {
+	alive := make([]*upstreamState, 0, len(mu.upstreams))
+	now := mu.now()
+	for _, us := range mu.upstreams {
+		us.mu.Lock()
+		switch {
+		case us.alive:
+			alive = append(alive, us)
+		case mu.probe == nil && !us.probing && !now.Before(us.probeAt):
+			us.probing = true
+			mu.wg.Add(1)
+			go func(probe *dns.Msg) {
+				defer mu.wg.Done()
+				_, _ = mu.exchange(us, probe)
+			}(m.Copy())
+		}
+		us.mu.Unlock()
+	}
+	return alive
+}
+
+// exchange asks the upstream and records the outcome. With another upstream
+// to fall back to, a refusal is returned as an error along with the reply and
+// counts against the upstream's health; a lone upstream's refusal is the
+// answer, and must not get it marked dead.
+func (mu *MultiUpstream) exchange(us *upstreamState, m *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := us.Exchange(m)
+	if err == nil && resp.Rcode == dns.RcodeRefused && len(mu.upstreams) > 1 {
+		err = errors.New(us.Address() + " refused request: " + m.Question[0].String())
+	}
+	us.record(time.Since(start), err)
+	mu.observe(us, err)
+	return resp, err
+}
+
+// observe moves an upstream between alive and dead. While dead, every outcome
+// is a probe's: a failure doubles the wait before the next one, a success
+// allows the next right away so recovery takes recoverThreshold queries.
+func (mu *MultiUpstream) observe(us *upstreamState, err error) (changed bool, alive bool) {
+	us.mu.Lock()
+	now := mu.now()
+	if us.alive {
+		if err == nil {
+			us.failCount = 0
+		} else if us.failCount++; us.failCount >= mu.failThreshold {
+			us.alive, us.failCount, us.successCount = false, 0, 0
+			us.backoff = probeBackoffMin
+			us.probeAt = now.Add(us.backoff)
+			changed = true
+		}
+	} else {
+		us.probing = false
+		if err != nil {
+			us.successCount = 0
+			us.backoff = min(us.backoff*2, probeBackoffMax)
+			us.probeAt = now.Add(us.backoff)
+		} else if us.successCount++; us.successCount >= mu.recoverThreshold {
+			us.alive, us.failCount, us.successCount = true, 0, 0
+			changed = true
+		} else {
+			us.backoff = probeBackoffMin
+			us.probeAt = now
+		}
+	}
+	alive = us.alive
+	us.mu.Unlock()
+	if changed && alive {
+		log.Printf("upstream %s is alive, will use", us.Address())
+	} else if changed {
+		log.Printf("upstream %s is dead, will skip", us.Address())
 	}
+	return changed, alive
+}
+
+// order is the order the one-at-a-time strategies ask the candidates in: the
+// strategy picks the first, the rest follow in config order after it
+// (lowest-latency sorts them all).
+func (mu *MultiUpstream) order(candidates []*upstreamState) []*upstreamState {
+	n := len(candidates)
+	ordered := make([]*upstreamState, 0, n)
+	first := 0
+	switch mu.strategy {
+	case config.StrategyRoundRobin:
+		first = int((mu.next.Add(1) - 1) % uint32(n))
+	case config.StrategyWeighted:
+		total := 0
+		for _, us := range candidates {
+			total += us.weight
+		}
+		pick := mu.intn(total)
+		for i, us := range candidates {
+			if pick < us.weight {
+				first = i
+				break
+			}
+			pick -= us.weight
+		}
+	case config.StrategyLowestLatency:
+		latency := make(map[*upstreamState]time.Duration, n)
+		for _, us := range candidates {
+			latency[us] = us.latency()
+		}
+		ordered = append(ordered, candidates...)
+		sort.SliceStable(ordered, func(i, j int) bool { return latency[ordered[i]] < latency[ordered[j]] })
+		return ordered
+	}
+	for i := range n {
+		ordered = append(ordered, candidates[(first+i)%n])
+	}
+	return ordered
+}
+
+func (mu *MultiUpstream) race(m *dns.Msg, candidates []*upstreamState) (*dns.Msg, error) {
 	result := make(chan interface{})
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
-	for _, u := range mu.upstreams {
+	for _, u := range candidates {
 		mu.wg.Add(1)
-		go func(up upstream.Upstream, q *dns.Msg) {
+		go func(up *upstreamState, q *dns.Msg) {
 			defer mu.wg.Done()
-			resp, err := up.Exchange(q.Copy())
+			resp, err := mu.exchange(up, q.Copy())
 			var r interface{}
 			if err != nil {
 				r = err
 			} else {
-				if resp.Rcode == dns.RcodeRefused {
-					r = errors.New(up.Address() + " refused request: " + q.Question[0].String())
-				} else {
-					r = resp
-				}
+				r = resp
 			}
 			select {
 			case <-ctx.Done():
@@ -183,7 +473,7 @@ func (mu *MultiUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
 			}
 		}(u, m)
 	}
-	for range mu.upstreams {
+	for range candidates {
 		ret := <-result
 		if r, ok := ret.(*dns.Msg); ok {
 			return r, nil
@@ -192,6 +482,15 @@ func (mu *MultiUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
 	return nil, errors.New("all upstreams fail")
 }
 
+// Stats reports each upstream's measurements, in config order.
+func (mu *MultiUpstream) Stats() []UpstreamStats {
+	stats := make([]UpstreamStats, len(mu.upstreams))
+	for i, us := range mu.upstreams {
+		stats[i] = us.stats()
+	}
+	return stats
+}
+
 func (mu *MultiUpstream) Address() string {
 	addresses := make([]string, 0)
 	for _, u := range mu.upstreams {
@@ -207,10 +506,12 @@ func NewForward(config *config.ForwardConfig) (*Forward, error) {
 		return nil, fmt.Errorf("init domain matcher fail: %w", err)
 	}
 	upstreams := make([]upstream.Upstream, 0)
+	weights := make([]int, 0)
 	if config.UpstreamConfig.Url != "" {
 		firstLevel, err := createUpStream(config.UpstreamConfig)
 		if err == nil {
 			upstreams = append(upstreams, firstLevel)
+			weights = append(weights, config.UpstreamConfig.Weight)
 		} else {
 			log.Printf("init first class upstream with %v fail: %v ", config.UpstreamConfig, err)
 		}
@@ -219,6 +520,7 @@ func NewForward(config *config.ForwardConfig) (*Forward, error) {
 		one, err := createUpStream(upConfig)
 		if err == nil {
 			upstreams = append(upstreams, one)
+			weights = append(weights, upConfig.Weight)
 		} else {
 			log.Printf("init upstream with %v fail: %v ", upConfig, err)
 		}
@@ -226,21 +528,72 @@ func NewForward(config *config.ForwardConfig) (*Forward, error) {
 	if len(upstreams) == 0 {
 		err = fmt.Errorf("all url fails")
 	}
-	up := NewMultiUpstream(upstreams)
+	up := newMultiUpstream(upstreams, weights, config.Strategy)
+	if config.FailThreshold > 0 {
+		up.failThreshold = config.FailThreshold
+	}
+	if config.RecoverThreshold > 0 {
+		up.recoverThreshold = config.RecoverThreshold
+	}
 
 	if err != nil {
 		return nil, fmt.Errorf("init upstream with %v fail: %w ", config, err)
 	}
-	return &Forward{
+	if config.Probe != nil {
+		if err = up.startProbe(config.Probe); err != nil {
+			_ = up.Close()
+			return nil, fmt.Errorf("init probe of %s fail: %w", config.Name, err)
+		}
+	}
+	forward := &Forward{
 		Name:          config.Name,
 		Upstream:      up,
 		DomainMatcher: domainMatcher,
 		ttl:           config.TTL,
-		stat:          ForwardStat{alive: true},
 		breakOnFail:   config.BreakOnFail,
 		nftSet:        config.NftSet,
 		nftSetTTL:     config.NftSetTTL,
-	}, nil
+	}
+	expect, err := parseAnswerPrefixes(config.ExpectIP)
+	var bogus []netip.Prefix
+	if err == nil {
+		bogus, err = parseAnswerPrefixes(config.BogusIP)
+	}
+	if err != nil {
+		_ = up.Close()
+		return nil, fmt.Errorf("init answer ip check of %s fail: %w", config.Name, err)
+	}
+	forward.expectIP4 = newAnswerIPSet(expect, netip.Addr.Is4)
+	forward.expectIP6 = newAnswerIPSet(expect, netip.Addr.Is6)
+	forward.bogusIP = newAnswerIPSet(bogus, nil)
+	return forward, nil
+}
+
+func parseAnswerPrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		p, err := config.ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+// newAnswerIPSet builds an expect-ip / bogus-ip set of the prefixes whose
+// address passes family (all of them when nil); nil when there are none.
+func newAnswerIPSet(prefixes []netip.Prefix, family func(netip.Addr) bool) *util.IPSet {
+	var kept []netip.Prefix
+	for _, p := range prefixes {
+		if family == nil || family(p.Addr()) {
+			kept = append(kept, p)
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return util.NewIPSet(kept)
 }
 
 func createUpStream(upConfig config.UpstreamConfig) (upstream.Upstream, error) {
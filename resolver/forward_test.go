@@ -2,10 +2,14 @@ package resolver
 
 import (
 	"errors"
+	"net/netip"
 	"sync"
 	"testing"
 	"time"
 
+	"dns-switchy/config"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/miekg/dns"
 )
 
@@ -42,6 +46,24 @@ func (testForwardSuccessUpstream) Close() error {
 	return nil
 }
 
+type testForwardRcodeUpstream struct {
+	rcode int
+}
+
+func (up testForwardRcodeUpstream) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	resp := new(dns.Msg)
+	resp.SetRcode(msg, up.rcode)
+	return resp, nil
+}
+
+func (testForwardRcodeUpstream) Address() string {
+	return "test-forward-rcode"
+}
+
+func (testForwardRcodeUpstream) Close() error {
+	return nil
+}
+
 type testForwardProbeUpstream struct {
 	entered  chan *dns.Msg
 	release  chan struct{}
@@ -72,23 +94,44 @@ func newForwardTestMsg(name string) *dns.Msg {
 	return msg
 }
 
-func waitForForwardStat(t *testing.T, stat *ForwardStat, wantAlive bool, wantFailCount int, wantSuccessCount int) {
+func healthOf(us *upstreamState) (alive bool, failCount int, successCount int) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	return us.alive, us.failCount, us.successCount
+}
+
+func waitForUpstreamHealth(t *testing.T, us *upstreamState, wantAlive bool, wantFailCount int, wantSuccessCount int) {
 	t.Helper()
 
 	deadline := time.Now().Add(2 * time.Second)
 	for time.Now().Before(deadline) {
-		alive, failCount, successCount := stat.snapshot()
+		alive, failCount, successCount := healthOf(us)
 		if alive == wantAlive && failCount == wantFailCount && successCount == wantSuccessCount {
-			return
+			us.mu.Lock()
+			probing := us.probing
+			us.mu.Unlock()
+			if !probing {
+				return
+			}
 		}
 		time.Sleep(time.Millisecond)
 	}
 
-	alive, failCount, successCount := stat.snapshot()
-	t.Fatalf("ForwardStat = {alive:%v failCount:%d successCount:%d}, want {alive:%v failCount:%d successCount:%d}", alive, failCount, successCount, wantAlive, wantFailCount, wantSuccessCount)
+	alive, failCount, successCount := healthOf(us)
+	t.Fatalf("upstream health = {alive:%v failCount:%d successCount:%d}, want {alive:%v failCount:%d successCount:%d}", alive, failCount, successCount, wantAlive, wantFailCount, wantSuccessCount)
 }
 
-func runConcurrentForwardStatUpdates(stat *ForwardStat, workers int, err error) int {
+// newDeadMultiUpstream returns a single-upstream MultiUpstream whose upstream
+// is already dead with a probe due, on a clock the test moves.
+func newDeadMultiUpstream(up upstream.Upstream, now *time.Time) *MultiUpstream {
+	mu := NewMultiUpstream([]upstream.Upstream{up})
+	mu.now = func() time.Time { return *now }
+	us := mu.upstreams[0]
+	us.alive, us.backoff, us.probeAt = false, probeBackoffMin, *now
+	return mu
+}
+
+func runConcurrentHealthUpdates(mu *MultiUpstream, workers int, err error) int {
 	start := make(chan struct{})
 	changed := make(chan struct{}, workers)
 	var wg sync.WaitGroup
@@ -98,7 +141,7 @@ func runConcurrentForwardStatUpdates(stat *ForwardStat, workers int, err error)
 		go func() {
 			defer wg.Done()
 			<-start
-			if statusChanged, _ := stat.checkStatus(err); statusChanged {
+			if statusChanged, _ := mu.observe(mu.upstreams[0], err); statusChanged {
 				changed <- struct{}{}
 			}
 		}()
@@ -115,12 +158,13 @@ func runConcurrentForwardStatUpdates(stat *ForwardStat, workers int, err error)
 	return count
 }
 
-func TestForwardStatResolveMarksDeadAfterFiveFailures(t *testing.T) {
+func TestUpstreamHealthResolveMarksDeadAfterFiveFailures(t *testing.T) {
+	mu := NewMultiUpstream([]upstream.Upstream{testForwardErrUpstream{err: errors.New("boom")}})
 	forward := &Forward{
 		Name:     "test-forward-dead-threshold",
-		Upstream: testForwardErrUpstream{err: errors.New("boom")},
-		stat:     ForwardStat{alive: true},
+		Upstream: mu,
 	}
+	us := mu.upstreams[0]
 
 	for i := 1; i <= 4; i++ {
 		resp, err := forward.Resolve(newForwardTestMsg("example.com"))
@@ -131,7 +175,7 @@ func TestForwardStatResolveMarksDeadAfterFiveFailures(t *testing.T) {
 			t.Fatalf("Resolve() resp = %v, want nil", resp)
 		}
 
-		alive, failCount, successCount := forward.stat.snapshot()
+		alive, failCount, successCount := healthOf(us)
 		if !alive {
 			t.Fatalf("after %d failures alive = false, want true", i)
 		}
@@ -151,7 +195,7 @@ func TestForwardStatResolveMarksDeadAfterFiveFailures(t *testing.T) {
 		t.Fatalf("Resolve() resp = %v, want nil", resp)
 	}
 
-	alive, failCount, successCount := forward.stat.snapshot()
+	alive, failCount, successCount := healthOf(us)
 	if alive {
 		t.Fatal("alive = true after 5 failures, want false")
 	}
@@ -161,13 +205,51 @@ func TestForwardStatResolveMarksDeadAfterFiveFailures(t *testing.T) {
 	if successCount != 0 {
 		t.Fatalf("successCount = %d after death transition, want 0", successCount)
 	}
+
+	if _, err := forward.Resolve(newForwardTestMsg("example.com")); !errors.Is(err, errUpstreamsDown) {
+		t.Fatalf("Resolve() on dead upstream error = %v, want %v", err, errUpstreamsDown)
+	}
+	if queries := mu.Stats()[0].Queries; queries != 5 {
+		t.Fatalf("dead upstream asked %d times, want 5 (no probe before the backoff)", queries)
+	}
 }
 
-func TestForwardStatDeadProbeMarksAliveAfterFiveSuccesses(t *testing.T) {
+func TestUpstreamHealthRefusalFromLoneUpstream(t *testing.T) {
+	refused := testForwardRcodeUpstream{rcode: dns.RcodeRefused}
+	lone := NewMultiUpstream([]upstream.Upstream{refused})
+	forward := &Forward{
+		Name:     "test-forward-lone-refusal",
+		Upstream: lone,
+	}
+	for i := 1; i <= 2*defaultFailThreshold; i++ {
+		resp, err := forward.Resolve(newForwardTestMsg("example.com"))
+		if err != nil || resp == nil || resp.Rcode != dns.RcodeRefused {
+			t.Fatalf("Resolve() #%d = %v, %v, want the REFUSED reply as the answer", i, resp, err)
+		}
+	}
+	if alive, failCount, _ := healthOf(lone.upstreams[0]); !alive || failCount != 0 {
+		t.Fatalf("lone upstream health = alive %v, failCount %d after refusals; want alive, 0", alive, failCount)
+	}
+
+	// With another upstream to fall back to, refusals count.
+	pair := NewMultiUpstream([]upstream.Upstream{refused, testForwardSuccessUpstream{}})
+	pair.strategy = config.StrategySequential
+	for i := 0; i < defaultFailThreshold; i++ {
+		if resp, err := pair.Exchange(newForwardTestMsg("example.com")); err != nil || resp.Rcode != dns.RcodeSuccess {
+			t.Fatalf("Exchange() = %v, %v, want the second upstream's answer", resp, err)
+		}
+	}
+	if alive, _, _ := healthOf(pair.upstreams[0]); alive {
+		t.Fatalf("refusing upstream alive after %d refusals, want dead", defaultFailThreshold)
+	}
+}
+
+func TestUpstreamHealthDeadProbeMarksAliveAfterFiveSuccesses(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	mu := newDeadMultiUpstream(testForwardSuccessUpstream{}, &now)
 	forward := &Forward{
 		Name:     "test-forward-alive-threshold",
-		Upstream: testForwardSuccessUpstream{},
-		stat:     ForwardStat{alive: false},
+		Upstream: mu,
 	}
 
 	for i := 1; i <= 4; i++ {
@@ -178,7 +260,7 @@ func TestForwardStatDeadProbeMarksAliveAfterFiveSuccesses(t *testing.T) {
 		if resp != nil {
 			t.Fatalf("Resolve() resp = %v, want nil on dead path", resp)
 		}
-		waitForForwardStat(t, &forward.stat, false, 0, i)
+		waitForUpstreamHealth(t, mu.upstreams[0], false, 0, i)
 	}
 
 	resp, err := forward.Resolve(newForwardTestMsg("example.com"))
@@ -188,19 +270,67 @@ func TestForwardStatDeadProbeMarksAliveAfterFiveSuccesses(t *testing.T) {
 	if resp != nil {
 		t.Fatalf("Resolve() resp = %v, want nil on dead path", resp)
 	}
-	waitForForwardStat(t, &forward.stat, true, 0, 0)
+	waitForUpstreamHealth(t, mu.upstreams[0], true, 0, 0)
+
+	if _, err := forward.Resolve(newForwardTestMsg("example.com")); err != nil {
+		t.Fatalf("Resolve() after recovery error = %v, want nil", err)
+	}
+}
+
+func TestUpstreamHealthProbeBacksOffExponentially(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	mu := newDeadMultiUpstream(testForwardErrUpstream{err: errors.New("boom")}, &now)
+	us := mu.upstreams[0]
+	probes := func() uint64 {
+		mu.wg.Wait()
+		return mu.Stats()[0].Queries
+	}
+
+	for i, wait := range []time.Duration{0, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		now = now.Add(wait - time.Millisecond)
+		if _, err := mu.Exchange(newForwardTestMsg("example.com")); err == nil {
+			t.Fatal("Exchange() error = nil on dead path, want skip error")
+		}
+		if i > 0 && probes() != uint64(i) {
+			t.Fatalf("probe %d sent %v early", i+1, time.Millisecond)
+		}
+		now = now.Add(time.Millisecond)
+		_, _ = mu.Exchange(newForwardTestMsg("example.com"))
+		if got := probes(); got != uint64(i+1) {
+			t.Fatalf("probes = %d after waiting %v, want %d", got, wait, i+1)
+		}
+	}
+	us.mu.Lock()
+	backoff := us.backoff
+	us.mu.Unlock()
+	if backoff != 16*time.Second {
+		t.Fatalf("backoff = %v after 4 failed probes, want 16s", backoff)
+	}
+
+	us.mu.Lock()
+	us.backoff = probeBackoffMax
+	us.mu.Unlock()
+	now = now.Add(probeBackoffMax)
+	_, _ = mu.Exchange(newForwardTestMsg("example.com"))
+	mu.wg.Wait()
+	us.mu.Lock()
+	backoff = us.backoff
+	us.mu.Unlock()
+	if backoff != probeBackoffMax {
+		t.Fatalf("backoff = %v, want capped at %v", backoff, probeBackoffMax)
+	}
 }
 
-func TestForwardStatDeadProbeUsesCopiedMessage(t *testing.T) {
+func TestUpstreamHealthDeadProbeUsesCopiedMessage(t *testing.T) {
 	upstream := &testForwardProbeUpstream{
 		entered:  make(chan *dns.Msg, 1),
 		release:  make(chan struct{}),
 		observed: make(chan string, 1),
 	}
+	now := time.Unix(1700000000, 0)
 	forward := &Forward{
 		Name:     "test-forward-probe-copy",
-		Upstream: upstream,
-		stat:     ForwardStat{alive: false},
+		Upstream: newDeadMultiUpstream(upstream, &now),
 	}
 	msg := newForwardTestMsg("example.com")
 
@@ -225,22 +355,127 @@ func TestForwardStatDeadProbeUsesCopiedMessage(t *testing.T) {
 	}
 }
 
-func TestForwardStatConcurrentTransitions(t *testing.T) {
-	stat := &ForwardStat{alive: true}
+func TestUpstreamHealthConcurrentTransitions(t *testing.T) {
+	mu := NewMultiUpstream([]upstream.Upstream{testForwardSuccessUpstream{}})
 
-	changedCount := runConcurrentForwardStatUpdates(stat, 10, errors.New("boom"))
+	changedCount := runConcurrentHealthUpdates(mu, 10, errors.New("boom"))
 	if changedCount != 1 {
 		t.Fatalf("failure transition count = %d, want 1", changedCount)
 	}
-	if alive, failCount, successCount := stat.snapshot(); alive || failCount != 0 || successCount != 0 {
-		t.Fatalf("after concurrent failures ForwardStat = {alive:%v failCount:%d successCount:%d}, want {alive:false failCount:0 successCount:0}", alive, failCount, successCount)
+	if alive, failCount, successCount := healthOf(mu.upstreams[0]); alive || failCount != 0 || successCount != 0 {
+		t.Fatalf("after concurrent failures health = {alive:%v failCount:%d successCount:%d}, want {alive:false failCount:0 successCount:0}", alive, failCount, successCount)
 	}
 
-	changedCount = runConcurrentForwardStatUpdates(stat, 10, nil)
+	changedCount = runConcurrentHealthUpdates(mu, 10, nil)
 	if changedCount != 1 {
 		t.Fatalf("recovery transition count = %d, want 1", changedCount)
 	}
-	if alive, failCount, successCount := stat.snapshot(); !alive || failCount != 0 || successCount != 0 {
-		t.Fatalf("after concurrent successes ForwardStat = {alive:%v failCount:%d successCount:%d}, want {alive:true failCount:0 successCount:0}", alive, failCount, successCount)
+	if alive, failCount, successCount := healthOf(mu.upstreams[0]); !alive || failCount != 0 || successCount != 0 {
+		t.Fatalf("after concurrent successes health = {alive:%v failCount:%d successCount:%d}, want {alive:true failCount:0 successCount:0}", alive, failCount, successCount)
+	}
+}
+
+// TestUpstreamHealthDeadUpstreamLeftOutOfRace verifies one dead upstream
+// neither takes its Forward down nor keeps being raced.
+func TestUpstreamHealthDeadUpstreamLeftOutOfRace(t *testing.T) {
+	bad := &countingUpstream{name: "bad", fail: true}
+	good := &countingUpstream{name: "good"}
+	mu := NewMultiUpstream([]upstream.Upstream{bad, good})
+	mu.failThreshold = 2
+	now := time.Unix(1700000000, 0)
+	mu.now = func() time.Time { return now }
+	forward := &Forward{Name: "test-forward-partial", Upstream: mu}
+
+	for i := 0; i < 10; i++ {
+		if _, err := forward.Resolve(newForwardTestMsg("example.com")); err != nil {
+			t.Fatalf("Resolve() error = %v, want the good upstream's answer", err)
+		}
+		mu.wg.Wait() // let the losing failure be counted before the next race
+	}
+	if got := bad.calls.Load(); got != 2 {
+		t.Fatalf("dead upstream asked %d times, want 2 (fail-threshold)", got)
+	}
+	if got := good.calls.Load(); got != 10 {
+		t.Fatalf("good upstream asked %d times, want 10", got)
+	}
+	if stats := mu.Stats(); stats[0].Alive || !stats[1].Alive {
+		t.Fatalf("Stats() = %+v, want bad dead and good alive", stats)
+	}
+}
+
+type testForwardAnswerUpstream struct {
+	ips []string
+}
+
+func (up testForwardAnswerUpstream) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	resp := new(dns.Msg)
+	resp.SetReply(msg)
+	for _, ip := range up.ips {
+		rr, err := dns.NewRR(msg.Question[0].Name + " 60 IN A " + ip)
+		if err != nil {
+			rr, err = dns.NewRR(msg.Question[0].Name + " 60 IN AAAA " + ip)
+		}
+		if err != nil {
+			return nil, err
+		}
+		resp.Answer = append(resp.Answer, rr)
+	}
+	return resp, nil
+}
+
+func (testForwardAnswerUpstream) Address() string {
+	return "test-forward-answer"
+}
+
+func (testForwardAnswerUpstream) Close() error {
+	return nil
+}
+
+func TestForwardRejectsAnswerByIP(t *testing.T) {
+	dual := []string{"1.0.1.0/24", "2001:250::/30"}
+	chnroute := []string{"1.0.1.0/24"} // IPv4 only, as chnroute lists usually are
+	tests := []struct {
+		name     string
+		expect   []string
+		ips      []string
+		rejected bool
+	}{
+		{name: "all expected", expect: dual, ips: []string{"1.0.1.1", "2001:250::1"}},
+		{name: "no address", expect: dual, ips: nil},
+		{name: "outside expect-ip", expect: dual, ips: []string{"1.0.1.1", "8.8.8.8"}, rejected: true},
+		{name: "AAAA outside expect-ip", expect: dual, ips: []string{"2001:db8::1"}, rejected: true},
+		{name: "AAAA with an IPv4-only list", expect: chnroute, ips: []string{"2001:db8::1"}},
+		{name: "A with an IPv4-only list", expect: chnroute, ips: []string{"2001:db8::1", "8.8.8.8"}, rejected: true},
+		{name: "inside bogus-ip", expect: dual, ips: []string{"1.0.1.7"}, rejected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expect, err := parseAnswerPrefixes(tt.expect)
+			if err != nil {
+				t.Fatalf("parseAnswerPrefixes() error = %v", err)
+			}
+			bogus, err := parseAnswerPrefixes([]string{"1.0.1.7/32"})
+			if err != nil {
+				t.Fatalf("parseAnswerPrefixes() error = %v", err)
+			}
+			forward := &Forward{
+				Name:        "test-forward-answer-ip",
+				Upstream:    testForwardAnswerUpstream{ips: tt.ips},
+				breakOnFail: true,
+				expectIP4:   newAnswerIPSet(expect, netip.Addr.Is4),
+				expectIP6:   newAnswerIPSet(expect, netip.Addr.Is6),
+				bogusIP:     newAnswerIPSet(bogus, nil),
+			}
+			resp, err := forward.Resolve(newForwardTestMsg("example.com"))
+			if tt.rejected {
+				if resp != nil || !errors.Is(err, RejectedError) {
+					t.Fatalf("Resolve() = %v, %v, want nil, RejectedError", resp, err)
+				}
+				return
+			}
+			if err != nil || len(resp.Answer) != len(tt.ips) {
+				t.Fatalf("Resolve() = %v, %v, want %d answers", resp, err, len(tt.ips))
+			}
+		})
 	}
 }
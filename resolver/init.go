@@ -2,14 +2,25 @@ package resolver
 
 import (
 	"dns-switchy/config"
+	"dns-switchy/util"
 	"errors"
 	"fmt"
 )
 
 func CreateResolvers(conf *config.SwitchyConfig) ([]DnsResolver, error) {
 	l := make([]DnsResolver, 0)
+	// One lease table per generation, shared by every `source:` with a MAC.
+	var leases *util.LeaseTable
+	if conf.LeaseFile != "" {
+		leases = util.NewLeaseTable(conf.LeaseFile)
+	}
 	for _, resolverConfig := range conf.Resolvers {
 		resolver, err := createResolver(resolverConfig)
+		if err == nil {
+			if err = applySource(resolver, resolverConfig, leases); err != nil {
+				resolver.Close()
+			}
+		}
 		if err != nil {
 			// Constructing a resolver may already have started goroutines/tickers
 			// (NewPreloader/NewFile). Close everything built so far before bailing
@@ -25,6 +36,23 @@ func CreateResolvers(conf *config.SwitchyConfig) ([]DnsResolver, error) {
 	return l, nil
 }
 
+func applySource(resolver DnsResolver, resolverConfig config.ResolverConfig, leases *util.LeaseTable) error {
+	entries := sourceOf(resolverConfig)
+	if len(entries) == 0 {
+		return nil
+	}
+	scoped, ok := resolver.(interface{ setSource(util.SourceMatcher) })
+	if !ok {
+		return fmt.Errorf("%s does not support source", resolverConfig.Type())
+	}
+	source, err := util.NewSourceSet(entries, leases)
+	if err != nil {
+		return err
+	}
+	scoped.setSource(source)
+	return nil
+}
+
 func createResolver(resolverConfig config.ResolverConfig) (DnsResolver, error) {
 	switch resolverConfig.Type() {
 	case config.FILTER:
@@ -2,6 +2,7 @@ package resolver
 
 import (
 	"dns-switchy/config"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"strings"
@@ -175,3 +176,50 @@ func TestCreateResolverUnknownTypeFails(t *testing.T) {
 		t.Fatalf("createResolver() error = %v, want substring %q", err, "definitely-unknown")
 	}
 }
+
+func TestCreateResolversAppliesSource(t *testing.T) {
+	resolvers, err := CreateResolvers(&config.SwitchyConfig{
+		Resolvers: []config.ResolverConfig{
+			&config.MockConfig{Answer: "0.0.0.0", SourceConfig: config.SourceConfig{Source: []string{"192.168.1.0/24"}}},
+			&config.PreloaderConfig{ForwardConfig: config.ForwardConfig{
+				Name:           "source-preloader",
+				TTL:            time.Minute,
+				UpstreamConfig: config.UpstreamConfig{Url: "127.0.0.1:53"},
+				SourceConfig:   config.SourceConfig{Source: []string{"10.0.0.1/32"}},
+			}},
+			&config.MockConfig{Answer: "1.1.1.1"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateResolvers() error = %v", err)
+	}
+	t.Cleanup(func() {
+		for _, r := range resolvers {
+			r.Close()
+		}
+	})
+
+	tests := []struct {
+		index  int
+		client string
+		want   bool
+	}{
+		{0, "192.168.1.9", true},
+		{0, "192.168.2.9", false},
+		{1, "10.0.0.1", true},
+		{1, "10.0.0.2", false},
+		{2, "203.0.113.1", true},
+	}
+	for _, tt := range tests {
+		sa, ok := resolvers[tt.index].(SourceAware)
+		if !ok {
+			t.Fatalf("resolvers[%d] type %T is not SourceAware", tt.index, resolvers[tt.index])
+		}
+		if got := sa.AcceptSource(netip.MustParseAddr(tt.client)); got != tt.want {
+			t.Errorf("resolvers[%d].AcceptSource(%s) = %v, want %v", tt.index, tt.client, got, tt.want)
+		}
+	}
+	if !resolvers[0].(SourceAware).SourceScoped() || resolvers[2].(SourceAware).SourceScoped() {
+		t.Fatal("SourceScoped() must be true only for resolvers with a source list")
+	}
+}
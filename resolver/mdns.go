@@ -22,6 +22,7 @@ import (
 // .local 在此终局应答:命中回 A,非 A 类型回 NODATA,miss 回 NXDOMAIN(负缓存),
 // 运行期 socket 故障回 BreakError——永不落到链条下游,这是定义性质,不可配置。
 type Mdns struct {
+	sourceFilter
 	util.DomainMatcher
 	conn        mdnsConn
 	group       *net.UDPAddr
@@ -159,7 +160,7 @@ func (m *Mdns) Resolve(msg *dns.Msg) (*dns.Msg, error) {
 		res.SetReply(msg)
 		return res, nil
 	}
-	if cached := m.negCache.Get(question); !reflect.DeepEqual(cached, util.None) {
+	if cached := m.negCache.Get(util.QuestionKey(question)); !reflect.DeepEqual(cached, util.None) {
 		return nxdomain(msg), nil
 	}
 	if m.dead.Load() {
@@ -196,7 +197,7 @@ func (m *Mdns) Resolve(msg *dns.Msg) (*dns.Msg, error) {
 			if m.dead.Load() {
 				return nil, fmt.Errorf("mdns reader closed: %w", BreakError)
 			}
-			m.negCache.Set(question, negMarker, m.negativeTTL)
+			m.negCache.Set(util.QuestionKey(question), negMarker, m.negativeTTL)
 			return nxdomain(msg), nil
 		}
 	}
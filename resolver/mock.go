@@ -11,6 +11,7 @@ import (
 
 type Mock struct {
 	NoCache
+	sourceFilter
 	util.DomainMatcher
 	util.QueryTypeMatcher
 	Answer string
@@ -6,6 +6,8 @@ import (
 	"testing"
 	"time"
 
+	"dns-switchy/config"
+
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/miekg/dns"
 )
@@ -138,3 +140,127 @@ func TestMultiUpstreamSingleUpstreamSynchronous(t *testing.T) {
 		t.Fatalf("Close() error = %v, want nil", err)
 	}
 }
+
+// countingUpstream answers (or fails) and counts how often it was asked.
+type countingUpstream struct {
+	name  string
+	fail  bool
+	calls atomic.Int32
+}
+
+func (c *countingUpstream) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	c.calls.Add(1)
+	if c.fail {
+		return nil, errors.New(c.name + " failed")
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(msg)
+	return resp, nil
+}
+func (c *countingUpstream) Address() string { return c.name }
+func (c *countingUpstream) Close() error    { return nil }
+
+func TestMultiUpstreamStrategies(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		weights  []int
+		picks    []int // what intn returns, in turn
+		fail     []bool
+		seed     []time.Duration // RTT recorded before the queries, 0 = none
+		queries  int
+		want     []int32 // calls per upstream
+	}{
+		{name: "race asks all", strategy: config.StrategyRace, queries: 2, want: []int32{2, 2, 2}},
+		{name: "sequential stops at first success", strategy: config.StrategySequential, fail: []bool{true, false, false}, queries: 2, want: []int32{2, 2, 0}},
+		{name: "round-robin rotates", strategy: config.StrategyRoundRobin, queries: 4, want: []int32{2, 1, 1}},
+		{name: "round-robin falls back", strategy: config.StrategyRoundRobin, fail: []bool{false, true, false}, queries: 3, want: []int32{1, 1, 2}},
+		{name: "weighted-random by weight", strategy: config.StrategyWeighted, weights: []int{1, 3, 0}, picks: []int{0, 1, 3, 4}, queries: 4, want: []int32{1, 2, 1}},
+		{name: "lowest-latency measures first", strategy: config.StrategyLowestLatency, seed: []time.Duration{20 * time.Millisecond, 5 * time.Millisecond, 0}, queries: 1, want: []int32{0, 0, 1}},
+		{name: "lowest-latency prefers fastest", strategy: config.StrategyLowestLatency, seed: []time.Duration{20 * time.Millisecond, 5 * time.Millisecond, 50 * time.Millisecond}, queries: 3, want: []int32{0, 3, 0}},
+		{name: "lowest-latency moves off failing", strategy: config.StrategyLowestLatency, fail: []bool{false, true, false}, seed: []time.Duration{20 * time.Millisecond, 5 * time.Millisecond, 50 * time.Millisecond}, queries: 3, want: []int32{3, 1, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ups := make([]*countingUpstream, len(tt.want))
+			upstreams := make([]upstream.Upstream, len(tt.want))
+			for i := range ups {
+				ups[i] = &countingUpstream{name: string(rune('a' + i))}
+				if tt.fail != nil {
+					ups[i].fail = tt.fail[i]
+				}
+				upstreams[i] = ups[i]
+			}
+			mu := newMultiUpstream(upstreams, tt.weights, tt.strategy)
+			picks := tt.picks
+			mu.intn = func(n int) int {
+				pick := picks[0]
+				picks = picks[1:]
+				return pick
+			}
+			for i, rtt := range tt.seed {
+				if rtt > 0 {
+					mu.upstreams[i].record(rtt, nil)
+				}
+			}
+			for range tt.queries {
+				if _, err := mu.Exchange(newMultiUpstreamTestMsg()); err != nil {
+					t.Fatalf("Exchange() error = %v", err)
+				}
+			}
+			_ = mu.Close() // waits for race losers
+			for i, up := range ups {
+				if got := up.calls.Load(); got != tt.want[i] {
+					t.Fatalf("upstream %s calls = %d, want %d (all: %v)", up.name, got, tt.want[i], mu.Stats())
+				}
+			}
+		})
+	}
+}
+
+func TestMultiUpstreamTracksRTTAndFailures(t *testing.T) {
+	bad := &countingUpstream{name: "bad", fail: true}
+	mu := newMultiUpstream([]upstream.Upstream{bad, &countingUpstream{name: "good"}}, nil, config.StrategySequential)
+	if _, err := mu.Exchange(newMultiUpstreamTestMsg()); err != nil {
+		t.Fatalf("Exchange() error = %v, want the second upstream's answer", err)
+	}
+	stats := mu.Stats()
+	if stats[0].Queries != 1 || stats[0].Failures != 1 || stats[0].SRTT < failureRTT {
+		t.Fatalf("failing upstream stats = %+v, want 1 query, 1 failure, srtt >= %v", stats[0], failureRTT)
+	}
+	if stats[1].Queries != 1 || stats[1].Failures != 0 || stats[1].SRTT >= failureRTT {
+		t.Fatalf("good upstream stats = %+v, want 1 query, no failure", stats[1])
+	}
+
+	us := &upstreamState{}
+	for _, rtt := range []time.Duration{80 * time.Millisecond, 0, 0} {
+		us.record(rtt, nil)
+	}
+	if want := 80 * time.Millisecond * 49 / 64; us.srtt != want {
+		t.Fatalf("srtt = %v, want %v", us.srtt, want)
+	}
+
+	mu.upstreams[1].Upstream.(*countingUpstream).fail = true
+	if _, err := mu.Exchange(newMultiUpstreamTestMsg()); err == nil {
+		t.Fatal("Exchange() error = nil, want all upstreams fail")
+	}
+}
+
+func TestUpstreamStatsPercentiles(t *testing.T) {
+	us := &upstreamState{Upstream: fastUpstream{}, alive: true}
+	if stats := us.stats(); stats.P50 != 0 || stats.P99 != 0 {
+		t.Fatalf("stats before any exchange = %+v, want zero percentiles", stats)
+	}
+	// 200 samples 1ms..200ms: the window keeps the last rttWindow (73..200ms).
+	for i := 1; i <= 200; i++ {
+		us.record(time.Duration(i)*time.Millisecond, nil)
+	}
+	us.record(time.Millisecond, errors.New("timeout")) // failures stay out of the percentiles
+	stats := us.stats()
+	if stats.P50 != 136*time.Millisecond || stats.P90 != 188*time.Millisecond || stats.P99 != 199*time.Millisecond {
+		t.Fatalf("p50/p90/p99 = %v/%v/%v, want 136ms/188ms/199ms", stats.P50, stats.P90, stats.P99)
+	}
+	if stats.Queries != 201 || stats.Failures != 1 || !stats.Alive {
+		t.Fatalf("stats = %+v, want 201 queries, 1 failure, alive", stats)
+	}
+}
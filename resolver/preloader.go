@@ -1,6 +1,7 @@
 package resolver
 
 import (
+	"container/list"
 	"dns-switchy/config"
 	"fmt"
 	"github.com/miekg/dns"
@@ -9,15 +10,47 @@ import (
 	"time"
 )
 
+const (
+	// defaultPreloadEntries 足够覆盖一个公司域的常用名字，又不至于每个周期刷出几万个查询。
+	defaultPreloadEntries = 1000
+	// defaultPreloadIdle 让只在工作日用到的名字熬过一个周末前先被清掉。
+	defaultPreloadIdle = 24 * time.Hour
+)
+
 type Preloader struct {
 	*Forward
-	dnsCache  sync.Map
+	maxEntries  int           // 0 = 不限
+	idleTimeout time.Duration // 0 = 不淘汰
+	now         func() time.Time
+
+	mu        sync.Mutex
+	dnsCache  map[dns.Question]*list.Element // of *preloadEntry
+	lru       list.List                      // front = most recently accessed
+	stats     PreloaderStats
 	ticker    *time.Ticker
 	stop      chan struct{}
 	done      chan struct{}
 	closeOnce sync.Once
 }
 
+type preloadEntry struct {
+	q          dns.Question
+	expiredAt  time.Time
+	item       *dns.Msg
+	lastAccess time.Time // last client query; refreshes do not count
+}
+
+// PreloaderStats counts what the preloader's working set and refresh loop did
+// since it was created.
+type PreloaderStats struct {
+	Entries       int    `json:"entries"`
+	MaxEntries    int    `json:"maxEntries"` // 0 = unbounded
+	Refreshed     uint64 `json:"refreshed"`
+	RefreshFailed uint64 `json:"refreshFailed"`
+	Evicted       uint64 `json:"evicted"` // dropped to stay within maxEntries
+	Idle          uint64 `json:"idle"`    // dropped after idleTimeout without a client query
+}
+
 func (pl *Preloader) TTL() time.Duration {
 	return -1
 }
@@ -31,6 +64,14 @@ func (pl *Preloader) NftSetSpec() (set4 string, ttl time.Duration) {
 	return pl.Forward.NftSetSpec()
 }
 
+// UpstreamStats 同 NftSetSpec，显式委托并防御 nil Forward。
+func (pl *Preloader) UpstreamStats() []UpstreamStats {
+	if pl.Forward == nil {
+		return nil
+	}
+	return pl.Forward.UpstreamStats()
+}
+
 func (pl *Preloader) Close() {
 	pl.closeOnce.Do(func() {
 		if pl.ticker != nil {
@@ -56,62 +97,161 @@ func (pl *Preloader) Work() {
 			log.Printf("preloader %s exit", pl)
 			return
 		case <-pl.ticker.C:
-			pl.dnsCache.Range(func(key, value interface{}) bool {
-				v := value.(TimeItem)
-				if v.ExpiredAt.After(time.Now()) {
-					return true
-				}
-				newMsg := new(dns.Msg)
-				oldQ := key.(dns.Question)
-				newMsg.Question = append(newMsg.Question, oldQ)
-				newMsg.Id = dns.Id()
-				newMsg.RecursionDesired = true
-				_, _ = pl.PreLoad(newMsg)
-				return true
-			})
+			pl.refresh()
+		}
+	}
+}
+
+// refresh drops the entries no client asked for within idleTimeout and
+// re-resolves the expired rest. Upstream is asked outside the lock so client
+// queries are not held up by a slow refresh.
+func (pl *Preloader) refresh() {
+	due := pl.sweep()
+	failed := 0
+	for _, q := range due {
+		newMsg := new(dns.Msg)
+		newMsg.Question = append(newMsg.Question, q)
+		newMsg.Id = dns.Id()
+		newMsg.RecursionDesired = true
+		if _, err := pl.load(newMsg, false); err != nil {
+			failed++
 		}
 	}
+	pl.mu.Lock()
+	pl.stats.Refreshed += uint64(len(due) - failed)
+	pl.stats.RefreshFailed += uint64(failed)
+	pl.mu.Unlock()
+	if failed > 0 {
+		log.Printf("preloader %s: %d of %d refreshes failed", pl, failed, len(due))
+	}
 }
 
-type TimeItem struct {
-	ExpiredAt time.Time
-	Item      *dns.Msg
+// sweep evicts idle entries and returns the questions due for a refresh.
+func (pl *Preloader) sweep() []dns.Question {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	now := pl.now()
+	var due []dns.Question
+	// Idle entries sit at the back of the LRU list.
+	for elem := pl.lru.Back(); elem != nil && pl.idleTimeout > 0; elem = pl.lru.Back() {
+		if now.Sub(elem.Value.(*preloadEntry).lastAccess) < pl.idleTimeout {
+			break
+		}
+		pl.remove(elem)
+		pl.stats.Idle++
+	}
+	for q, elem := range pl.dnsCache {
+		if !elem.Value.(*preloadEntry).expiredAt.After(now) {
+			due = append(due, q)
+		}
+	}
+	return due
 }
 
 func (pl *Preloader) PreLoad(msg *dns.Msg) (*dns.Msg, error) {
+	return pl.load(msg, true)
+}
+
+// load resolves msg and stores a non-empty answer. A client query (access)
+// marks the entry as used; a refresh keeps its last access so an entry
+// nobody asks for still goes idle. A refresh of an entry evicted meanwhile is
+// not stored again.
+func (pl *Preloader) load(msg *dns.Msg, access bool) (*dns.Msg, error) {
 	resolve, err := pl.Forward.Resolve(msg)
-	if err == nil && len(resolve.Answer) > 0 {
-		pl.dnsCache.Store(
-			msg.Question[0],
-			TimeItem{time.Now().Add(pl.ttl), resolve.Copy()},
-		)
+	if err != nil || len(resolve.Answer) == 0 {
+		return resolve, err
 	}
-	return resolve, err
+	q := msg.Question[0]
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	now := pl.now()
+	elem, ok := pl.dnsCache[q]
+	switch {
+	case ok:
+		entry := elem.Value.(*preloadEntry)
+		entry.expiredAt, entry.item = now.Add(pl.ttl), resolve.Copy()
+		if access {
+			entry.lastAccess = now
+			pl.lru.MoveToFront(elem)
+		}
+	case access:
+		pl.evictFor(1)
+		pl.dnsCache[q] = pl.lru.PushFront(&preloadEntry{q: q, expiredAt: now.Add(pl.ttl), item: resolve.Copy(), lastAccess: now})
+	}
+	return resolve, nil
+}
+
+// evictFor drops the least recently accessed entries until n more fit.
+func (pl *Preloader) evictFor(n int) {
+	if pl.maxEntries <= 0 {
+		return
+	}
+	for pl.lru.Len()+n > pl.maxEntries && pl.lru.Len() > 0 {
+		pl.remove(pl.lru.Back())
+		pl.stats.Evicted++
+	}
+}
+
+func (pl *Preloader) remove(elem *list.Element) {
+	delete(pl.dnsCache, pl.lru.Remove(elem).(*preloadEntry).q)
 }
 
 func (pl *Preloader) Resolve(msg *dns.Msg) (*dns.Msg, error) {
-	if cached, exist := pl.dnsCache.Load(msg.Question[0]); exist {
-		return cached.(TimeItem).Item.Copy(), nil
-	} else {
-		return pl.PreLoad(msg)
+	pl.mu.Lock()
+	if elem, exist := pl.dnsCache[msg.Question[0]]; exist {
+		entry := elem.Value.(*preloadEntry)
+		entry.lastAccess = pl.now()
+		pl.lru.MoveToFront(elem)
+		item := entry.item.Copy()
+		pl.mu.Unlock()
+		return item, nil
 	}
+	pl.mu.Unlock()
+	return pl.load(msg, true)
+}
+
+func (pl *Preloader) Stats() PreloaderStats {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	stats := pl.stats
+	stats.Entries = pl.lru.Len()
+	stats.MaxEntries = pl.maxEntries
+	return stats
 }
 
 func NewPreloader(pc *config.PreloaderConfig) (*Preloader, error) {
 	if pc.TTL <= 0 {
 		return nil, fmt.Errorf("invalid preloader ttl: %s", pc.TTL)
 	}
+	maxEntries, idleTimeout := pc.MaxEntries, pc.IdleTimeout
+	switch {
+	case maxEntries == 0:
+		maxEntries = defaultPreloadEntries
+	case maxEntries == -1:
+		maxEntries = 0
+	case maxEntries < 0:
+		return nil, fmt.Errorf("invalid preloader max-entries: %d", pc.MaxEntries)
+	}
+	switch {
+	case idleTimeout == 0:
+		idleTimeout = defaultPreloadIdle
+	case idleTimeout < 0:
+		idleTimeout = 0
+	}
 	forward, err := NewForward(&pc.ForwardConfig)
 	if err != nil {
 		log.Println("init preloader fail")
 		return nil, err
 	}
 	p := &Preloader{
-		Forward:  forward,
-		dnsCache: sync.Map{},
-		ticker:   time.NewTicker(pc.TTL),
-		stop:     make(chan struct{}),
-		done:     make(chan struct{}),
+		Forward:     forward,
+		maxEntries:  maxEntries,
+		idleTimeout: idleTimeout,
+		now:         time.Now,
+		dnsCache:    make(map[dns.Question]*list.Element),
+		ticker:      time.NewTicker(pc.TTL),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
 	}
 	go p.Work()
 	return p, nil
@@ -1,8 +1,10 @@
 package resolver
 
 import (
+	"container/list"
+	"errors"
 	"net"
-	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -61,7 +63,8 @@ func newPreloaderForCloseTest() *Preloader {
 			Name:     "test-preloader",
 			Upstream: testUpstream{},
 		},
-		dnsCache: sync.Map{},
+		now:      time.Now,
+		dnsCache: make(map[dns.Question]*list.Element),
 		ticker:   time.NewTicker(time.Hour),
 		stop:     make(chan struct{}),
 		done:     make(chan struct{}),
@@ -120,9 +123,9 @@ func TestPreloaderCacheHitReturnsIsolatedCopies(t *testing.T) {
 			Name:     "test-preloader-cache",
 			Upstream: testPreloaderCacheUpstream{},
 			ttl:      time.Hour,
-			stat:     ForwardStat{alive: true},
 		},
-		dnsCache: sync.Map{},
+		now:      time.Now,
+		dnsCache: make(map[dns.Question]*list.Element),
 	}
 
 	msg := new(dns.Msg)
@@ -199,3 +202,107 @@ func TestNewPreloaderRejectsInvalidTTL(t *testing.T) {
 		})
 	}
 }
+
+type testPreloaderFlakyUpstream struct {
+	testPreloaderCacheUpstream
+	fail *atomic.Bool
+}
+
+func (up testPreloaderFlakyUpstream) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	if up.fail.Load() {
+		return nil, errors.New("upstream timeout")
+	}
+	return up.testPreloaderCacheUpstream.Exchange(msg)
+}
+
+func TestPreloaderBoundsWorkingSet(t *testing.T) {
+	var fail atomic.Bool
+	now := time.Unix(1700000000, 0)
+	preloader := &Preloader{
+		Forward: &Forward{
+			Name:     "test-preloader-bounded",
+			Upstream: testPreloaderFlakyUpstream{fail: &fail},
+			ttl:      time.Minute,
+		},
+		maxEntries:  2,
+		idleTimeout: time.Hour,
+		now:         func() time.Time { return now },
+		dnsCache:    make(map[dns.Question]*list.Element),
+	}
+	ask := func(name string) {
+		t.Helper()
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		if _, err := preloader.Resolve(msg); err != nil {
+			t.Fatalf("Resolve(%s) error = %v", name, err)
+		}
+	}
+	cached := func(name string) bool {
+		preloader.mu.Lock()
+		defer preloader.mu.Unlock()
+		_, ok := preloader.dnsCache[dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}]
+		return ok
+	}
+
+	ask("a.example.")
+	now = now.Add(time.Second)
+	ask("b.example.")
+	now = now.Add(time.Second)
+	ask("a.example.") // b is now the least recently asked
+	ask("c.example.")
+	if !cached("a.example.") || cached("b.example.") || !cached("c.example.") {
+		t.Fatal("over capacity the least recently asked name was not evicted")
+	}
+
+	// Refreshes keep the answers current but do not count as use.
+	now = now.Add(2 * time.Minute)
+	preloader.refresh()
+	now = now.Add(30 * time.Minute)
+	ask("c.example.")
+	now = now.Add(31 * time.Minute)
+	fail.Store(true)
+	preloader.refresh()
+	if cached("a.example.") || !cached("c.example.") {
+		t.Fatal("idle entry a was not evicted, or recently asked c was")
+	}
+
+	stats := preloader.Stats()
+	want := PreloaderStats{Entries: 1, MaxEntries: 2, Refreshed: 2, RefreshFailed: 1, Evicted: 1, Idle: 1}
+	if stats != want {
+		t.Fatalf("Stats() = %+v, want %+v", stats, want)
+	}
+}
+
+func TestNewPreloaderWorkingSetDefaults(t *testing.T) {
+	for _, tt := range []struct {
+		maxEntries, wantEntries int
+		idle, wantIdle          time.Duration
+	}{
+		{0, defaultPreloadEntries, 0, defaultPreloadIdle},
+		{-1, 0, -time.Second, 0},
+		{50, 50, time.Hour, time.Hour},
+	} {
+		preloader, err := NewPreloader(&config.PreloaderConfig{
+			ForwardConfig: config.ForwardConfig{
+				Name:           "test-preloader-defaults",
+				TTL:            time.Minute,
+				UpstreamConfig: config.UpstreamConfig{Url: "127.0.0.1:53"},
+			},
+			MaxEntries:  tt.maxEntries,
+			IdleTimeout: tt.idle,
+		})
+		if err != nil {
+			t.Fatalf("NewPreloader() error = %v", err)
+		}
+		preloader.Close()
+		if preloader.maxEntries != tt.wantEntries || preloader.idleTimeout != tt.wantIdle {
+			t.Fatalf("max-entries %d idle-timeout %s = %d, %s; want %d, %s", tt.maxEntries, tt.idle, preloader.maxEntries, preloader.idleTimeout, tt.wantEntries, tt.wantIdle)
+		}
+	}
+	if _, err := NewPreloader(&config.PreloaderConfig{
+		ForwardConfig: config.ForwardConfig{TTL: time.Minute, UpstreamConfig: config.UpstreamConfig{Url: "127.0.0.1:53"}},
+		MaxEntries:    -2,
+	}); err == nil {
+		t.Fatal("NewPreloader(max-entries -2) error = nil, want invalid max-entries")
+	}
+}
@@ -0,0 +1,79 @@
+package resolver
+
+import (
+	"dns-switchy/config"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startProbe sends a probe query of its own to the upstreams every interval,
+// so a dead upstream is noticed before a client query hits it and a recovered
+// one without giving up client queries. Alive upstreams are probed every
+// tick; dead ones when their backoff allows.
+func (mu *MultiUpstream) startProbe(pc *config.ProbeConfig) error {
+	name, qtype := pc.Name, pc.Type
+	if name == "" {
+		name = "."
+	}
+	if qtype == "" {
+		qtype = "NS"
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return fmt.Errorf("invalid probe name %q", pc.Name)
+	}
+	qtypeValue, ok := dns.StringToType[strings.ToUpper(qtype)]
+	if !ok {
+		return fmt.Errorf("invalid probe type %q", pc.Type)
+	}
+	mu.probe = &dns.Question{Name: dns.Fqdn(name), Qtype: qtypeValue, Qclass: dns.ClassINET}
+	mu.probeStop = make(chan struct{})
+	mu.probeDone = make(chan struct{})
+	go mu.probeLoop(pc.Interval)
+	return nil
+}
+
+func (mu *MultiUpstream) probeLoop(interval time.Duration) {
+	defer close(mu.probeDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-mu.probeStop:
+			return
+		case <-ticker.C:
+			mu.probeAll()
+		}
+	}
+}
+
+// probeAll probes every due upstream concurrently and returns when all
+// answered, so a slow upstream never has two probes in flight.
+func (mu *MultiUpstream) probeAll() {
+	now := mu.now()
+	var wg sync.WaitGroup
+	for _, us := range mu.upstreams {
+		us.mu.Lock()
+		due := us.alive || (!us.probing && !now.Before(us.probeAt))
+		if due && !us.alive {
+			us.probing = true
+		}
+		us.mu.Unlock()
+		if !due {
+			continue
+		}
+		msg := new(dns.Msg)
+		msg.Id = dns.Id()
+		msg.RecursionDesired = true
+		msg.Question = []dns.Question{*mu.probe}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = mu.exchange(us, msg)
+		}()
+	}
+	wg.Wait()
+}
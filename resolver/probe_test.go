@@ -0,0 +1,153 @@
+package resolver
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"dns-switchy/config"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// testProbeUpstream records the questions it was asked and fails on demand.
+type testProbeUpstream struct {
+	mu    sync.Mutex
+	fail  bool
+	asked []dns.Question
+}
+
+func (up *testProbeUpstream) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	up.asked = append(up.asked, msg.Question[0])
+	if up.fail {
+		return nil, errors.New("probe upstream down")
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(msg)
+	return resp, nil
+}
+
+func (up *testProbeUpstream) Address() string { return "test-probe" }
+func (up *testProbeUpstream) Close() error    { return nil }
+
+func (up *testProbeUpstream) setFail(fail bool) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	up.fail = fail
+}
+
+func (up *testProbeUpstream) questions() []dns.Question {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return append([]dns.Question(nil), up.asked...)
+}
+
+func TestMultiUpstreamActiveProbeTracksHealth(t *testing.T) {
+	up := &testProbeUpstream{fail: true}
+	mu := NewMultiUpstream([]upstream.Upstream{up})
+	mu.failThreshold, mu.recoverThreshold = 2, 2
+	now := time.Unix(1700000000, 0)
+	mu.now = func() time.Time { return now }
+	mu.probe = &dns.Question{Name: "probe.example.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}
+
+	// Dies on probes alone, before any client query.
+	mu.probeAll()
+	mu.probeAll()
+	if alive, _, _ := healthOf(mu.upstreams[0]); alive {
+		t.Fatal("alive = true after 2 failed probes, want false")
+	}
+	for _, q := range up.questions() {
+		if q.Name != "probe.example." || q.Qtype != dns.TypeAAAA {
+			t.Fatalf("probe question = %v, want probe.example. AAAA", q)
+		}
+	}
+
+	// A client query to a dead upstream is not copied into a probe.
+	now = now.Add(time.Hour)
+	if _, err := mu.Exchange(newForwardTestMsg("example.com")); !errors.Is(err, errUpstreamsDown) {
+		t.Fatalf("Exchange() error = %v, want %v", err, errUpstreamsDown)
+	}
+	mu.wg.Wait()
+	if n := len(up.questions()); n != 2 {
+		t.Fatalf("upstream asked %d times, want 2 (probes only)", n)
+	}
+
+	// Backoff still applies to a dead upstream, then it recovers on probes.
+	up.setFail(false)
+	mu.probeAll()
+	if n := len(up.questions()); n != 3 {
+		t.Fatalf("upstream asked %d times, want 3 (one due probe)", n)
+	}
+	mu.probeAll()
+	if alive, _, _ := healthOf(mu.upstreams[0]); !alive {
+		t.Fatal("alive = false after 2 successful probes, want true")
+	}
+	if _, err := mu.Exchange(newForwardTestMsg("example.com")); err != nil {
+		t.Fatalf("Exchange() after recovery error = %v", err)
+	}
+}
+
+func TestNewForwardProbe(t *testing.T) {
+	conf := func(probe *config.ProbeConfig) *config.ForwardConfig {
+		return &config.ForwardConfig{
+			Name:           "probe-forward",
+			UpstreamConfig: config.UpstreamConfig{Url: "127.0.0.1:53"},
+			Probe:          probe,
+		}
+	}
+	for _, probe := range []*config.ProbeConfig{
+		{Interval: time.Minute, Type: "BOGUS"},
+		{Interval: time.Minute, Name: "bad..name"},
+	} {
+		if _, err := NewForward(conf(probe)); err == nil {
+			t.Fatalf("NewForward(probe %+v) error = nil, want invalid probe", probe)
+		}
+	}
+
+	forward, err := NewForward(conf(&config.ProbeConfig{Interval: time.Minute}))
+	if err != nil {
+		t.Fatalf("NewForward() error = %v", err)
+	}
+	mu := forward.Upstream.(*MultiUpstream)
+	if want := (dns.Question{Name: ".", Qtype: dns.TypeNS, Qclass: dns.ClassINET}); *mu.probe != want {
+		t.Fatalf("probe = %v, want %v", *mu.probe, want)
+	}
+	closed := make(chan struct{})
+	go func() {
+		forward.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close() did not stop the probe loop")
+	}
+}
+
+func TestMultiUpstreamProbeLoop(t *testing.T) {
+	up := &testProbeUpstream{}
+	mu := NewMultiUpstream([]upstream.Upstream{up})
+	if err := mu.startProbe(&config.ProbeConfig{Interval: time.Millisecond, Name: "example.org", Type: "a"}); err != nil {
+		t.Fatalf("startProbe() error = %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(up.questions()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("probe loop sent fewer than 2 probes")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	_ = mu.Close()
+	sent := len(up.questions())
+	time.Sleep(10 * time.Millisecond)
+	if got := len(up.questions()); got != sent {
+		t.Fatalf("probes after Close = %d, want none", got-sent)
+	}
+	if q := up.questions()[0]; q.Name != "example.org." || q.Qtype != dns.TypeA {
+		t.Fatalf("probe question = %v, want example.org. A", q)
+	}
+}
@@ -0,0 +1,53 @@
+package resolver
+
+import (
+	"dns-switchy/config"
+	"dns-switchy/util"
+	"net/netip"
+)
+
+// SourceAware is implemented by every resolver type. The server asks it before
+// Accept, with the querying client's address: a resolver configured with
+// `source:` only takes queries from those clients. SourceScoped reports
+// whether such a list is configured, i.e. whether the answer may differ per
+// client and so must stay out of the shared cache.
+type SourceAware interface {
+	AcceptSource(client netip.Addr) bool
+	SourceScoped() bool
+}
+
+// sourceFilter is embedded by the resolver types; the zero value accepts every
+// client.
+type sourceFilter struct {
+	source util.SourceMatcher
+}
+
+func (f *sourceFilter) AcceptSource(client netip.Addr) bool {
+	return f.source == nil || f.source.MatchSource(client)
+}
+
+func (f *sourceFilter) SourceScoped() bool {
+	return f.source != nil
+}
+
+func (f *sourceFilter) setSource(source util.SourceMatcher) {
+	f.source = source
+}
+
+func sourceOf(resolverConfig config.ResolverConfig) []string {
+	switch c := resolverConfig.(type) {
+	case *config.FilterConfig:
+		return c.Source
+	case *config.FileConfig:
+		return c.Source
+	case *config.ForwardConfig:
+		return c.Source
+	case *config.PreloaderConfig:
+		return c.Source
+	case *config.MockConfig:
+		return c.Source
+	case *config.MdnsConfig:
+		return c.Source
+	}
+	return nil
+}
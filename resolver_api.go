@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"dns-switchy/resolver"
+	"dns-switchy/util"
+)
+
+// resolverCounters counts the queries one resolver of a generation accepted
+// and how they ended. Refreshes (serve-stale, prefetch) and /api/query go
+// through the chain too and are counted alike.
+type resolverCounters struct {
+	accepted atomic.Uint64
+	answered atomic.Uint64
+	failed   atomic.Uint64
+}
+
+func newResolverGen(resolvers []resolver.DnsResolver) *resolverGen {
+	return &resolverGen{resolvers: resolvers, counters: make([]resolverCounters, len(resolvers))}
+}
+
+// counter returns the counters of resolvers[i]. A generation built without
+// counters (tests) counts into a throwaway.
+func (g *resolverGen) counter(i int) *resolverCounters {
+	if i < len(g.counters) {
+		return &g.counters[i]
+	}
+	return &resolverCounters{}
+}
+
+type upstreamView struct {
+	Address      string  `json:"address"`
+	Alive        bool    `json:"alive"`
+	FailCount    int     `json:"failCount"`    // consecutive failures while alive
+	SuccessCount int     `json:"successCount"` // consecutive successful probes while dead
+	Queries      uint64  `json:"queries"`
+	Failures     uint64  `json:"failures"`
+	SRTT         float64 `json:"srttMs"`
+	P50          float64 `json:"p50Ms"`
+	P90          float64 `json:"p90Ms"`
+	P99          float64 `json:"p99Ms"`
+}
+
+type resolverView struct {
+	Name      string                   `json:"name"`
+	Type      string                   `json:"type,omitempty"`
+	Alive     bool                     `json:"alive"` // false once every upstream is dead
+	Accepted  uint64                   `json:"accepted"`
+	Answered  uint64                   `json:"answered"`
+	Failed    uint64                   `json:"failed"`
+	CacheHits uint64                   `json:"cacheHits"`
+	Upstreams []upstreamView           `json:"upstreams,omitempty"`
+	Preloader *resolver.PreloaderStats `json:"preloader,omitempty"`
+}
+
+type resolversResponse struct {
+	Resolvers []resolverView `json:"resolvers"`
+}
+
+// apiResolversHandler serves GET /api/resolvers: the active chain in order,
+// with each resolver's query counters, the cache hits on its answers and, for
+// resolvers with upstreams, their health and latency. Counters start over on
+// every reload; cache hits are attributed by resolver name and count since
+// start.
+func (s *DnsSwitchyServer) apiResolversHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var hits map[string]uint64
+	if owned, ok := s.dnsCache.(util.OwnedCache); ok {
+		hits = owned.OwnerHits()
+	}
+	gen := s.acquireGen()
+	defer s.releaseGen(gen)
+	views := make([]resolverView, 0)
+	if gen != nil {
+		for i, res := range gen.resolvers {
+			counters := gen.counter(i)
+			view := resolverView{
+				Name:      resolverName(res),
+				Type:      string(resolver.TypeOf(res)),
+				Alive:     true,
+				Accepted:  counters.accepted.Load(),
+				Answered:  counters.answered.Load(),
+				Failed:    counters.failed.Load(),
+				CacheHits: hits[resolverName(res)],
+			}
+			if ua, ok := res.(resolver.UpstreamAware); ok {
+				view.Upstreams, view.Alive = upstreamViews(ua.UpstreamStats())
+			}
+			if pl, ok := res.(*resolver.Preloader); ok {
+				stats := pl.Stats()
+				view.Preloader = &stats
+			}
+			views = append(views, view)
+		}
+	}
+	writeJSON(w, http.StatusOK, resolversResponse{Resolvers: views})
+}
+
+// upstreamViews renders upstream stats; alive is true while any upstream is.
+func upstreamViews(stats []resolver.UpstreamStats) (views []upstreamView, alive bool) {
+	views = make([]upstreamView, len(stats))
+	alive = len(stats) == 0
+	for i, st := range stats {
+		views[i] = upstreamView{
+			Address:      st.Address,
+			Alive:        st.Alive,
+			FailCount:    st.FailCount,
+			SuccessCount: st.SuccessCount,
+			Queries:      st.Queries,
+			Failures:     st.Failures,
+			SRTT:         millis(st.SRTT),
+			P50:          millis(st.P50),
+			P90:          millis(st.P90),
+			P99:          millis(st.P99),
+		}
+		alive = alive || st.Alive
+	}
+	return views, alive
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"dns-switchy/resolver"
+	"dns-switchy/util"
+
+	"github.com/miekg/dns"
+)
+
+// upstreamResolver is a namedResolver reporting fixed upstream stats.
+type upstreamResolver struct {
+	namedResolver
+	stats []resolver.UpstreamStats
+}
+
+func (r *upstreamResolver) UpstreamStats() []resolver.UpstreamStats {
+	return r.stats
+}
+
+func TestAPIResolvers(t *testing.T) {
+	failing := &upstreamResolver{
+		namedResolver: namedResolver{name: "broken", testResolver: testResolver{
+			acceptFn:  func(msg *dns.Msg) bool { return msg.Question[0].Name == "broken.example." },
+			resolveFn: func(*dns.Msg) (*dns.Msg, error) { return nil, errors.New("upstream down") },
+		}},
+		stats: []resolver.UpstreamStats{{Address: "192.0.2.53", FailCount: 3, Queries: 3, Failures: 3}},
+	}
+	direct := &upstreamResolver{
+		namedResolver: namedResolver{name: "direct", testResolver: testResolver{
+			acceptFn:  func(*dns.Msg) bool { return true },
+			resolveFn: func(msg *dns.Msg) (*dns.Msg, error) { return makeAResponse(msg, "192.0.2.1"), nil },
+			ttl:       time.Minute,
+		}},
+		stats: []resolver.UpstreamStats{
+			{Address: "192.0.2.10"},
+			{Address: "192.0.2.11", Alive: true, Queries: 4, SRTT: 1500 * time.Microsecond, P50: time.Millisecond, P90: 2 * time.Millisecond, P99: 3 * time.Millisecond},
+		},
+	}
+	server := newServerForTest([]resolver.DnsResolver{failing, direct})
+	server.dnsCache = util.NewDnsCache(time.Minute)
+	server.apiKey = "secret"
+	// broken fails and falls through to direct; example.com is asked twice,
+	// the second time from the cache.
+	for _, name := range []string{"broken.example.", "example.com.", "example.com."} {
+		msg := makeQuery(name, dns.TypeA)
+		server.dnsMsgHandler(&DnsWriter{writer: newCaptureDNSResponseWriter(), msg: msg, start: time.Now().UnixMilli()}, msg)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/resolvers", nil)
+	req.Header.Set(apiKeyHeader, "secret")
+	rec := httptest.NewRecorder()
+	server.httpMux().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+	var got resolversResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode %q: %v", rec.Body.String(), err)
+	}
+	if len(got.Resolvers) != 2 {
+		t.Fatalf("resolvers = %+v, want 2", got.Resolvers)
+	}
+	brokenView, directView := got.Resolvers[0], got.Resolvers[1]
+	if brokenView.Name != "broken" || brokenView.Alive || brokenView.Accepted != 1 || brokenView.Failed != 1 || brokenView.Answered != 0 {
+		t.Fatalf("broken = %+v, want dead, 1 accepted, 1 failed", brokenView)
+	}
+	if up := brokenView.Upstreams[0]; up.Address != "192.0.2.53" || up.FailCount != 3 || up.Failures != 3 {
+		t.Fatalf("broken upstream = %+v", up)
+	}
+	if directView.Name != "direct" || !directView.Alive || directView.Accepted != 2 || directView.Answered != 2 || directView.Failed != 0 || directView.CacheHits != 1 {
+		t.Fatalf("direct = %+v, want alive, 2 accepted, 2 answered, 1 cache hit", directView)
+	}
+	if up := directView.Upstreams[1]; up.SRTT != 1.5 || up.P50 != 1 || up.P90 != 2 || up.P99 != 3 {
+		t.Fatalf("direct upstream latency = %+v, want srtt 1.5ms, p50/90/99 1/2/3ms", up)
+	}
+
+	rec = httptest.NewRecorder()
+	server.httpMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/resolvers", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status without key = %d, want 401", rec.Code)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/api/resolvers", nil)
+	req.Header.Set(apiKeyHeader, "secret")
+	rec = httptest.NewRecorder()
+	server.httpMux().ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST status = %d, want 405", rec.Code)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io/fs"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -60,6 +61,8 @@ func printRuntimeInfo() {
 // would otherwise corrupt non-idempotent Forward.Close (forward.go:38).
 type resolverGen struct {
 	resolvers []resolver.DnsResolver
+	// counters[i] counts what resolvers[i] did; see resolver_api.go.
+	counters []resolverCounters
 	// inUse counts in-flight queries holding this generation. It is incremented
 	// under genMu.RLock (acquire) and decremented/read under genMu.Lock
 	// (release/swap); atomic ops keep the concurrent RLock increments safe.
@@ -77,17 +80,28 @@ func (g *resolverGen) closeAll() {
 }
 
 type DnsSwitchyServer struct {
-	config     *config.SwitchyConfig
-	udpServer  *dns.Server
-	httpServer *http.Server
-	gen        atomic.Pointer[resolverGen]
-	genMu      sync.RWMutex // protects gen.inUse / gen.retired
-	dnsCache   util.Cache
-	nftWriter  nftset.Writer
-	configCtl  *ConfigController // nil when the config editor API is not wired (e.g. unit tests)
-	apiKey     string            // 见 auth.go：空 = 不鉴权；创建后只读
-	shutdown   bool
-	wg         sync.WaitGroup
+	config      *config.SwitchyConfig
+	listeners   []*dnsListener // DNS listeners plus the `http:` one; see takeListeners
+	httpHandler http.Handler   // built in Start, served by the `http:` listener
+	certs       *certStore     // nil unless a tls listener is configured
+	stopWatch   func()
+	stopPersist func() // stops the periodic cache snapshot; nil when not running
+	gen         atomic.Pointer[resolverGen]
+	genMu       sync.RWMutex // protects gen.inUse / gen.retired
+	dnsCache    util.Cache
+	nftWriter   nftset.Writer
+	configCtl   *ConfigController  // nil when the config editor API is not wired (e.g. unit tests)
+	apiKey      string             // 见 auth.go：空 = 不鉴权；创建后只读
+	acl         *clientACL         // nil = 不限制来源
+	limiter     *rateLimiter       // nil = 不限速
+	clients     *util.ClientGroups // nil = 未配置 clients，日志不标注来源组
+	stale       *staleTracker      // nil = 未开启 serve-stale
+	flights     *flightGroup       // nil = 不合并并发的相同查询
+	// maxNegativeTTL 是否定应答的缓存上限；0 = 不缓存否定应答。
+	maxNegativeTTL time.Duration
+	persistFile    string // 缓存快照文件；空 = 不持久化
+	// successor 是完整重载后接替本服务器的新服务器，见 resolveChain。
+	successor atomic.Pointer[DnsSwitchyServer]
 }
 
 // acquireGen pins the active resolver generation for the duration of a query.
@@ -140,7 +154,12 @@ func (s *DnsSwitchyServer) SwapResolvers(conf *config.SwitchyConfig) error {
 // the last in-flight query closes it on release). It does not touch the cache or
 // s.config — SwapResolvers wraps those concerns.
 func (s *DnsSwitchyServer) installGen(newR []resolver.DnsResolver) {
-	newGen := &resolverGen{resolvers: newR}
+	s.replaceGen(newResolverGen(newR))
+}
+
+// replaceGen stores newGen (nil on Shutdown) and retires the previous
+// generation under the same RCU rules as a swap.
+func (s *DnsSwitchyServer) replaceGen(newGen *resolverGen) {
 	s.genMu.Lock()
 	old := s.gen.Load()
 	s.gen.Store(newGen)
@@ -155,18 +174,35 @@ func (s *DnsSwitchyServer) installGen(newR []resolver.DnsResolver) {
 	}
 }
 
+// Shutdown stops the listeners this server still owns, writes the cache
+// snapshot and retires its resolver generation. Queries that were dispatched
+// here before a reload handed the listeners over still finish: the generation
+// is closed by the last of them.
 func (s *DnsSwitchyServer) Shutdown() {
+	s.shutdown(true)
+}
+
+// shutdown is Shutdown, writing the cache snapshot only if save is set: a
+// reload has already written it before creating the next server, and a second
+// write would cost flash wear for an older view of the cache.
+func (s *DnsSwitchyServer) shutdown(save bool) {
 	log.Println("Shutdown server")
-	if s.udpServer != nil {
-		_ = s.udpServer.Shutdown()
+	for _, l := range s.listeners {
+		l.stop()
 	}
-	if s.httpServer != nil {
-		_ = s.httpServer.Shutdown(context.Background())
+	s.listeners = nil
+	if s.stopWatch != nil {
+		s.stopWatch()
+		s.stopWatch = nil
 	}
-	if gen := s.gen.Load(); gen != nil {
-		gen.closeAll()
+	if s.stopPersist != nil {
+		s.stopPersist()
+		s.stopPersist = nil
 	}
-	s.wg.Wait()
+	if save {
+		s.saveCache()
+	}
+	s.replaceGen(nil)
 }
 
 func (s *DnsSwitchyServer) Start() {
@@ -175,50 +211,92 @@ func (s *DnsSwitchyServer) Start() {
 	if gen := s.gen.Load(); gen != nil {
 		resolvers = gen.resolvers
 	}
-	log.Printf("Started at %s\nHTTP: %s\nTTL: %s\nResolvers: %s", s.config.Addr, s.config.Http, s.config.TTL, resolvers)
-	s.udpServer = &dns.Server{
-		Net:       "udp",
-		Addr:      s.config.Addr,
-		Handler:   s.plainUDPHandler(),
-		ReusePort: true,
-		ReuseAddr: true,
+	if s.certs != nil {
+		s.stopWatch = s.certs.watch()
+	}
+	if s.persistFile != "" && s.config.Cache.PersistInterval > 0 {
+		s.stopPersist = s.persistCache(s.config.Cache.PersistInterval)
 	}
-	s.wg.Add(1)
-	go s.StartPlainUDPServer()
 	if s.config.Http != nil {
-		s.httpServer = &http.Server{Handler: s.httpMux()}
-		s.wg.Add(1)
-		go s.StartHttpServer()
+		s.httpHandler = s.httpMux()
+	}
+	// Listeners handed over by takeListeners are re-labelled and retargeted in
+	// place; only the rest are bound here.
+	adopted := make(map[string]*dnsListener, len(s.listeners))
+	for _, l := range s.listeners {
+		adopted[l.key] = l
+	}
+	var listeners []*dnsListener
+	for _, lc := range s.wantedListeners() {
+		if l, ok := adopted[lc.String()]; ok {
+			l.attach(s, lc.Label)
+			delete(adopted, lc.String())
+			listeners = append(listeners, l)
+			continue
+		}
+		l, err := s.newListener(lc)
+		if err != nil {
+			log.Printf("Create listener fail: %s", err)
+			continue
+		}
+		l.attach(s, lc.Label)
+		l.start()
+		listeners = append(listeners, l)
+	}
+	for _, l := range adopted {
+		l.stop()
 	}
+	s.listeners = listeners
+	log.Printf("Started at %s\nHTTP: %s\nTTL: %s\nResolvers: %s", listeners, s.config.Http, s.config.TTL, resolvers)
 }
 
-func (s *DnsSwitchyServer) StartPlainUDPServer() {
-	defer s.wg.Done()
-	retry(s.udpServer.ListenAndServe)
+// wantedListeners is every socket the config asks for, the `http:` listener
+// included, with duplicate protocol+address entries dropped (they would fight
+// over the same port).
+func (s *DnsSwitchyServer) wantedListeners() []config.ListenerConfig {
+	all := s.config.AllListeners()
+	if s.config.Http != nil {
+		key := protocolHTTP + "://" + s.config.Http.String()
+		all = append(all, config.ListenerConfig{Addr: s.config.Http.String(), Protocol: protocolHTTP, Label: key})
+	}
+	seen := make(map[string]bool, len(all))
+	wanted := make([]config.ListenerConfig, 0, len(all))
+	for _, lc := range all {
+		if seen[lc.String()] {
+			log.Printf("Duplicate listener %s ignored", lc)
+			continue
+		}
+		seen[lc.String()] = true
+		wanted = append(wanted, lc)
+	}
+	return wanted
 }
 
-func (s *DnsSwitchyServer) StartHttpServer() {
-	defer s.wg.Done()
-	if s.httpServer == nil || s.config.Http == nil {
-		return
+func (s *DnsSwitchyServer) newListener(lc config.ListenerConfig) (*dnsListener, error) {
+	if lc.Protocol == protocolHTTP {
+		return newHTTPListener(s.config.Http), nil
 	}
-	retry(func() error {
-		listener, err := s.config.Http.CreateListener()
-		if err != nil {
-			return err
-		}
-		err = s.httpServer.Serve(listener)
-		if errors.Is(err, http.ErrServerClosed) {
-			return nil
-		}
-		return err
-	})
+	return newListener(lc)
 }
 
-func (s *DnsSwitchyServer) plainUDPHandler() dns.HandlerFunc {
-	return func(writer dns.ResponseWriter, msg *dns.Msg) {
-		s.dnsMsgHandler(&DnsWriter{writer, msg, time.Now().UnixMilli()}, msg)
+// takeListeners moves the live listeners of prev that s is configured to serve
+// too (same protocol and address) over to s, and stops the others so their
+// ports are free for s.Start. Until Start retargets them the handed-over
+// listeners keep answering from prev, so there is no gap; prev must be Shutdown
+// after s.Start.
+func (s *DnsSwitchyServer) takeListeners(prev *DnsSwitchyServer) {
+	wanted := make(map[string]bool)
+	for _, lc := range s.wantedListeners() {
+		wanted[lc.String()] = true
+	}
+	for _, l := range prev.listeners {
+		if wanted[l.key] && l.alive() {
+			s.listeners = append(s.listeners, l)
+		} else {
+			l.stop()
+		}
 	}
+	prev.listeners = nil
 }
 
 func (s *DnsSwitchyServer) httpMux() http.Handler {
@@ -228,10 +306,25 @@ func (s *DnsSwitchyServer) httpMux() http.Handler {
 	mux.HandleFunc("/api/query", s.requireAPIKey(s.apiQueryHandler))
 	mux.HandleFunc("/api/config/validate", s.requireAPIKey(s.apiConfigValidateHandler))
 	mux.HandleFunc("/api/config", s.requireAPIKey(s.apiConfigHandler))
+	mux.HandleFunc("/api/ratelimit", s.requireAPIKey(s.apiRateLimitHandler))
+	mux.HandleFunc("/api/cache/stats", s.requireAPIKey(s.apiCacheStatsHandler))
+	mux.HandleFunc("/api/cache", s.requireAPIKey(s.apiCacheHandler))
+	mux.HandleFunc("/api/resolvers", s.requireAPIKey(s.apiResolversHandler))
+	// RFC 8484 DoH 端点不鉴权：浏览器/系统的 DoH 客户端带不了 X-Api-Key。
+	mux.HandleFunc("/dns-query", s.dohHandler(s.httpLabel()))
 	mux.Handle("/", spaHandler())
 	return mux
 }
 
+// httpLabel is the listener label for DoH queries arriving on the plain
+// `http:` listener.
+func (s *DnsSwitchyServer) httpLabel() string {
+	if s.config == nil || s.config.Http == nil {
+		return "http"
+	}
+	return "http://" + s.config.Http.String()
+}
+
 func (s *DnsSwitchyServer) apiQueryHandler(w http.ResponseWriter, r *http.Request) {
 	queryType := r.URL.Query().Get("type")
 	if queryType == "" {
@@ -249,9 +342,21 @@ func (s *DnsSwitchyServer) apiQueryHandler(w http.ResponseWriter, r *http.Reques
 		_, _ = w.Write([]byte("Missing question"))
 		return
 	}
+	// client asks as if from that address, so the portal can check what a
+	// given device gets from source-routed resolvers.
+	var client netip.Addr
+	if param := r.URL.Query().Get("client"); param != "" {
+		var err error
+		if client, err = netip.ParseAddr(param); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("Invalid client"))
+			return
+		}
+		client = client.Unmap()
+	}
 	m := new(dns.Msg)
 	m.SetQuestion(dns.Fqdn(question), queryTypeValue)
-	s.resolveOnly(&HttpWriter{w, m, time.Now().UnixMilli()}, m)
+	s.resolveOnly(&HttpWriter{writer: w, msg: m, start: time.Now().UnixMilli(), client: client, tags: QueryTags{Client: s.clients.Lookup(client)}}, m)
 }
 
 func spaHandler() http.Handler {
@@ -311,6 +416,23 @@ func spaHandlerFS(subFS fs.FS) http.Handler {
 }
 
 func (s *DnsSwitchyServer) dnsMsgHandler(resultWriter ResultWriter, msg *dns.Msg) {
+	client, _ := util.AddrOf(resultWriter.RemoteAddr())
+	resultWriter.Tags().Client = s.clients.Lookup(client)
+	// The ACL runs first: a denied source gets nothing but REFUSED (or
+	// silence), not even FORMERR or a cached answer. Denied queries do not
+	// count against the rate limit; everything else does, cache hits included.
+	if allowed, rule := s.acl.check(resultWriter.RemoteAddr()); rule != "" {
+		resultWriter.Tags().ACL = rule
+		if !allowed {
+			resultWriter.Deny("acl", s.acl.drop)
+			return
+		}
+	}
+	if ok, bucket := s.limiter.take(resultWriter.RemoteAddr()); !ok {
+		resultWriter.Tags().RateLimit = bucket
+		resultWriter.Deny("ratelimit", s.limiter.drop)
+		return
+	}
 	if checkAndUnify(msg) != nil {
 		if msg == nil {
 			log.Printf("[%s] send invalid nil msg", resultWriter.RemoteAddr())
@@ -320,14 +442,33 @@ func (s *DnsSwitchyServer) dnsMsgHandler(resultWriter ResultWriter, msg *dns.Msg
 		resultWriter.Rcode(dns.RcodeFormatError)
 		return
 	}
-	if cached := s.dnsCache.Get(msg.Question[0]); !reflect.DeepEqual(cached, util.None) {
-		resultWriter.Success("dnsCache", &cached)
-		return
+	if !s.sourceRouted(client, msg) {
+		if cached, due := s.getCached(util.KeyOf(msg)); !reflect.DeepEqual(cached, util.None) {
+			resultWriter.Success("dnsCache", &cached)
+			if due {
+				s.prefetch(msg)
+			}
+			return
+		}
+		// Upstream failed for this name moments ago: answer stale right away
+		// instead of waiting on it again; a background refresh is under way.
+		if s.stale.recentlyFailed(util.KeyOf(msg)) && s.answerStale(resultWriter, msg) {
+			return
+		}
 	}
-	s.resolveOnly(resultWriter, msg)
+	s.resolveChain(resultWriter, msg, true)
 }
 
+// resolveOnly walks the resolver chain without the cache: /api/query.
 func (s *DnsSwitchyServer) resolveOnly(resultWriter ResultWriter, msg *dns.Msg) {
+	s.resolveChain(resultWriter, msg, false)
+}
+
+// resolveChain hands msg to the first resolver that accepts it. On the cached
+// path, concurrent identical queries share one upstream exchange (see
+// flightGroup) and a failing resolver is answered for from an expired cache
+// entry (see answerStale) rather than falling through to the next resolver.
+func (s *DnsSwitchyServer) resolveChain(resultWriter ResultWriter, msg *dns.Msg, cached bool) {
 	if checkAndUnify(msg) != nil {
 		if msg == nil {
 			log.Printf("[%s] send invalid nil msg", resultWriter.RemoteAddr())
@@ -338,15 +479,42 @@ func (s *DnsSwitchyServer) resolveOnly(resultWriter ResultWriter, msg *dns.Msg)
 		return
 	}
 	gen := s.acquireGen()
+	if gen == nil {
+		// The listener dispatched msg here just before a reload retargeted
+		// it, and this server has been shut down since: ask its successor.
+		if next := s.successor.Load(); next != nil {
+			next.resolveChain(resultWriter, msg, cached)
+			return
+		}
+	}
 	defer s.releaseGen(gen)
 	var resolvers []resolver.DnsResolver
 	if gen != nil {
 		resolvers = gen.resolvers
 	}
+	client, _ := util.AddrOf(resultWriter.RemoteAddr())
 	for i, upstream := range resolvers {
-		if upstream.Accept(msg) {
-			resp, err := upstream.Resolve(msg)
+		if acceptSource(upstream, client) && upstream.Accept(msg) {
+			counters := gen.counter(i)
+			counters.accepted.Add(1)
+			var resp *dns.Msg
+			var err error
+			shared := false
+			if cached && !sourceScoped(upstream) {
+				resp, shared, err = s.flights.resolve(upstream, msg)
+			} else {
+				resp, err = upstream.Resolve(msg)
+			}
 			if err != nil {
+				counters.failed.Add(1)
+				// A rejected answer is not an outage: the next resolver answers
+				// it, not the stale entry this resolver left in the cache.
+				if cached && !sourceScoped(upstream) && !errors.Is(err, resolver.RejectedError) {
+					s.stale.fail(util.KeyOf(msg))
+					if s.answerStale(resultWriter, msg) {
+						return
+					}
+				}
 				if errors.Is(err, resolver.BreakError) {
 					resultWriter.Fail(upstream, err)
 					return
@@ -357,9 +525,9 @@ func (s *DnsSwitchyServer) resolveOnly(resultWriter ResultWriter, msg *dns.Msg)
 					resultWriter.Fail(upstream, err)
 				}
 			} else {
-				if resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0 {
-					s.writeNftSet(upstream, resp)
-					s.dnsCache.Set(msg.Question[0], *resp, upstream.TTL())
+				counters.answered.Add(1)
+				if !shared {
+					s.storeAnswer(upstream, msg, resp)
 				}
 				resultWriter.Success(upstream, resp)
 			}
@@ -369,6 +537,66 @@ func (s *DnsSwitchyServer) resolveOnly(resultWriter ResultWriter, msg *dns.Msg)
 	resultWriter.Rcode(dns.RcodeRefused)
 }
 
+// storeAnswer feeds a successful upstream answer to the nft sets and, unless
+// the resolver is source-scoped, to the shared cache. NXDOMAIN and NODATA are
+// cached for their SOA-derived TTL when negative caching is on and the
+// resolver's ttl does not disable caching.
+func (s *DnsSwitchyServer) storeAnswer(upstream resolver.DnsResolver, msg, resp *dns.Msg) {
+	if resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0 {
+		s.writeNftSet(upstream, resp)
+		if !sourceScoped(upstream) {
+			s.cacheAnswer(upstream, util.KeyOf(msg), resp, upstream.TTL())
+		}
+		return
+	}
+	if sourceScoped(upstream) || upstream.TTL() < 0 {
+		return
+	}
+	if ttl, ok := util.NegativeTTL(resp, s.maxNegativeTTL); ok {
+		s.cacheAnswer(upstream, util.KeyOf(msg), resp, ttl)
+	}
+}
+
+// cacheAnswer stores resp tagged with the resolver that produced it, when the
+// cache keeps track of that.
+func (s *DnsSwitchyServer) cacheAnswer(upstream resolver.DnsResolver, key util.CacheKey, resp *dns.Msg, ttl time.Duration) {
+	if owned, ok := s.dnsCache.(util.OwnedCache); ok {
+		owned.SetFrom(key, *resp, ttl, resolverName(upstream))
+		return
+	}
+	s.dnsCache.Set(key, *resp, ttl)
+}
+
+// acceptSource lets a resolver with a `source:` list turn away other clients.
+// Resolvers that are not SourceAware (test doubles) accept everyone.
+func acceptSource(upstream resolver.DnsResolver, client netip.Addr) bool {
+	sa, ok := upstream.(resolver.SourceAware)
+	return !ok || sa.AcceptSource(client)
+}
+
+func sourceScoped(upstream resolver.DnsResolver) bool {
+	sa, ok := upstream.(resolver.SourceAware)
+	return ok && sa.SourceScoped()
+}
+
+// sourceRouted reports whether a source-scoped resolver would take this query
+// from client. Such answers are per client, so they bypass the shared cache in
+// both directions: a kid's device must not get the answer cached for everyone
+// else, nor leave its filtered answer behind for them.
+func (s *DnsSwitchyServer) sourceRouted(client netip.Addr, msg *dns.Msg) bool {
+	gen := s.acquireGen()
+	defer s.releaseGen(gen)
+	if gen == nil {
+		return false
+	}
+	for _, r := range gen.resolvers {
+		if sourceScoped(r) && acceptSource(r, client) && r.Accept(msg) {
+			return true
+		}
+	}
+	return false
+}
+
 // writeNftSet 在「配了 nftset 的 resolver」cache-miss 解析成功后，把答案里的 A 记录 IP
 // 同步写进对应的 nft 集合（本期仅 IPv4，忽略 AAAA）。失败非致命：只记日志，DNS 答案
 // 照常返回。调用点在 dnsCache.Set/Success 之前，确保客户端拿到 IP 去连接时集合已就绪。
@@ -399,6 +627,21 @@ func (s *DnsSwitchyServer) writeNftSet(upstream resolver.DnsResolver, resp *dns.
 }
 
 func Create(conf *config.SwitchyConfig) (*DnsSwitchyServer, error) {
+	var certs *certStore
+	if conf.TLS != nil {
+		var err error
+		if certs, err = newCertStore(conf.TLS.Cert, conf.TLS.Key); err != nil {
+			return nil, err
+		}
+	}
+	var leases *util.LeaseTable
+	if conf.LeaseFile != "" {
+		leases = util.NewLeaseTable(conf.LeaseFile)
+	}
+	clients, err := util.NewClientGroups(conf.Clients, leases)
+	if err != nil {
+		return nil, err
+	}
 	resolvers, err := resolver.CreateResolvers(conf)
 	if err != nil {
 		return nil, err
@@ -408,12 +651,27 @@ func Create(conf *config.SwitchyConfig) (*DnsSwitchyServer, error) {
 	}
 	s := &DnsSwitchyServer{
 		config:    conf,
-		dnsCache:  util.NewDnsCache(conf.TTL),
+		dnsCache:  util.NewDnsCacheWithConfig(conf.TTL, conf.Cache),
 		nftWriter: nftset.NewExecWriter(conf.NftSetTable),
+		certs:     certs,
 		apiKey:    conf.ApiKey,
-		wg:        sync.WaitGroup{},
+		acl:       newClientACL(conf.ACL),
+		limiter:   newRateLimiter(conf.RateLimit),
+		clients:   clients,
+		stale:     newStaleTracker(conf.Cache),
+		flights:   newFlightGroup(),
+
+		maxNegativeTTL: conf.Cache.MaxNegativeTTL,
+		persistFile:    conf.Cache.PersistFile,
+	}
+	if s.persistFile != "" {
+		if restored, err := loadCacheSnapshot(s.dnsCache, s.persistFile, resolvers); err != nil {
+			log.Printf("cache snapshot %s: %s", s.persistFile, err)
+		} else if restored > 0 {
+			log.Printf("Restored %d cache entries from %s", restored, s.persistFile)
+		}
 	}
-	s.gen.Store(&resolverGen{resolvers: resolvers})
+	s.gen.Store(newResolverGen(resolvers))
 	return s, nil
 }
 
@@ -441,21 +699,38 @@ func calcTTL(resolvers []resolver.DnsResolver) time.Duration {
 
 type ResultWriter interface {
 	RemoteAddr() net.Addr
+	// Tags is filled in while the query is handled and lands in the log line.
+	Tags() *QueryTags
 	Success(name interface{}, resp *dns.Msg)
 	Fail(name interface{}, err error)
 	Rcode(rcode int)
+	// Deny answers a query rejected by policy (logged as its resolver) with
+	// REFUSED, or not at all when drop is set.
+	Deny(policy string, drop bool)
+}
+
+// QueryTags is per-query metadata carried from the transport and the policy
+// checks into StructureLog.
+type QueryTags struct {
+	Listener  string // label of the listener the query arrived on
+	Client    string // `clients:` group of the source; empty when none matches
+	ACL       string // deciding acl rule; empty without an acl
+	RateLimit string // source IP or prefix whose bucket ran dry
 }
 
 type DnsWriter struct {
 	writer dns.ResponseWriter
 	msg    *dns.Msg
 	start  int64
+	tags   QueryTags
 }
 
 type HttpWriter struct {
 	writer http.ResponseWriter
 	msg    *dns.Msg
 	start  int64
+	client netip.Addr // ?client= of /api/query; invalid when not given
+	tags   QueryTags
 }
 
 type FakeAddr struct {
@@ -470,23 +745,37 @@ func (f FakeAddr) String() string {
 }
 
 func (a *HttpWriter) RemoteAddr() net.Addr {
+	if a.client.IsValid() {
+		return net.UDPAddrFromAddrPort(netip.AddrPortFrom(a.client, 0))
+	}
 	return &FakeAddr{}
 }
 
+func (a *HttpWriter) Tags() *QueryTags {
+	return &a.tags
+}
+
 func (a *HttpWriter) Success(name interface{}, resp *dns.Msg) {
 	a.writer.Header().Set("content-type", "application/json")
-	_ = json.NewEncoder(a.writer).Encode(map[string]interface{}{
-		"resolver": fmt.Sprintf("%s", name),
-		"answer":   resp,
-	})
+	_ = json.NewEncoder(a.writer).Encode(a.result(name, "answer", resp))
 }
 
 func (a *HttpWriter) Fail(name interface{}, err error) {
 	a.writer.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(a.writer).Encode(map[string]interface{}{
+	_ = json.NewEncoder(a.writer).Encode(a.result(name, "error", err))
+}
+
+// result is the /api/query response body; "client" names the `clients:` group
+// of ?client= when one matches, like the query log does.
+func (a *HttpWriter) result(name interface{}, key string, value interface{}) map[string]interface{} {
+	out := map[string]interface{}{
 		"resolver": fmt.Sprintf("%s", name),
-		"error":    err,
-	})
+		key:        value,
+	}
+	if a.tags.Client != "" {
+		out["client"] = a.tags.Client
+	}
+	return out
 }
 
 func (a *HttpWriter) Rcode(rcode int) {
@@ -499,21 +788,41 @@ func (a *HttpWriter) Rcode(rcode int) {
 	a.Success("policy", resp)
 }
 
+func (a *HttpWriter) Deny(string, bool) {
+	a.Rcode(dns.RcodeRefused)
+}
+
 func (w *DnsWriter) RemoteAddr() net.Addr {
 	return w.writer.RemoteAddr()
 }
 
-func (w *DnsWriter) Success(name interface{}, resp *dns.Msg) {
+func (w *DnsWriter) Tags() *QueryTags {
+	return &w.tags
+}
+
+// structureLog fills the fields shared by every log line of this query. The
+// question may be missing when the ACL rejects a malformed message.
+func (w *DnsWriter) structureLog(name interface{}) StructureLog {
 	remoteAddr := w.writer.RemoteAddr().String()
 	structureLog := StructureLog{
-		Resolver:   fmt.Sprintf("%s", name),
-		Remote:     remoteAddr[:strings.LastIndex(remoteAddr, ":")],
-		Time:       time.Now().UnixMilli() - w.start,
-		Type:       dns.TypeToString[w.msg.Question[0].Qtype],
-		Question:   w.msg.Question[0].Name,
-		RCode:      dns.RcodeToString[resp.Rcode],
-		AnswerSize: len(resp.Answer),
+		Resolver: fmt.Sprintf("%s", name),
+		Remote:   remoteAddr[:strings.LastIndex(remoteAddr, ":")],
+		Listener: w.tags.Listener,
+		Client:   w.tags.Client,
+		ACL:      w.tags.ACL,
+		Time:     time.Now().UnixMilli() - w.start,
+	}
+	if w.msg != nil && len(w.msg.Question) > 0 {
+		structureLog.Type = dns.TypeToString[w.msg.Question[0].Qtype]
+		structureLog.Question = w.msg.Question[0].Name
 	}
+	return structureLog
+}
+
+func (w *DnsWriter) Success(name interface{}, resp *dns.Msg) {
+	structureLog := w.structureLog(name)
+	structureLog.RCode = dns.RcodeToString[resp.Rcode]
+	structureLog.AnswerSize = len(resp.Answer)
 	_ = json.NewEncoder(log.Writer()).Encode(structureLog)
 	writeResp := resp.Copy()
 	writeResp.Id = w.msg.Id
@@ -522,11 +831,26 @@ func (w *DnsWriter) Success(name interface{}, resp *dns.Msg) {
 		writeResp.RecursionDesired = w.msg.RecursionDesired // Copy rd bit
 		writeResp.CheckingDisabled = w.msg.CheckingDisabled // Copy cd bit
 	}
-	writeResp.Truncate(w.udpSize())
+	writeResp.Truncate(w.maxSize())
 	_ = w.writer.WriteMsg(writeResp)
 }
 
-func (w *DnsWriter) udpSize() int {
+// streamWriter marks dns.ResponseWriters whose transport carries full-size
+// messages even though the peer address is a *net.UDPAddr (DoQ).
+type streamWriter interface {
+	streamTransport()
+}
+
+// maxSize is the largest response the client can take on this transport. Only
+// UDP is limited by the EDNS0 buffer size (or 512); stream transports carry a
+// full 64 KiB message, so TCP/DoT/DoH/DoQ answers are never truncated.
+func (w *DnsWriter) maxSize() int {
+	if _, ok := w.writer.(streamWriter); ok {
+		return dns.MaxMsgSize
+	}
+	if _, ok := w.writer.RemoteAddr().(*net.UDPAddr); !ok {
+		return dns.MaxMsgSize
+	}
 	if opt := w.msg.IsEdns0(); opt != nil && opt.UDPSize() > 0 {
 		return int(opt.UDPSize())
 	}
@@ -534,15 +858,8 @@ func (w *DnsWriter) udpSize() int {
 }
 
 func (w *DnsWriter) Fail(name interface{}, err error) {
-	remoteAddr := w.writer.RemoteAddr().String()
-	structureLog := StructureLog{
-		Resolver: fmt.Sprintf("%s", name),
-		Remote:   remoteAddr[:strings.LastIndex(remoteAddr, ":")],
-		Time:     time.Now().UnixMilli() - w.start,
-		Type:     dns.TypeToString[w.msg.Question[0].Qtype],
-		Question: w.msg.Question[0].Name,
-		Error:    err,
-	}
+	structureLog := w.structureLog(name)
+	structureLog.Error = err
 	_ = json.NewEncoder(log.Writer()).Encode(structureLog)
 	resp := new(dns.Msg)
 	resp.SetRcode(w.msg, dns.RcodeServerFailure)
@@ -559,6 +876,30 @@ func (w *DnsWriter) Rcode(rcode int) {
 	_ = w.writer.WriteMsg(resp)
 }
 
+// dropWriter is a transport that cannot stay silent: HTTP always answers with
+// a status, so a dropped DoH query gets 403 instead of an empty 200.
+type dropWriter interface {
+	drop()
+}
+
+func (w *DnsWriter) Deny(policy string, drop bool) {
+	structureLog := w.structureLog(policy)
+	structureLog.RateLimit = w.tags.RateLimit
+	if drop {
+		structureLog.Dropped = true
+	} else {
+		structureLog.RCode = dns.RcodeToString[dns.RcodeRefused]
+	}
+	_ = json.NewEncoder(log.Writer()).Encode(structureLog)
+	if !drop {
+		w.Rcode(dns.RcodeRefused)
+		return
+	}
+	if d, ok := w.writer.(dropWriter); ok {
+		d.drop()
+	}
+}
+
 func checkAndUnify(msg *dns.Msg) error {
 	if msg == nil {
 		return errors.New("invalid nil msg")
@@ -573,10 +914,15 @@ func checkAndUnify(msg *dns.Msg) error {
 type StructureLog struct {
 	Resolver   string `json:"resolver,omitempty"`
 	Remote     string `json:"remote,omitempty"`
+	Listener   string `json:"listener,omitempty"`
+	Client     string `json:"client,omitempty"`
+	ACL        string `json:"acl,omitempty"`
+	RateLimit  string `json:"rateLimit,omitempty"`
 	Time       int64  `json:"time,omitempty"`
 	Type       string `json:"type,omitempty"`
 	Question   string `json:"question,omitempty"`
 	RCode      string `json:"rCode,omitempty"`
 	AnswerSize int    `json:"answerSize"`
 	Error      error  `json:"error,omitempty"`
+	Dropped    bool   `json:"dropped,omitempty"`
 }
@@ -6,7 +6,9 @@ import (
 	"dns-switchy/config"
 	"dns-switchy/resolver"
 	"dns-switchy/util"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -97,7 +99,7 @@ func newServerForTest(resolvers []resolver.DnsResolver) *DnsSwitchyServer {
 	s := &DnsSwitchyServer{
 		dnsCache: &util.NoCache{},
 	}
-	s.gen.Store(&resolverGen{resolvers: resolvers})
+	s.gen.Store(newResolverGen(resolvers))
 	return s
 }
 
@@ -113,7 +115,7 @@ type fakeCache struct {
 	clearCalls int
 }
 
-func (c *fakeCache) Get(_ dns.Question) dns.Msg {
+func (c *fakeCache) Get(_ util.CacheKey) dns.Msg {
 	return c.getResult
 }
 
@@ -121,9 +123,9 @@ func (c *fakeCache) Clear() {
 	c.clearCalls++
 }
 
-func (c *fakeCache) Set(q dns.Question, msg dns.Msg, ttl time.Duration) {
+func (c *fakeCache) Set(key util.CacheKey, msg dns.Msg, ttl time.Duration) {
 	c.setCalls = append(c.setCalls, fakeCacheSetCall{
-		question: q,
+		question: key.Question,
 		msg:      *msg.Copy(),
 		ttl:      ttl,
 	})
@@ -557,6 +559,62 @@ func TestDnsMsgHandlerCachesOnlySuccessfulAnsweredResponses(t *testing.T) {
 	}
 }
 
+func makeNegativeResponse(msg *dns.Msg, rcode int, soaTTL, minTTL uint32) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetRcode(msg, rcode)
+	resp.Ns = []dns.RR{&dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: soaTTL},
+		Ns:     "ns.example.com.",
+		Mbox:   "hostmaster.example.com.",
+		Minttl: minTTL,
+	}}
+	return resp
+}
+
+func TestDnsMsgHandlerCachesNegativeResponses(t *testing.T) {
+	tests := []struct {
+		name        string
+		resp        func(msg *dns.Msg) *dns.Msg
+		resolverTTL time.Duration
+		maxNegative time.Duration
+		wantTTL     time.Duration // 0 = not cached
+	}{
+		{"NXDOMAINUsesSOAMinimum", func(msg *dns.Msg) *dns.Msg { return makeNegativeResponse(msg, dns.RcodeNameError, 3600, 300) }, time.Hour, 10 * time.Minute, 300 * time.Second},
+		{"NODATAUsesSOATTL", func(msg *dns.Msg) *dns.Msg { return makeNegativeResponse(msg, dns.RcodeSuccess, 60, 300) }, time.Hour, 10 * time.Minute, 60 * time.Second},
+		{"CappedAtMaxNegativeTTL", func(msg *dns.Msg) *dns.Msg { return makeNegativeResponse(msg, dns.RcodeNameError, 3600, 3600) }, time.Hour, 30 * time.Second, 30 * time.Second},
+		{"WithoutSOANotCached", func(msg *dns.Msg) *dns.Msg { return new(dns.Msg).SetRcode(msg, dns.RcodeNameError) }, time.Hour, 10 * time.Minute, 0},
+		{"ServfailNotCached", func(msg *dns.Msg) *dns.Msg { return makeNegativeResponse(msg, dns.RcodeServerFailure, 3600, 300) }, time.Hour, 10 * time.Minute, 0},
+		{"ResolverCacheDisabled", func(msg *dns.Msg) *dns.Msg { return makeNegativeResponse(msg, dns.RcodeNameError, 3600, 300) }, -time.Second, 10 * time.Minute, 0},
+		{"NegativeCachingOff", func(msg *dns.Msg) *dns.Msg { return makeNegativeResponse(msg, dns.RcodeNameError, 3600, 300) }, time.Hour, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := &fakeCache{}
+			server := newServerForTest([]resolver.DnsResolver{&testResolver{
+				ttl:       tt.resolverTTL,
+				acceptFn:  func(*dns.Msg) bool { return true },
+				resolveFn: func(msg *dns.Msg) (*dns.Msg, error) { return tt.resp(msg), nil },
+			}})
+			server.dnsCache = cache
+			server.maxNegativeTTL = tt.maxNegative
+
+			query := makeQuery("missing.example.com.", dns.TypeAAAA)
+			wire := newCaptureDNSResponseWriter()
+			server.dnsMsgHandler(&DnsWriter{writer: wire, msg: query, start: time.Now().UnixMilli()}, query)
+
+			if tt.wantTTL == 0 {
+				if len(cache.setCalls) != 0 {
+					t.Fatalf("cache set calls = %d, want 0", len(cache.setCalls))
+				}
+				return
+			}
+			if len(cache.setCalls) != 1 || cache.setCalls[0].ttl != tt.wantTTL {
+				t.Fatalf("cache set calls = %+v, want one with ttl %s", cache.setCalls, tt.wantTTL)
+			}
+		})
+	}
+}
+
 type nftAddCall struct {
 	set string
 	ips []net.IP
@@ -847,6 +905,25 @@ func TestDnsWriterSuccessTruncateAndEDNSPolicy(t *testing.T) {
 	}
 }
 
+func TestDnsWriterSuccessDoesNotTruncateOverTCP(t *testing.T) {
+	req := makeQuery("large.example.", dns.TypeA)
+	resp := largeReplyFor(req)
+	wire := newCaptureDNSResponseWriter()
+	wire.peerAddr = &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53000}
+
+	(&DnsWriter{writer: wire, msg: req, start: time.Now().UnixMilli()}).Success("test-resolver", resp)
+
+	if wire.msg == nil {
+		t.Fatal("expected DNS response to be written")
+	}
+	if wire.msg.Truncated {
+		t.Fatal("TCP response has TC bit set, want full answer")
+	}
+	if len(wire.msg.Answer) != len(resp.Answer) {
+		t.Fatalf("answer count = %d, want %d", len(wire.msg.Answer), len(resp.Answer))
+	}
+}
+
 func TestDnsWriterSuccessResponseCopyIsolation(t *testing.T) {
 	sharedResp := largeReplyFor(makeQuery("shared.example.", dns.TypeA))
 	sharedResp.Id = 7
@@ -966,6 +1043,40 @@ func TestStartReturnsImmediately(t *testing.T) {
 	}
 }
 
+func TestStartServesTCPOnSameAddr(t *testing.T) {
+	addr := reserveUDPAddr(t)
+	server := newServerForTest([]resolver.DnsResolver{&testResolver{
+		acceptFn:  func(*dns.Msg) bool { return true },
+		resolveFn: func(msg *dns.Msg) (*dns.Msg, error) { return largeReplyFor(msg), nil },
+	}})
+	server.config = &config.SwitchyConfig{Addr: addr}
+	server.Start()
+	t.Cleanup(server.Shutdown)
+
+	req := makeQuery("large.example.", dns.TypeA)
+	var (
+		resp *dns.Msg
+		err  error
+	)
+	client := &dns.Client{Net: "tcp", Timeout: time.Second}
+	for range 20 {
+		resp, _, err = client.Exchange(req, addr)
+		if err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("tcp exchange fail: %v", err)
+	}
+	if resp.Truncated {
+		t.Fatal("TCP response has TC bit set, want full answer")
+	}
+	if want := len(largeReplyFor(req).Answer); len(resp.Answer) != want {
+		t.Fatalf("answer count = %d, want %d", len(resp.Answer), want)
+	}
+}
+
 func TestReloadServerStopsPreviousListeners(t *testing.T) {
 	oldAddr := reserveUDPAddr(t)
 	newAddr := reserveUDPAddr(t)
@@ -1064,3 +1175,149 @@ resolvers:
 		t.Fatalf("forward.Rule = %#v, want %#v", forward.Rule, want)
 	}
 }
+
+func TestDnsMsgHandlerRoutesBySource(t *testing.T) {
+	scoped, err := resolver.CreateResolvers(&config.SwitchyConfig{Resolvers: []config.ResolverConfig{
+		&config.MockConfig{Answer: "192.0.2.66", SourceConfig: config.SourceConfig{Source: []string{"192.168.1.50/32"}}},
+	}})
+	if err != nil {
+		t.Fatalf("CreateResolvers() error = %v", err)
+	}
+	server := newServerForTest(append(scoped, &testResolver{
+		acceptFn:  func(*dns.Msg) bool { return true },
+		resolveFn: func(msg *dns.Msg) (*dns.Msg, error) { return makeAResponse(msg, "192.0.2.1"), nil },
+		ttl:       time.Minute,
+	}))
+	server.dnsCache = util.NewDnsCache(time.Minute)
+
+	query := func(client string) string {
+		t.Helper()
+		writer := newCaptureDNSResponseWriter()
+		writer.peerAddr = &net.UDPAddr{IP: net.ParseIP(client), Port: 5353}
+		msg := makeQuery("example.com.", dns.TypeA)
+		server.dnsMsgHandler(&DnsWriter{writer: writer, msg: msg, start: time.Now().UnixMilli()}, msg)
+		if writer.msg == nil || len(writer.msg.Answer) != 1 {
+			t.Fatalf("response for %s = %v, want one answer", client, writer.msg)
+		}
+		return writer.msg.Answer[0].(*dns.A).A.String()
+	}
+
+	// The default answer is cached for everyone else, but never served to the
+	// source-scoped client; its own answer never lands in the shared cache.
+	if got := query("192.168.1.10"); got != "192.0.2.1" {
+		t.Fatalf("default client answer = %s, want 192.0.2.1", got)
+	}
+	if got := query("192.168.1.50"); got != "192.0.2.66" {
+		t.Fatalf("scoped client answer = %s, want 192.0.2.66", got)
+	}
+	if got := query("192.168.1.11"); got != "192.0.2.1" {
+		t.Fatalf("default client answer after scoped query = %s, want 192.0.2.1", got)
+	}
+	if cached := server.dnsCache.Get(util.QuestionKey(dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})); len(cached.Answer) != 1 || cached.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("shared cache = %v, want the default answer only", cached.Answer)
+	}
+}
+
+func TestClientGroupInLogAndAPIQuery(t *testing.T) {
+	logs := captureLog(t)
+	scoped, err := resolver.CreateResolvers(&config.SwitchyConfig{Resolvers: []config.ResolverConfig{
+		&config.MockConfig{Answer: "192.0.2.66", SourceConfig: config.SourceConfig{Source: []string{"192.168.1.50/32"}}},
+	}})
+	if err != nil {
+		t.Fatalf("CreateResolvers() error = %v", err)
+	}
+	server := newServerForTest(append(scoped, &testResolver{
+		acceptFn:  func(*dns.Msg) bool { return true },
+		resolveFn: func(msg *dns.Msg) (*dns.Msg, error) { return makeAResponse(msg, "192.0.2.1"), nil },
+	}))
+	if server.clients, err = util.NewClientGroups(map[string][]string{"kids": {"192.168.1.50/32"}}, nil); err != nil {
+		t.Fatalf("NewClientGroups() error = %v", err)
+	}
+
+	for _, ip := range []string{"192.168.1.50", "192.168.1.10"} {
+		writer := newCaptureDNSResponseWriter()
+		writer.peerAddr = &net.UDPAddr{IP: net.ParseIP(ip), Port: 5353}
+		msg := makeQuery("example.com.", dns.TypeA)
+		server.dnsMsgHandler(&DnsWriter{writer: writer, msg: msg, start: time.Now().UnixMilli()}, msg)
+	}
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("log = %q, want two lines", logs.String())
+	}
+	for i, want := range []string{"kids", ""} {
+		var entry StructureLog
+		if err := json.Unmarshal([]byte(lines[i]), &entry); err != nil {
+			t.Fatalf("decode log line %q: %v", lines[i], err)
+		}
+		if entry.Client != want {
+			t.Fatalf("log line %d client = %q, want %q", i, entry.Client, want)
+		}
+	}
+
+	apiQuery := func(query string) (int, map[string]interface{}) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		server.httpMux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/query?question=example.com"+query, nil))
+		var body map[string]interface{}
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body
+	}
+	// ?client= both routes like the device would be and names its group.
+	if code, body := apiQuery("&client=192.168.1.50"); code != http.StatusOK || body["client"] != "kids" || !strings.Contains(fmt.Sprint(body["resolver"]), "192.0.2.66") {
+		t.Fatalf("api query as kid = %d %v, want kids routed to the scoped mock", code, body)
+	}
+	if code, body := apiQuery(""); code != http.StatusOK || body["client"] != nil {
+		t.Fatalf("api query without client = %d %v, want no client group", code, body)
+	}
+	if code, _ := apiQuery("&client=kids"); code != http.StatusBadRequest {
+		t.Fatalf("api query with bad client = %d, want 400", code)
+	}
+}
+
+func TestDnsMsgHandlerCachesPerDOAndCD(t *testing.T) {
+	var calls int
+	server := newServerForTest([]resolver.DnsResolver{&testResolver{
+		acceptFn: func(*dns.Msg) bool { return true },
+		resolveFn: func(msg *dns.Msg) (*dns.Msg, error) {
+			calls++
+			resp := makeAResponse(msg, "192.0.2.1")
+			if opt := msg.IsEdns0(); opt != nil && opt.Do() {
+				resp.Answer = append(resp.Answer, &dns.RRSIG{
+					Hdr:         dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 60},
+					TypeCovered: dns.TypeA,
+				})
+			}
+			return resp, nil
+		},
+	}})
+	server.dnsCache = util.NewDnsCache(time.Minute)
+	query := func(do, cd bool) int {
+		t.Helper()
+		writer := newCaptureDNSResponseWriter()
+		msg := makeQuery("example.com.", dns.TypeA)
+		msg.CheckingDisabled = cd
+		if do {
+			msg.SetEdns0(1232, true)
+		}
+		server.dnsMsgHandler(&DnsWriter{writer: writer, msg: msg, start: time.Now().UnixMilli()}, msg)
+		if writer.msg == nil {
+			t.Fatal("no response written")
+		}
+		return len(writer.msg.Answer)
+	}
+
+	if n := query(false, false); n != 1 {
+		t.Fatalf("plain answer has %d records, want 1", n)
+	}
+	if n := query(true, false); n != 2 {
+		t.Fatalf("DO answer has %d records, want the A and its RRSIG", n)
+	}
+	if n := query(false, false); n != 1 {
+		t.Fatalf("plain answer after DO has %d records, want 1 without the RRSIG", n)
+	}
+	query(false, true)
+	query(true, false)
+	if calls != 3 {
+		t.Fatalf("upstream calls = %d, want one each for plain, DO and CD", calls)
+	}
+}
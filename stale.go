@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"dns-switchy/config"
+	"dns-switchy/util"
+
+	"github.com/miekg/dns"
+)
+
+// staleTracker is the serve-stale (RFC 8767) state beside the cache: which
+// questions upstream recently failed for, and which are being refreshed in
+// the background. A nil *staleTracker means serve-stale is off.
+type staleTracker struct {
+	recheck time.Duration // how long a failure lets stale answers skip upstream
+	now     func() time.Time
+
+	mu        sync.Mutex
+	failed    map[util.CacheKey]time.Time
+	inflight  map[util.CacheKey]struct{}
+	nextPrune time.Time
+}
+
+func newStaleTracker(c config.CacheConfig) *staleTracker {
+	if c.ServeStale <= 0 {
+		return nil
+	}
+	return &staleTracker{
+		recheck:  c.StaleTTL,
+		now:      time.Now,
+		failed:   make(map[util.CacheKey]time.Time),
+		inflight: make(map[util.CacheKey]struct{}),
+	}
+}
+
+// fail records an upstream failure for key. Old records are pruned at most once
+// per recheck so names that are never asked again do not accumulate.
+func (t *staleTracker) fail(key util.CacheKey) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	t.failed[key] = now
+	if now.Before(t.nextPrune) {
+		return
+	}
+	t.nextPrune = now.Add(t.recheck)
+	for failed, at := range t.failed {
+		if now.Sub(at) >= t.recheck {
+			delete(t.failed, failed)
+		}
+	}
+}
+
+// recentlyFailed reports whether upstream failed for key within the last
+// recheck, i.e. within the lifetime of the stale answer the client got.
+func (t *staleTracker) recentlyFailed(key util.CacheKey) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	at, ok := t.failed[key]
+	return ok && t.now().Sub(at) < t.recheck
+}
+
+// begin claims the background refresh of key; false if one is already running.
+func (t *staleTracker) begin(key util.CacheKey) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.inflight[key]; ok {
+		return false
+	}
+	t.inflight[key] = struct{}{}
+	return true
+}
+
+func (t *staleTracker) end(key util.CacheKey, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.inflight, key)
+	if ok {
+		delete(t.failed, key)
+	} else {
+		t.failed[key] = t.now()
+	}
+}
+
+// answerStale answers msg from an expired cache entry, if the cache still
+// holds one, and starts refreshing it in the background.
+func (s *DnsSwitchyServer) answerStale(resultWriter ResultWriter, msg *dns.Msg) bool {
+	if s.stale == nil {
+		return false
+	}
+	cache, ok := s.dnsCache.(util.StaleCache)
+	if !ok {
+		return false
+	}
+	resp, ok := cache.GetStale(util.KeyOf(msg))
+	if !ok {
+		return false
+	}
+	resultWriter.Success("staleCache", &resp)
+	s.refreshStale(msg)
+	return true
+}
+
+// refreshStale re-resolves msg in the background, at most once at a time per
+// question. A success lands in the cache like any answer; a failure keeps
+// stale answers coming for another recheck period.
+func (s *DnsSwitchyServer) refreshStale(msg *dns.Msg) {
+	key := util.KeyOf(msg)
+	if !s.stale.begin(key) {
+		return
+	}
+	s.refresh(msg, func(ok bool) { s.stale.end(key, ok) })
+}
+
+// refresh re-resolves msg in the background and stores a successful answer,
+// then calls done. Only the resolver that takes the question is asked:
+// falling through to the next one would cache an answer from the wrong
+// upstream. The exchange is shared with client misses for the same key (see
+// flightGroup); whichever of them started it stores the answer.
+func (s *DnsSwitchyServer) refresh(msg *dns.Msg, done func(ok bool)) {
+	refresh := msg.Copy()
+	go func() {
+		ok := false
+		defer func() { done(ok) }()
+		gen := s.acquireGen()
+		defer s.releaseGen(gen)
+		if gen == nil {
+			return
+		}
+		// No client address: source-scoped resolvers, whose answers are never
+		// cached, do not take part.
+		for _, upstream := range gen.resolvers {
+			if acceptSource(upstream, netip.Addr{}) && upstream.Accept(refresh) {
+				resp, shared, err := s.flights.resolve(upstream, refresh)
+				if ok = err == nil; ok && !shared {
+					s.storeAnswer(upstream, refresh, resp)
+				}
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dns-switchy/config"
+	"dns-switchy/resolver"
+	"dns-switchy/util"
+
+	"github.com/miekg/dns"
+)
+
+// waitRefresh waits for background stale refreshes to finish.
+func waitRefresh(t *testing.T, tracker *staleTracker) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		tracker.mu.Lock()
+		idle := len(tracker.inflight) == 0
+		tracker.mu.Unlock()
+		if idle {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("background refresh did not finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDnsMsgHandlerServesStaleOnUpstreamFailure(t *testing.T) {
+	var failing atomic.Bool
+	var finalCalls atomic.Int32
+	server := newServerForTest([]resolver.DnsResolver{
+		&testResolver{
+			acceptFn: func(*dns.Msg) bool { return true },
+			resolveFn: func(msg *dns.Msg) (*dns.Msg, error) {
+				if failing.Load() {
+					return nil, errors.New("upstream timeout")
+				}
+				return makeAResponse(msg, "192.0.2.1"), nil
+			},
+			ttl: 20 * time.Millisecond,
+		},
+		&testResolver{
+			acceptFn: func(*dns.Msg) bool { return true },
+			resolveFn: func(msg *dns.Msg) (*dns.Msg, error) {
+				finalCalls.Add(1)
+				return makeAResponse(msg, "192.0.2.9"), nil
+			},
+		},
+	})
+	cacheConf := config.CacheConfig{ServeStale: time.Hour, StaleTTL: 30 * time.Second}
+	server.dnsCache = util.NewDnsCacheWithConfig(time.Minute, cacheConf)
+	server.stale = newStaleTracker(cacheConf)
+
+	query := func() *dns.A {
+		t.Helper()
+		writer := newCaptureDNSResponseWriter()
+		msg := makeQuery("example.com.", dns.TypeA)
+		server.dnsMsgHandler(&DnsWriter{writer: writer, msg: msg, start: time.Now().UnixMilli()}, msg)
+		if writer.msg == nil || len(writer.msg.Answer) != 1 {
+			t.Fatalf("response = %v, want one answer", writer.msg)
+		}
+		return writer.msg.Answer[0].(*dns.A)
+	}
+
+	query()
+	time.Sleep(40 * time.Millisecond) // let the entry expire
+	failing.Store(true)
+	if a := query(); a.A.String() != "192.0.2.1" || a.Hdr.Ttl != 30 {
+		t.Fatalf("answer during outage = %s ttl %d, want stale 192.0.2.1 ttl 30", a.A, a.Hdr.Ttl)
+	}
+	if finalCalls.Load() != 0 {
+		t.Fatalf("final resolver called %d times, want the stale answer instead", finalCalls.Load())
+	}
+	waitRefresh(t, server.stale)
+	if !server.stale.recentlyFailed(util.KeyOf(makeQuery("example.com.", dns.TypeA))) {
+		t.Fatal("failed background refresh did not extend the failure window")
+	}
+
+	// Upstream is back: the next query is still answered stale (the failure is
+	// recent) but its refresh puts a fresh answer in the cache.
+	failing.Store(false)
+	if a := query(); a.Hdr.Ttl != 30 {
+		t.Fatalf("answer right after recovery ttl %d, want stale ttl 30", a.Hdr.Ttl)
+	}
+	waitRefresh(t, server.stale)
+	if a := query(); a.A.String() != "192.0.2.1" || a.Hdr.Ttl != 60 {
+		t.Fatalf("answer after refresh = %s ttl %d, want fresh 192.0.2.1 ttl 60", a.A, a.Hdr.Ttl)
+	}
+
+	// /api/query never sees the cache, stale or not.
+	time.Sleep(40 * time.Millisecond)
+	failing.Store(true)
+	w := httptest.NewRecorder()
+	server.httpMux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/query?question=example.com", nil))
+	if !strings.Contains(w.Body.String(), "192.0.2.9") {
+		t.Fatalf("api query during outage = %s, want the final resolver's answer", w.Body.String())
+	}
+}
+
+func TestDnsMsgHandlerRejectedAnswerFallsThrough(t *testing.T) {
+	var rejecting atomic.Bool
+	server := newServerForTest([]resolver.DnsResolver{
+		&testResolver{
+			acceptFn: func(*dns.Msg) bool { return true },
+			resolveFn: func(msg *dns.Msg) (*dns.Msg, error) {
+				if rejecting.Load() {
+					return nil, fmt.Errorf("%w: 203.0.113.1 not in expect-ip", resolver.RejectedError)
+				}
+				return makeAResponse(msg, "192.0.2.1"), nil
+			},
+			ttl: 20 * time.Millisecond,
+		},
+		&testResolver{
+			acceptFn:  func(*dns.Msg) bool { return true },
+			resolveFn: func(msg *dns.Msg) (*dns.Msg, error) { return makeAResponse(msg, "192.0.2.9"), nil },
+		},
+	})
+	cacheConf := config.CacheConfig{ServeStale: time.Hour, StaleTTL: 30 * time.Second}
+	server.dnsCache = util.NewDnsCacheWithConfig(time.Minute, cacheConf)
+	server.stale = newStaleTracker(cacheConf)
+
+	query := func() string {
+		t.Helper()
+		writer := newCaptureDNSResponseWriter()
+		msg := makeQuery("example.com.", dns.TypeA)
+		server.dnsMsgHandler(&DnsWriter{writer: writer, msg: msg, start: time.Now().UnixMilli()}, msg)
+		if writer.msg == nil || len(writer.msg.Answer) != 1 {
+			t.Fatalf("response = %v, want one answer", writer.msg)
+		}
+		return writer.msg.Answer[0].(*dns.A).A.String()
+	}
+
+	query()
+	time.Sleep(40 * time.Millisecond) // let the entry expire
+	rejecting.Store(true)
+	if got := query(); got != "192.0.2.9" {
+		t.Fatalf("answer after rejection = %s, want the next resolver's 192.0.2.9, not stale", got)
+	}
+	if server.stale.recentlyFailed(util.KeyOf(makeQuery("example.com.", dns.TypeA))) {
+		t.Fatal("rejected answer recorded as an upstream failure")
+	}
+}
+
+func TestStaleTrackerDisabledWithoutServeStale(t *testing.T) {
+	if tracker := newStaleTracker(config.CacheConfig{StaleTTL: 30 * time.Second}); tracker != nil {
+		t.Fatalf("newStaleTracker() = %v, want nil without serve-stale", tracker)
+	}
+	server := newServerForTest([]resolver.DnsResolver{&testResolver{
+		acceptFn:  func(*dns.Msg) bool { return true },
+		resolveFn: func(*dns.Msg) (*dns.Msg, error) { return nil, errors.New("upstream timeout") },
+	}})
+	server.dnsCache = util.NewDnsCache(time.Minute)
+	writer := newCaptureDNSResponseWriter()
+	writer.peerAddr = &net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 5353}
+	msg := makeQuery("example.com.", dns.TypeA)
+	server.dnsMsgHandler(&DnsWriter{writer: writer, msg: msg, start: time.Now().UnixMilli()}, msg)
+	if writer.msg == nil || writer.msg.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("response = %v, want SERVFAIL", writer.msg)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// certStore serves the DoT certificate through tls.Config.GetCertificate and
+// swaps it in place when the PEM files change on disk, so a renewed certificate
+// is picked up by new handshakes without rebinding the listener. A failed
+// reload (e.g. cert rewritten before the matching key) keeps the previous
+// certificate.
+type certStore struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+func newCertStore(certFile, keyFile string) (*certStore, error) {
+	c := &certStore{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certStore) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("load tls certificate %s: %w", c.certFile, err)
+	}
+	c.cert.Store(&cert)
+	return nil
+}
+
+func (c *certStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// serverTLSConfig is the base config of every encrypted listener. The
+// certificate is looked up per handshake, so neither a renewal nor a reload that
+// hands the listener to a new server needs a rebind.
+func serverTLSConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: getCertificate,
+	}
+}
+
+// watch reloads the certificate whenever the cert or key file changes, reusing
+// the directory watcher the config file uses (survives atomic-rename renewals
+// from acme.sh/certbot). The returned func stops both watchers.
+func (c *certStore) watch() func() {
+	onChange := func(file *string) {
+		if err := c.reload(); err != nil {
+			log.Printf("tls certificate reload fail: %s", err)
+			return
+		}
+		log.Printf("tls certificate reloaded from %s", *file)
+	}
+	certFile, keyFile := c.certFile, c.keyFile
+	stopCert := watchConfigFile(&certFile, onChange)
+	stopKey := watchConfigFile(&keyFile, onChange)
+	return func() {
+		stopCert()
+		stopKey()
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"dns-switchy/config"
+	"dns-switchy/resolver"
+
+	"github.com/miekg/dns"
+)
+
+// writeTestCert writes a self-signed cert/key pair for commonName into dir and
+// returns their paths.
+func writeTestCert(t *testing.T, dir string, commonName string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key fail: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create cert fail: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key fail: %v", err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("write key fail: %v", err)
+	}
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("write cert fail: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func servedCommonName(t *testing.T, store *certStore) string {
+	t.Helper()
+	cert, err := store.getCertificate(&tls.ClientHelloInfo{})
+	if err != nil || cert == nil {
+		t.Fatalf("getCertificate fail: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("parse served cert fail: %v", err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestNewCertStoreMissingFileFails(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := newCertStore(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")); err == nil {
+		t.Fatal("newCertStore error = nil, want missing file error")
+	}
+}
+
+func TestCertStoreWatchReloadsRenewedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "old.example")
+	store, err := newCertStore(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertStore fail: %v", err)
+	}
+	stop := store.watch()
+	t.Cleanup(stop)
+
+	if got := servedCommonName(t, store); got != "old.example" {
+		t.Fatalf("served CN = %q, want old.example", got)
+	}
+	writeTestCert(t, dir, "new.example")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for servedCommonName(t, store) != "new.example" {
+		if time.Now().After(deadline) {
+			t.Fatal("renewed certificate was not picked up")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestStartServesDoT(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "dot.example")
+	tlsAddr := reserveUDPAddr(t)
+	server, err := Create(&config.SwitchyConfig{
+		Addr: reserveUDPAddr(t),
+		TLS:  &config.TLSConfig{Addr: tlsAddr, Cert: certFile, Key: keyFile},
+	})
+	if err != nil {
+		t.Fatalf("Create fail: %v", err)
+	}
+	server.installGen([]resolver.DnsResolver{&testResolver{
+		acceptFn:  func(*dns.Msg) bool { return true },
+		resolveFn: func(msg *dns.Msg) (*dns.Msg, error) { return makeAResponse(msg, "192.0.2.53"), nil },
+	}})
+	server.Start()
+	t.Cleanup(server.Shutdown)
+
+	client := &dns.Client{Net: "tcp-tls", Timeout: time.Second, TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	var resp *dns.Msg
+	for range 20 {
+		resp, _, err = client.Exchange(makeQuery("dot.example.", dns.TypeA), tlsAddr)
+		if err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("DoT exchange fail: %v", err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("answer count = %d, want 1", len(resp.Answer))
+	}
+}
@@ -1,21 +1,134 @@
 package util
 
 import (
-	"github.com/XGFan/go-utils"
-	"github.com/miekg/dns"
+	"container/heap"
+	"container/list"
 	"log"
+	"maps"
+	"net/netip"
 	"sync"
 	"time"
+
+	"dns-switchy/config"
+
+	"github.com/miekg/dns"
 )
 
 type Cache interface {
-	Set(q dns.Question, msg dns.Msg, ttl time.Duration)
-	Get(q dns.Question) dns.Msg
+	Set(key CacheKey, msg dns.Msg, ttl time.Duration)
+	Get(key CacheKey) dns.Msg
 	// Clear drops all cached entries. Used after a resolver swap so stale
 	// routing decisions are not masked by previously cached answers.
 	Clear()
 }
 
+// CacheKey is what answers are cached under: the question plus the request
+// bits that change the answer. A query with DNSSEC OK gets RRSIGs a plain one
+// must not be handed and vice versa, Checking Disabled gets answers a
+// validating upstream would have refused, and an EDNS Client Subnet query
+// gets an answer tailored to that subnet.
+type CacheKey struct {
+	dns.Question
+	DO  bool   `json:"do,omitempty"`
+	CD  bool   `json:"cd,omitempty"`
+	ECS string `json:"ecs,omitempty"` // client subnet as a prefix, e.g. 192.0.2.0/24
+}
+
+// QuestionKey is the key for q asked without DO, CD or ECS.
+func QuestionKey(q dns.Question) CacheKey {
+	return CacheKey{Question: q}
+}
+
+// KeyOf is the cache key for msg, which must carry one question.
+func KeyOf(msg *dns.Msg) CacheKey {
+	key := CacheKey{Question: msg.Question[0], CD: msg.CheckingDisabled}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return key
+	}
+	key.DO = opt.Do()
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			key.ECS = subnetKey(subnet)
+		}
+	}
+	return key
+}
+
+// subnetKey masks the client address to its source prefix length, so two
+// clients sending the same subnet share an entry.
+func subnetKey(subnet *dns.EDNS0_SUBNET) string {
+	addr, ok := netip.AddrFromSlice(subnet.Address)
+	if !ok {
+		return subnet.String()
+	}
+	if subnet.Family == 1 {
+		addr = addr.Unmap()
+	}
+	prefix, err := addr.Prefix(int(subnet.SourceNetmask))
+	if err != nil {
+		return subnet.String()
+	}
+	return prefix.String()
+}
+
+// StaleCache is implemented by caches that keep expired entries around for
+// serve-stale (RFC 8767). GetStale returns an entry that has expired but is
+// still within the stale window, with every TTL rewritten to the stale TTL.
+type StaleCache interface {
+	GetStale(key CacheKey) (dns.Msg, bool)
+}
+
+// PrefetchCache is implemented by caches that pick popular entries to refresh
+// before they expire. GetPrefetch is Get that also reports whether the caller
+// should refresh key in the background now; it says so at most once per entry.
+type PrefetchCache interface {
+	GetPrefetch(key CacheKey) (dns.Msg, bool)
+}
+
+// OwnedCache is implemented by caches that remember which resolver produced
+// each entry, so a snapshot can drop entries whose resolver is gone. OwnerHits
+// counts the hits on entries of each owner since the cache was created.
+type OwnedCache interface {
+	SetFrom(key CacheKey, msg dns.Msg, ttl time.Duration, owner string)
+	OwnerHits() map[string]uint64
+}
+
+// PersistentCache is implemented by caches that can be written to a snapshot
+// and filled back from one. Records lists the entries most recently used
+// first; Restore inserts the ones still within the stale window whose owner
+// passes keep, and returns how many it kept.
+type PersistentCache interface {
+	Records() []CacheRecord
+	Restore(records []CacheRecord, keep func(owner string) bool) int
+}
+
+// InspectableCache is implemented by caches whose entries can be listed and
+// removed one by one. Entries skips entries past the stale window; Delete
+// removes every entry whose key matches and returns how many it removed.
+type InspectableCache interface {
+	Entries() []CacheEntryInfo
+	Delete(match func(key CacheKey) bool) int
+}
+
+type CacheEntryInfo struct {
+	Key   CacheKey
+	Owner string
+	// Remaining is the time left until expiry; zero or negative for an expired
+	// entry kept for serve-stale.
+	Remaining time.Duration
+}
+
+// CacheRecord is one cache entry in a snapshot, with the message in wire
+// format.
+type CacheRecord struct {
+	Key    CacheKey  `json:"key"`
+	Msg    []byte    `json:"msg"`
+	Owner  string    `json:"owner,omitempty"`
+	Stored time.Time `json:"stored"`
+	Expire time.Time `json:"expire"`
+}
+
 var None = dns.Msg{}
 
 type NoCache struct {
@@ -24,51 +137,407 @@ type NoCache struct {
 func (n NoCache) Close() {
 }
 
-func (n NoCache) Set(_ dns.Question, _ dns.Msg, _ time.Duration) {
+func (n NoCache) Set(_ CacheKey, _ dns.Msg, _ time.Duration) {
 }
 
-func (n NoCache) Get(_ dns.Question) dns.Msg {
+func (n NoCache) Get(_ CacheKey) dns.Msg {
 	return None
 }
 
 func (n NoCache) Clear() {
 }
 
-// dnsCache wraps go-utils.TTLCache to add a concurrency-safe Clear(). The
-// underlying TTLCache stores its data in an unexported field, so Clear()
-// rebuilds the inner cache under a write lock rather than mutating it in place.
-// An RWMutex guards Get/Set (read lock) against Clear (write lock).
+// StatsCache is implemented by caches that report their size and counters.
+type StatsCache interface {
+	Stats() CacheStats
+}
+
+type CacheStats struct {
+	Entries    int    `json:"entries"`
+	Bytes      int    `json:"bytes"`
+	MaxEntries int    `json:"maxEntries"` // 0 = unbounded
+	MaxBytes   int    `json:"maxBytes"`   // 0 = unbounded
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+	Evicted    uint64 `json:"evicted"`    // dropped to stay within the limits
+	Expired    uint64 `json:"expired"`    // dropped by the sweep after expiry
+	Prefetched uint64 `json:"prefetched"` // refreshes handed out by GetPrefetch
+}
+
+type cacheEntry struct {
+	key    CacheKey
+	msg    dns.Msg
+	size   int    // approximate wire size, counted against MaxBytes
+	owner  string // resolver that produced msg; empty when unknown
+	stored time.Time
+	expire time.Time
+	hits   int  // since stored, i.e. within the current lifetime
+	due    bool // prefetch already handed out for this entry
+	index  int  // position in dnsCache.expiry
+}
+
+// expiryHeap orders cache entries by expiry, soonest first, so a sweep only
+// touches the entries it drops.
+type expiryHeap []*cacheEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expire.Before(h[j].expire) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *expiryHeap) Push(x any) {
+	entry := x.(*cacheEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// dnsCache is a TTL cache keyed by CacheKey, bounded as an LRU by entry count
+// and approximate wire size (conf.MaxEntries, conf.MaxBytes): a Set that goes
+// over either limit evicts the least recently used entries. Expired entries
+// are kept for conf.ServeStale past their expiry so GetStale can answer while
+// upstream is down; Get never returns them. Each Get drops the entries past
+// that window, soonest expiry first (see expiryHeap). With conf.UpstreamTTL the answer's own TTLs
+// decide the lifetime and count down while the entry sits in the cache. With
+// conf.Prefetch an entry hit at least conf.PrefetchHits times is handed out
+// for refresh once it is in the last conf.Prefetch percent of its lifetime;
+// the refreshed answer replaces it with a fresh count.
 type dnsCache struct {
-	mu    sync.RWMutex
-	ttl   time.Duration
-	inner *utils.TTLCache[dns.Question, dns.Msg]
+	ttl  time.Duration
+	conf config.CacheConfig
+	now  func() time.Time
+
+	mu         sync.Mutex
+	entries    map[CacheKey]*list.Element // of *cacheEntry
+	lru        *list.List                 // front = most recently used
+	expiry     expiryHeap
+	bytes      int
+	hits       uint64
+	misses     uint64
+	evicted    uint64
+	expired    uint64
+	prefetched uint64
+	ownerHits  map[string]uint64
+}
+
+// Set stores msg for ttl, or for the cache's default ttl when ttl is zero. A
+// negative ttl is not cached. In upstream-ttl mode a non-negative ttl is
+// replaced by the lifetime the answer records carry; a message without any
+// (a negative answer) keeps the ttl it was given.
+func (c *dnsCache) Set(key CacheKey, msg dns.Msg, ttl time.Duration) {
+	c.SetFrom(key, msg, ttl, "")
+}
+
+// SetFrom is Set recording owner as the resolver that produced msg.
+func (c *dnsCache) SetFrom(key CacheKey, msg dns.Msg, ttl time.Duration, owner string) {
+	if ttl == 0 {
+		ttl = c.ttl
+	}
+	if c.conf.UpstreamTTL && ttl >= 0 && len(msg.Answer) > 0 {
+		ttl = c.answerTTL(&msg)
+	}
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	c.insert(&cacheEntry{key: key, msg: msg, size: msg.Len(), owner: owner, stored: now, expire: now.Add(ttl)})
+}
+
+// insert makes entry the most recently used one, replacing any entry for the
+// same key, and evicts from the back until the cache is within limits.
+func (c *dnsCache) insert(entry *cacheEntry) {
+	if elem, ok := c.entries[entry.key]; ok {
+		c.remove(elem)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	heap.Push(&c.expiry, entry)
+	c.bytes += entry.size
+	for c.overLimit() {
+		c.remove(c.lru.Back())
+		c.evicted++
+	}
+}
+
+func (c *dnsCache) overLimit() bool {
+	return c.lru.Len() > 0 &&
+		(c.conf.MaxEntries > 0 && c.lru.Len() > c.conf.MaxEntries ||
+			c.conf.MaxBytes > 0 && c.bytes > c.conf.MaxBytes)
 }
 
-func (c *dnsCache) Set(q dns.Question, msg dns.Msg, ttl time.Duration) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	c.inner.Set(q, msg, ttl)
+func (c *dnsCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	heap.Remove(&c.expiry, entry.index)
+	c.bytes -= entry.size
 }
 
-func (c *dnsCache) Get(q dns.Question) dns.Msg {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	return c.inner.Get(q)
+// answerTTL is the smallest TTL among the answer records, clamped to
+// [MinTTL, MaxTTL].
+func (c *dnsCache) answerTTL(msg *dns.Msg) time.Duration {
+	ttl := time.Duration(-1)
+	for _, rr := range msg.Answer {
+		if t := time.Duration(rr.Header().Ttl) * time.Second; ttl < 0 || t < ttl {
+			ttl = t
+		}
+	}
+	ttl = max(ttl, c.conf.MinTTL)
+	if c.conf.MaxTTL > 0 {
+		ttl = min(ttl, c.conf.MaxTTL)
+	}
+	return ttl
+}
+
+func (c *dnsCache) Get(key CacheKey) dns.Msg {
+	msg, _ := c.get(key, false)
+	return msg
+}
+
+func (c *dnsCache) GetPrefetch(key CacheKey) (dns.Msg, bool) {
+	return c.get(key, true)
+}
+
+func (c *dnsCache) get(key CacheKey, prefetch bool) (dns.Msg, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	c.sweep(now)
+	elem, ok := c.entries[key]
+	if !ok || !now.Before(elem.Value.(*cacheEntry).expire) {
+		c.misses++
+		return None, false
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+	entry := elem.Value.(*cacheEntry)
+	entry.hits++
+	if entry.owner != "" {
+		c.ownerHits[entry.owner]++
+	}
+	due := prefetch && c.prefetchDue(entry, now)
+	if due {
+		entry.due = true
+		c.prefetched++
+	}
+	if c.conf.UpstreamTTL {
+		return *ageRecords(&entry.msg, now.Sub(entry.stored)), due
+	}
+	return entry.msg, due
+}
+
+// prefetchDue reports whether a popular entry has entered the last
+// conf.Prefetch percent of its lifetime and was not handed out yet.
+func (c *dnsCache) prefetchDue(entry *cacheEntry, now time.Time) bool {
+	if c.conf.Prefetch <= 0 || entry.due || entry.hits < c.conf.PrefetchHits {
+		return false
+	}
+	return entry.expire.Sub(now)*100 <= entry.expire.Sub(entry.stored)*time.Duration(c.conf.Prefetch)
+}
+
+// ageRecords returns a copy of msg with age taken off every record TTL, so a
+// client does not cache an answer longer than upstream allowed. A record whose
+// TTL is shorter than a min-ttl stretched entry goes down to 0.
+func ageRecords(msg *dns.Msg, age time.Duration) *dns.Msg {
+	aged := msg.Copy()
+	elapsed := uint32(age / time.Second)
+	for _, section := range [][]dns.RR{aged.Answer, aged.Ns, aged.Extra} {
+		for _, rr := range section {
+			if h := rr.Header(); h.Rrtype != dns.TypeOPT {
+				h.Ttl -= min(h.Ttl, elapsed)
+			}
+		}
+	}
+	return aged
+}
+
+func (c *dnsCache) GetStale(key CacheKey) (dns.Msg, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return None, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !c.now().Before(entry.expire.Add(c.conf.ServeStale)) {
+		return None, false
+	}
+	c.lru.MoveToFront(elem)
+	stale := entry.msg.Copy()
+	ttl := uint32(c.conf.StaleTTL.Seconds())
+	for _, section := range [][]dns.RR{stale.Answer, stale.Ns, stale.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = ttl
+			}
+		}
+	}
+	return *stale, true
 }
 
 func (c *dnsCache) Clear() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.inner = utils.NewTTlCache[dns.Question, dns.Msg](c.ttl)
+	c.entries = make(map[CacheKey]*list.Element)
+	c.lru.Init()
+	c.expiry = nil
+	c.bytes = 0
+}
+
+func (c *dnsCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Entries:    c.lru.Len(),
+		Bytes:      c.bytes,
+		MaxEntries: c.conf.MaxEntries,
+		MaxBytes:   c.conf.MaxBytes,
+		Hits:       c.hits,
+		Misses:     c.misses,
+		Evicted:    c.evicted,
+		Expired:    c.expired,
+		Prefetched: c.prefetched,
+	}
+}
+
+func (c *dnsCache) OwnerHits() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return maps.Clone(c.ownerHits)
+}
+
+func (c *dnsCache) Entries() []CacheEntryInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	infos := make([]CacheEntryInfo, 0, c.lru.Len())
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*cacheEntry)
+		if !now.Before(entry.expire.Add(c.conf.ServeStale)) {
+			continue
+		}
+		infos = append(infos, CacheEntryInfo{Key: entry.key, Owner: entry.owner, Remaining: entry.expire.Sub(now)})
+	}
+	return infos
+}
+
+func (c *dnsCache) Delete(match func(key CacheKey) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	deleted := 0
+	for key, elem := range c.entries {
+		if match(key) {
+			c.remove(elem)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+func (c *dnsCache) Records() []CacheRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	records := make([]CacheRecord, 0, c.lru.Len())
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*cacheEntry)
+		wire, err := entry.msg.Pack()
+		if err != nil {
+			continue
+		}
+		records = append(records, CacheRecord{
+			Key:    entry.key,
+			Msg:    wire,
+			Owner:  entry.owner,
+			Stored: entry.stored,
+			Expire: entry.expire,
+		})
+	}
+	return records
+}
+
+func (c *dnsCache) Restore(records []CacheRecord, keep func(owner string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	restored := 0
+	// Insert least recently used first so the snapshot's LRU order survives.
+	for i := len(records) - 1; i >= 0; i-- {
+		record := records[i]
+		if !now.Before(record.Expire.Add(c.conf.ServeStale)) || !keep(record.Owner) {
+			continue
+		}
+		var msg dns.Msg
+		if err := msg.Unpack(record.Msg); err != nil {
+			log.Printf("restore cache entry %s: %s", record.Key.Name, err)
+			continue
+		}
+		c.insert(&cacheEntry{
+			key:    record.Key,
+			msg:    msg,
+			size:   msg.Len(),
+			owner:  record.Owner,
+			stored: record.Stored,
+			expire: record.Expire,
+		})
+		restored++
+	}
+	return restored
+}
+
+// sweep drops the entries past their serve-stale window. The work is
+// proportional to what it drops, so it can run on every Get.
+func (c *dnsCache) sweep(now time.Time) {
+	for len(c.expiry) > 0 && !now.Before(c.expiry[0].expire.Add(c.conf.ServeStale)) {
+		c.remove(c.entries[c.expiry[0].key])
+		c.expired++
+	}
+}
+
+// NegativeTTL is how long an NXDOMAIN or NODATA response may be cached
+// (RFC 2308 §5): the smaller of the authority SOA's TTL and its MINIMUM,
+// capped at limit. ok is false for other responses and for negative ones
+// without an SOA, which must not be cached.
+func NegativeTTL(msg *dns.Msg, limit time.Duration) (ttl time.Duration, ok bool) {
+	negative := msg.Rcode == dns.RcodeNameError || msg.Rcode == dns.RcodeSuccess && len(msg.Answer) == 0
+	if !negative || limit <= 0 {
+		return 0, false
+	}
+	for _, rr := range msg.Ns {
+		if soa, isSOA := rr.(*dns.SOA); isSOA {
+			ttl = time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second
+			return min(ttl, limit), ttl > 0
+		}
+	}
+	return 0, false
 }
 
 func NewDnsCache(ttl time.Duration) Cache {
-	if ttl == 0 {
+	return NewDnsCacheWithConfig(ttl, config.CacheConfig{})
+}
+
+// NewDnsCacheWithConfig is NewDnsCache with the `cache:` block applied. In
+// upstream-ttl mode the answers carry their own lifetime, so a zero ttl does
+// not disable the cache.
+func NewDnsCacheWithConfig(ttl time.Duration, conf config.CacheConfig) Cache {
+	if ttl == 0 && !conf.UpstreamTTL {
 		log.Println("cache is disabled")
 		return &NoCache{}
 	}
 	return &dnsCache{
-		ttl:   ttl,
-		inner: utils.NewTTlCache[dns.Question, dns.Msg](ttl),
+		ttl:       ttl,
+		conf:      conf,
+		now:       time.Now,
+		entries:   make(map[CacheKey]*list.Element),
+		lru:       list.New(),
+		ownerHits: make(map[string]uint64),
 	}
 }
@@ -1,10 +1,14 @@
 package util
 
 import (
+	"fmt"
+	"net"
 	"sync"
 	"testing"
 	"time"
 
+	"dns-switchy/config"
+
 	"github.com/miekg/dns"
 )
 
@@ -18,7 +22,7 @@ func TestNewDnsCacheZeroTTLReturnsNoCache(t *testing.T) {
 
 func TestNoCacheIgnoresSetAndReturnsMiss(t *testing.T) {
 	cache := NoCache{}
-	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	q := QuestionKey(dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
 	msg := dns.Msg{}
 	msg.SetQuestion(q.Name, q.Qtype)
 	rr, err := dns.NewRR("example.com. 60 IN A 203.0.113.10")
@@ -38,7 +42,7 @@ func TestNoCacheIgnoresSetAndReturnsMiss(t *testing.T) {
 func TestDnsCacheStoresAndExpiresEntry(t *testing.T) {
 	ttl := 25 * time.Millisecond
 	cache := NewDnsCache(ttl)
-	q := dns.Question{Name: "example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	q := QuestionKey(dns.Question{Name: "example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
 	msg := dns.Msg{}
 	msg.SetQuestion(q.Name, q.Qtype)
 	rr, err := dns.NewRR("example.org. 60 IN A 198.51.100.7")
@@ -50,7 +54,7 @@ func TestDnsCacheStoresAndExpiresEntry(t *testing.T) {
 	cache.Set(q, msg, ttl)
 
 	got := cache.Get(q)
-	if len(got.Question) != 1 || got.Question[0] != q {
+	if len(got.Question) != 1 || got.Question[0] != q.Question {
 		t.Fatalf("cache.Get() before expiry question = %+v, want %+v", got.Question, msg.Question)
 	}
 	if len(got.Answer) != 1 || got.Answer[0].Header().Name != rr.Header().Name {
@@ -67,7 +71,7 @@ func TestDnsCacheStoresAndExpiresEntry(t *testing.T) {
 
 func TestDnsCacheClearInvalidatesHits(t *testing.T) {
 	cache := NewDnsCache(time.Minute)
-	q := dns.Question{Name: "clear.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	q := QuestionKey(dns.Question{Name: "clear.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
 	msg := dns.Msg{}
 	msg.SetQuestion(q.Name, q.Qtype)
 
@@ -107,8 +111,8 @@ func TestDnsCacheConcurrentGetSetClear(t *testing.T) {
 		}
 	}
 
-	mkQ := func() dns.Question {
-		return dns.Question{Name: "race.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	mkQ := func() CacheKey {
+		return QuestionKey(dns.Question{Name: "race.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
 	}
 
 	wg.Add(3)
@@ -128,3 +132,378 @@ func TestDnsCacheConcurrentGetSetClear(t *testing.T) {
 	close(stop)
 	wg.Wait()
 }
+
+func TestDnsCacheServesStaleWithinWindow(t *testing.T) {
+	cache := NewDnsCacheWithConfig(time.Minute, config.CacheConfig{ServeStale: time.Hour, StaleTTL: 30 * time.Second}).(*dnsCache)
+	now := time.Unix(1700000000, 0)
+	cache.now = func() time.Time { return now }
+	q := QuestionKey(dns.Question{Name: "stale.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	msg := dns.Msg{}
+	msg.SetQuestion(q.Name, q.Qtype)
+	rr, err := dns.NewRR("stale.example. 300 IN A 198.51.100.7")
+	if err != nil {
+		t.Fatalf("dns.NewRR() error = %v", err)
+	}
+	msg.Answer = []dns.RR{rr}
+	cache.Set(q, msg, time.Minute)
+
+	if _, ok := cache.GetStale(QuestionKey(dns.Question{Name: "other.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET})); ok {
+		t.Fatal("GetStale(unknown) ok = true, want miss")
+	}
+
+	now = now.Add(30 * time.Minute)
+	if got := cache.Get(q); len(got.Answer) != 0 {
+		t.Fatalf("Get() after expiry = %+v, want miss", got)
+	}
+	stale, ok := cache.GetStale(q)
+	if !ok || len(stale.Answer) != 1 || stale.Answer[0].Header().Ttl != 30 {
+		t.Fatalf("GetStale() = %+v, %v, want the answer with TTL 30", stale.Answer, ok)
+	}
+	if rr.Header().Ttl != 300 {
+		t.Fatalf("GetStale() rewrote the cached record TTL to %d", rr.Header().Ttl)
+	}
+
+	now = now.Add(31 * time.Minute)
+	if _, ok := cache.GetStale(q); ok {
+		t.Fatal("GetStale() past the stale window ok = true, want miss")
+	}
+	cache.Get(q)
+	if len(cache.entries) != 0 {
+		t.Fatalf("entries after sweep = %d, want 0", len(cache.entries))
+	}
+
+	// Without serve-stale an expired entry is gone for good.
+	plain := NewDnsCache(time.Minute).(*dnsCache)
+	plain.now = func() time.Time { return now }
+	plain.Set(q, msg, time.Minute)
+	now = now.Add(2 * time.Minute)
+	if _, ok := plain.GetStale(q); ok {
+		t.Fatal("GetStale() without serve-stale ok = true, want miss")
+	}
+}
+
+func TestDnsCacheUpstreamTTL(t *testing.T) {
+	cache := NewDnsCacheWithConfig(time.Hour, config.CacheConfig{UpstreamTTL: true, MinTTL: 10 * time.Second, MaxTTL: time.Hour}).(*dnsCache)
+	now := time.Unix(1700000000, 0)
+	cache.now = func() time.Time { return now }
+	set := func(name string, ttl time.Duration, records ...string) CacheKey {
+		t.Helper()
+		q := QuestionKey(dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		msg := dns.Msg{}
+		msg.SetQuestion(q.Name, q.Qtype)
+		for _, record := range records {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				t.Fatalf("dns.NewRR(%q) error = %v", record, err)
+			}
+			msg.Answer = append(msg.Answer, rr)
+		}
+		cache.Set(q, msg, ttl)
+		return q
+	}
+
+	// The resolver's static ttl is ignored; the smallest record TTL decides.
+	cname := set("www.example.", 10*time.Minute, "www.example. 300 IN CNAME cdn.example.", "cdn.example. 120 IN A 198.51.100.7")
+	short := set("short.example.", 0, "short.example. 2 IN A 198.51.100.8")
+	long := set("long.example.", 0, "long.example. 604800 IN A 198.51.100.9")
+	disabled := set("off.example.", -time.Second, "off.example. 300 IN A 198.51.100.10")
+	for q, want := range map[CacheKey]time.Duration{cname: 120 * time.Second, short: 10 * time.Second, long: time.Hour} {
+		if got := cache.entries[q].Value.(*cacheEntry).expire.Sub(now); got != want {
+			t.Errorf("%s lifetime = %s, want %s", q.Name, got, want)
+		}
+	}
+	if _, ok := cache.entries[disabled]; ok {
+		t.Error("entry cached despite a negative resolver ttl")
+	}
+
+	now = now.Add(5500 * time.Millisecond)
+	got := cache.Get(cname)
+	if len(got.Answer) != 2 || got.Answer[0].Header().Ttl != 295 || got.Answer[1].Header().Ttl != 115 {
+		t.Fatalf("Get() TTLs = %v, want 295 and 115 after 5s in cache", got.Answer)
+	}
+	if got = cache.Get(short); len(got.Answer) != 1 || got.Answer[0].Header().Ttl != 0 {
+		t.Fatalf("Get() stretched record = %v, want TTL floored at 0", got.Answer)
+	}
+	if got = cache.Get(cname); got.Answer[0].Header().Ttl != 295 {
+		t.Fatalf("second Get() TTL = %d, want the stored entry left untouched", got.Answer[0].Header().Ttl)
+	}
+
+	now = now.Add(115 * time.Second)
+	if got = cache.Get(cname); len(got.Answer) != 0 {
+		t.Fatalf("Get() after the record TTL = %v, want miss", got.Answer)
+	}
+}
+
+func TestNewDnsCacheUpstreamTTLWithoutDefaultTTL(t *testing.T) {
+	cache := NewDnsCacheWithConfig(0, config.CacheConfig{UpstreamTTL: true})
+	q := QuestionKey(dns.Question{Name: "example.net.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	msg := dns.Msg{}
+	msg.SetQuestion(q.Name, q.Qtype)
+	rr, err := dns.NewRR("example.net. 60 IN A 203.0.113.1")
+	if err != nil {
+		t.Fatalf("dns.NewRR() error = %v", err)
+	}
+	msg.Answer = []dns.RR{rr}
+	cache.Set(q, msg, 0)
+	if got := cache.Get(q); len(got.Answer) != 1 {
+		t.Fatalf("Get() = %+v, want the answer cached for its own TTL", got)
+	}
+}
+
+func TestNegativeTTL(t *testing.T) {
+	soa := func(ttl, minttl uint32) []dns.RR {
+		return []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl}, Minttl: minttl}}
+	}
+	answer, err := dns.NewRR("example. 60 IN A 192.0.2.1")
+	if err != nil {
+		t.Fatalf("dns.NewRR() error = %v", err)
+	}
+	tests := []struct {
+		name   string
+		msg    dns.Msg
+		limit  time.Duration
+		want   time.Duration
+		wantOK bool
+	}{
+		{"nxdomain", dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}, Ns: soa(900, 60)}, time.Hour, time.Minute, true},
+		{"nodata", dns.Msg{Ns: soa(30, 60)}, time.Hour, 30 * time.Second, true},
+		{"capped", dns.Msg{Ns: soa(900, 900)}, 5 * time.Minute, 5 * time.Minute, true},
+		{"zero soa ttl", dns.Msg{Ns: soa(0, 60)}, time.Hour, 0, false},
+		{"no soa", dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}}, time.Hour, 0, false},
+		{"positive", dns.Msg{Answer: []dns.RR{answer}, Ns: soa(900, 60)}, time.Hour, 0, false},
+		{"servfail", dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}, Ns: soa(900, 60)}, time.Hour, 0, false},
+		{"disabled", dns.Msg{Ns: soa(900, 60)}, 0, 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := NegativeTTL(&tt.msg, tt.limit); got != tt.want || ok != tt.wantOK {
+			t.Errorf("%s: NegativeTTL() = %s, %v, want %s, %v", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	// In upstream-ttl mode a negative entry keeps the ttl it was stored with
+	// and its SOA counts down like any record.
+	cache := NewDnsCacheWithConfig(time.Hour, config.CacheConfig{UpstreamTTL: true, MinTTL: 10 * time.Minute}).(*dnsCache)
+	now := time.Unix(1700000000, 0)
+	cache.now = func() time.Time { return now }
+	q := QuestionKey(dns.Question{Name: "missing.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	cache.Set(q, dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}, Question: []dns.Question{q.Question}, Ns: soa(900, 60)}, time.Minute)
+	now = now.Add(10 * time.Second)
+	if got := cache.Get(q); got.Rcode != dns.RcodeNameError || len(got.Ns) != 1 || got.Ns[0].Header().Ttl != 890 {
+		t.Fatalf("Get() = %+v, want the NXDOMAIN with its SOA aged by 10s", got)
+	}
+	now = now.Add(time.Minute)
+	if got := cache.Get(q); got.Rcode != dns.RcodeSuccess || len(got.Question) != 0 {
+		t.Fatalf("Get() after the negative ttl = %+v, want miss", got)
+	}
+}
+
+func TestDnsCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	msgFor := func(name string) (CacheKey, dns.Msg) {
+		q := QuestionKey(dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		msg := dns.Msg{}
+		msg.SetQuestion(q.Name, q.Qtype)
+		rr, err := dns.NewRR(name + " 60 IN A 192.0.2.1")
+		if err != nil {
+			t.Fatalf("dns.NewRR() error = %v", err)
+		}
+		msg.Answer = []dns.RR{rr}
+		return q, msg
+	}
+	hit := func(c Cache, q CacheKey) bool {
+		return len(c.Get(q).Answer) == 1
+	}
+
+	cache := NewDnsCacheWithConfig(time.Minute, config.CacheConfig{MaxEntries: 2})
+	a, msgA := msgFor("a.example.")
+	b, msgB := msgFor("b.example.")
+	c, msgC := msgFor("c.example.")
+	cache.Set(a, msgA, 0)
+	cache.Set(b, msgB, 0)
+	cache.Get(a) // a is now more recently used than b
+	cache.Set(c, msgC, 0)
+	if !hit(cache, a) || hit(cache, b) || !hit(cache, c) {
+		t.Fatalf("after the third Set: a %v b %v c %v, want b evicted", hit(cache, a), hit(cache, b), hit(cache, c))
+	}
+	cache.Set(c, msgC, 0) // replacing an entry does not evict
+	stats := cache.(StatsCache).Stats()
+	if stats.Entries != 2 || stats.Evicted != 1 || stats.Bytes != msgA.Len()+msgC.Len() {
+		t.Fatalf("Stats() = %+v, want 2 entries, 1 eviction, %d bytes", stats, msgA.Len()+msgC.Len())
+	}
+	if stats.Hits != 3 || stats.Misses != 1 {
+		t.Fatalf("Stats() hits %d misses %d, want 3 and 1", stats.Hits, stats.Misses)
+	}
+
+	// A byte limit that fits two answers.
+	sized := NewDnsCacheWithConfig(time.Minute, config.CacheConfig{MaxBytes: msgA.Len() + msgB.Len()})
+	sized.Set(a, msgA, 0)
+	sized.Set(b, msgB, 0)
+	sized.Set(c, msgC, 0)
+	if hit(sized, a) || !hit(sized, b) || !hit(sized, c) {
+		t.Fatal("byte-bounded cache did not evict the oldest entry")
+	}
+
+	sized.Clear()
+	if stats := sized.(StatsCache).Stats(); stats.Entries != 0 || stats.Bytes != 0 {
+		t.Fatalf("Stats() after Clear = %+v, want empty", stats)
+	}
+}
+
+func TestDnsCacheSweepCountsExpired(t *testing.T) {
+	cache := NewDnsCache(time.Minute).(*dnsCache)
+	now := time.Unix(1700000000, 0)
+	cache.now = func() time.Time { return now }
+	q := QuestionKey(dns.Question{Name: "gone.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	msg := dns.Msg{}
+	msg.SetQuestion(q.Name, q.Qtype)
+	cache.Set(q, msg, time.Minute)
+	now = now.Add(2 * time.Minute)
+	cache.Get(QuestionKey(dns.Question{Name: "other.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}))
+	if stats := cache.Stats(); stats.Entries != 0 || stats.Expired != 1 || stats.Bytes != 0 {
+		t.Fatalf("Stats() = %+v, want the expired entry swept", stats)
+	}
+
+	// Only what expired is dropped, soonest first, whatever the insert order;
+	// a replaced entry expires on its new lifetime.
+	key := func(name string) CacheKey {
+		return QuestionKey(dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	}
+	for i, ttl := range []time.Duration{5 * time.Minute, time.Minute, 3 * time.Minute, 2 * time.Minute} {
+		cache.Set(key(fmt.Sprintf("n%d.example.", i)), msg, ttl)
+	}
+	cache.Set(key("n1.example."), msg, 10*time.Minute)
+	cache.Set(key("n3.example."), msg, time.Minute)
+	now = now.Add(150 * time.Second)
+	cache.Get(key("other.example."))
+	if len(cache.entries) != 3 || len(cache.expiry) != 3 || cache.Stats().Expired != 2 {
+		t.Fatalf("after sweep %d entries, %d in expiry, %d expired; want 3, 3 and 2", len(cache.entries), len(cache.expiry), cache.Stats().Expired)
+	}
+	if _, ok := cache.entries[key("n3.example.")]; ok {
+		t.Fatal("replaced entry kept past its new lifetime")
+	}
+}
+
+func TestDnsCacheRecordsRestore(t *testing.T) {
+	msgFor := func(name string) (CacheKey, dns.Msg) {
+		q := QuestionKey(dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		msg := dns.Msg{}
+		msg.SetQuestion(q.Name, q.Qtype)
+		rr, err := dns.NewRR(name + " 60 IN A 192.0.2.1")
+		if err != nil {
+			t.Fatalf("dns.NewRR() error = %v", err)
+		}
+		msg.Answer = []dns.RR{rr}
+		return q, msg
+	}
+	now := time.Unix(1700000000, 0)
+	source := NewDnsCacheWithConfig(time.Minute, config.CacheConfig{}).(*dnsCache)
+	source.now = func() time.Time { return now }
+	a, msgA := msgFor("a.example.")
+	b, msgB := msgFor("b.example.")
+	c, msgC := msgFor("c.example.")
+	source.SetFrom(a, msgA, 0, "proxy")
+	source.SetFrom(b, msgB, 0, "gone")
+	source.SetFrom(c, msgC, 2*time.Minute, "proxy")
+	source.Get(a) // LRU order is now a, c, b
+	source.Set(QuestionKey(dns.Question{Name: "d.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}), msgA, 0)
+	source.Get(QuestionKey(dns.Question{Name: "d.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}))
+	if hits := source.OwnerHits(); len(hits) != 1 || hits["proxy"] != 1 {
+		t.Fatalf("OwnerHits() = %v, want proxy: 1 (entries without owner not counted)", hits)
+	}
+	source.Delete(func(key CacheKey) bool { return key.Name == "d.example." })
+
+	records := source.Records()
+	if len(records) != 3 || records[0].Key != a || records[1].Key != c || records[0].Owner != "proxy" {
+		t.Fatalf("Records() = %+v, want a, c, b most recently used first", records)
+	}
+
+	// 90s later a has expired; b's resolver no longer exists.
+	target := NewDnsCacheWithConfig(time.Minute, config.CacheConfig{MaxEntries: 10}).(*dnsCache)
+	target.now = func() time.Time { return now.Add(90 * time.Second) }
+	if n := target.Restore(records, func(owner string) bool { return owner == "proxy" }); n != 1 {
+		t.Fatalf("Restore() = %d, want 1", n)
+	}
+	if got := target.Get(c); len(got.Answer) != 1 || got.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("Get(c) = %v, want the restored answer", got)
+	}
+	if got := target.Get(a); len(got.Answer) != 0 {
+		t.Fatalf("Get(a) = %v, want expired entry dropped", got)
+	}
+	if entry := target.entries[c].Value.(*cacheEntry); entry.owner != "proxy" || !entry.expire.Equal(now.Add(2*time.Minute)) {
+		t.Fatalf("restored entry owner %q expire %s, want proxy and the original expiry", entry.owner, entry.expire)
+	}
+}
+
+func TestDnsCachePrefetchPopularEntries(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	cache := NewDnsCacheWithConfig(100*time.Second, config.CacheConfig{Prefetch: 10, PrefetchHits: 2}).(*dnsCache)
+	cache.now = func() time.Time { return now }
+	popular := QuestionKey(dns.Question{Name: "popular.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	rare := QuestionKey(dns.Question{Name: "rare.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	msg := dns.Msg{}
+	msg.SetQuestion(popular.Name, dns.TypeA)
+	cache.Set(popular, msg, 0)
+	cache.Set(rare, msg, 0)
+
+	for _, step := range []struct {
+		at   time.Duration
+		q    CacheKey
+		want bool
+	}{
+		{50 * time.Second, popular, false}, // too early
+		{85 * time.Second, popular, false}, // 15% left
+		{91 * time.Second, popular, true},  // 9% left, third hit
+		{92 * time.Second, popular, false}, // already handed out
+		{95 * time.Second, rare, false},    // first hit only
+	} {
+		now = time.Unix(1700000000, 0).Add(step.at)
+		if _, due := cache.GetPrefetch(step.q); due != step.want {
+			t.Fatalf("GetPrefetch(%s) at %s due = %v, want %v", step.q.Name, step.at, due, step.want)
+		}
+	}
+	if got := cache.Stats().Prefetched; got != 1 {
+		t.Fatalf("Prefetched = %d, want 1", got)
+	}
+
+	// The refreshed answer starts a new lifetime with a fresh hit count.
+	cache.Set(popular, msg, 0)
+	now = now.Add(95 * time.Second)
+	if _, due := cache.GetPrefetch(popular); due {
+		t.Fatal("GetPrefetch() due on the first hit of a refreshed entry")
+	}
+	if _, due := cache.GetPrefetch(popular); !due {
+		t.Fatal("GetPrefetch() not due on the second hit of a refreshed entry")
+	}
+}
+
+func TestKeyOf(t *testing.T) {
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	query := func(do, cd bool, options ...dns.EDNS0) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(q.Name, q.Qtype)
+		msg.CheckingDisabled = cd
+		if do || len(options) > 0 {
+			msg.SetEdns0(1232, do)
+			msg.IsEdns0().Option = options
+		}
+		return msg
+	}
+	subnet := func(family uint16, ip string, bits uint8) *dns.EDNS0_SUBNET {
+		return &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: family, SourceNetmask: bits, Address: net.ParseIP(ip)}
+	}
+
+	for name, tc := range map[string]struct {
+		msg  *dns.Msg
+		want CacheKey
+	}{
+		"plain":        {query(false, false), QuestionKey(q)},
+		"do":           {query(true, false), CacheKey{Question: q, DO: true}},
+		"cd":           {query(false, true), CacheKey{Question: q, CD: true}},
+		"ecs masked":   {query(false, false, subnet(1, "192.0.2.77", 24)), CacheKey{Question: q, ECS: "192.0.2.0/24"}},
+		"ecs v6":       {query(true, false, subnet(2, "2001:db8:1:2::1", 48)), CacheKey{Question: q, DO: true, ECS: "2001:db8:1::/48"}},
+		"other option": {query(false, false, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"}), QuestionKey(q)},
+	} {
+		if got := KeyOf(tc.msg); got != tc.want {
+			t.Errorf("%s: KeyOf() = %+v, want %+v", name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package util
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// IPSet is a set of CIDR prefixes matched by longest prefix. Prefixes are
+// bucketed by length, so a lookup costs one map probe per distinct length
+// (at most 33 for IPv4, 129 for IPv6) regardless of how many prefixes are
+// loaded.
+type IPSet struct {
+	byBits map[int]map[netip.Prefix]struct{}
+	bits   []int // distinct lengths, longest first
+	size   int
+}
+
+func NewIPSet(prefixes []netip.Prefix) *IPSet {
+	s := &IPSet{byBits: make(map[int]map[netip.Prefix]struct{})}
+	for _, p := range prefixes {
+		p = p.Masked()
+		bucket, ok := s.byBits[p.Bits()]
+		if !ok {
+			bucket = make(map[netip.Prefix]struct{})
+			s.byBits[p.Bits()] = bucket
+			s.bits = append(s.bits, p.Bits())
+		}
+		if _, dup := bucket[p]; !dup {
+			bucket[p] = struct{}{}
+			s.size++
+		}
+	}
+	slices.Sort(s.bits)
+	slices.Reverse(s.bits)
+	return s
+}
+
+// Lookup returns the most specific prefix containing addr. IPv4-mapped IPv6
+// addresses are matched as IPv4.
+func (s *IPSet) Lookup(addr netip.Addr) (netip.Prefix, bool) {
+	if s == nil || !addr.IsValid() {
+		return netip.Prefix{}, false
+	}
+	addr = addr.Unmap()
+	for _, bits := range s.bits {
+		if bits > addr.BitLen() {
+			continue
+		}
+		p, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if _, ok := s.byBits[bits][p]; ok {
+			return p, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+func (s *IPSet) Contains(addr netip.Addr) bool {
+	_, ok := s.Lookup(addr)
+	return ok
+}
+
+func (s *IPSet) Len() int {
+	if s == nil {
+		return 0
+	}
+	return s.size
+}
+
+// AddrOf extracts the peer IP of a UDP/TCP address; anything else (the
+// /api/query FakeAddr, a unix socket peer) has none.
+func AddrOf(addr net.Addr) (netip.Addr, bool) {
+	var ip netip.Addr
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.AddrPort().Addr()
+	case *net.TCPAddr:
+		ip = a.AddrPort().Addr()
+	default:
+		return netip.Addr{}, false
+	}
+	if !ip.IsValid() || ip.IsUnspecified() {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap(), true
+}
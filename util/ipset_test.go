@@ -0,0 +1,63 @@
+package util
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"dns-switchy/config"
+)
+
+func mustPrefixes(t *testing.T, texts ...string) []netip.Prefix {
+	t.Helper()
+	out := make([]netip.Prefix, 0, len(texts))
+	for _, text := range texts {
+		p, err := config.ParsePrefix(text)
+		if err != nil {
+			t.Fatalf("ParsePrefix(%q) error = %v", text, err)
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+func TestIPSetLookupLongestPrefix(t *testing.T) {
+	set := NewIPSet(mustPrefixes(t, "10.0.0.0/8", "10.1.0.0/16", "10.1.2.3", "2001:db8::/32", "10.0.0.0/8"))
+	if set.Len() != 4 {
+		t.Fatalf("Len() = %d, want 4 (duplicate dropped)", set.Len())
+	}
+	tests := []struct {
+		addr string
+		want string
+		ok   bool
+	}{
+		{"10.9.9.9", "10.0.0.0/8", true},
+		{"10.1.9.9", "10.1.0.0/16", true},
+		{"10.1.2.3", "10.1.2.3/32", true},
+		{"::ffff:10.1.2.3", "10.1.2.3/32", true},
+		{"2001:db8::1", "2001:db8::/32", true},
+		{"192.0.2.1", "", false},
+		{"2001:db9::1", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := set.Lookup(netip.MustParseAddr(tt.addr))
+		if ok != tt.ok || (ok && got.String() != tt.want) {
+			t.Errorf("Lookup(%s) = %v, %v, want %s, %v", tt.addr, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestAddrOf(t *testing.T) {
+	if ip, ok := AddrOf(&net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 53}); !ok || ip.String() != "192.0.2.1" {
+		t.Fatalf("AddrOf(udp) = %v, %v, want 192.0.2.1", ip, ok)
+	}
+	if ip, ok := AddrOf(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}); !ok || ip.String() != "2001:db8::1" {
+		t.Fatalf("AddrOf(tcp) = %v, %v, want 2001:db8::1", ip, ok)
+	}
+	if _, ok := AddrOf(&net.TCPAddr{}); ok {
+		t.Fatal("AddrOf(zero TCPAddr) ok = true, want false")
+	}
+	if _, ok := AddrOf(&net.UnixAddr{Name: "/tmp/x", Net: "unix"}); ok {
+		t.Fatal("AddrOf(unix) ok = true, want false")
+	}
+}
@@ -0,0 +1,100 @@
+package util
+
+import (
+	"log"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"dns-switchy/config"
+)
+
+// leaseCheckInterval bounds how often LeaseTable stats the lease file.
+const leaseCheckInterval = time.Second
+
+// LeaseEntry is one line of a dnsmasq lease file:
+// "<expiry> <mac> <ip> <hostname> <client-id>". IPv6 leases carry an IAID
+// instead of a MAC, so MAC is empty for them; unnamed hosts have Hostname "*".
+type LeaseEntry struct {
+	MAC      string
+	IP       netip.Addr
+	Hostname string
+}
+
+func ParseLeases(content string) []LeaseEntry {
+	var entries []LeaseEntry
+	for _, line := range strings.Split(content, "\n") {
+		parts := strings.Fields(line)
+		if len(parts) != 5 {
+			continue
+		}
+		ip, err := netip.ParseAddr(parts[2])
+		if err != nil {
+			continue
+		}
+		mac, _ := config.ParseMAC(parts[1])
+		entries = append(entries, LeaseEntry{MAC: mac, IP: ip.Unmap(), Hostname: parts[3]})
+	}
+	return entries
+}
+
+// LeaseTable answers "which lease holds this IP" from a dnsmasq lease file. It
+// re-reads the file when its mtime or size changes (checked at most once per
+// leaseCheckInterval, on lookup), so a new DHCP lease is seen without a reload
+// and without a goroutine to stop. A missing file is an empty table.
+type LeaseTable struct {
+	path string
+	now  func() time.Time
+
+	mu      sync.Mutex
+	checked time.Time
+	modTime time.Time
+	size    int64
+	byIP    map[netip.Addr]LeaseEntry
+}
+
+func NewLeaseTable(path string) *LeaseTable {
+	return &LeaseTable{path: path, now: time.Now}
+}
+
+func (t *LeaseTable) Lookup(ip netip.Addr) (LeaseEntry, bool) {
+	if t == nil {
+		return LeaseEntry{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refresh()
+	entry, ok := t.byIP[ip.Unmap()]
+	return entry, ok
+}
+
+func (t *LeaseTable) refresh() {
+	now := t.now()
+	if !t.checked.IsZero() && now.Sub(t.checked) < leaseCheckInterval {
+		return
+	}
+	t.checked = now
+	info, err := os.Stat(t.path)
+	if err != nil {
+		if t.byIP != nil {
+			log.Printf("lease file %s: %s", t.path, err)
+		}
+		t.byIP, t.modTime, t.size = nil, time.Time{}, 0
+		return
+	}
+	if t.byIP != nil && info.ModTime().Equal(t.modTime) && info.Size() == t.size {
+		return
+	}
+	content, err := os.ReadFile(t.path)
+	if err != nil {
+		log.Printf("lease file %s: %s", t.path, err)
+		return
+	}
+	byIP := make(map[netip.Addr]LeaseEntry)
+	for _, entry := range ParseLeases(string(content)) {
+		byIP[entry.IP] = entry
+	}
+	t.byIP, t.modTime, t.size = byIP, info.ModTime(), info.Size()
+}
@@ -0,0 +1,155 @@
+package util
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testLeases = `1700000000 AA:BB:CC:00:00:01 192.168.1.50 kid-tablet 01:aa:bb:cc:00:00:01
+1700000000 aa:bb:cc:00:00:02 192.168.1.51 * *
+1700000000 3920121 fd00::50 kid-tablet 00:01:00:01:2b:aa
+duid 00:01:00:01:2b:aa:bb:cc:dd:ee
+garbage line
+`
+
+func TestParseLeases(t *testing.T) {
+	entries := ParseLeases(testLeases)
+	want := []LeaseEntry{
+		{MAC: "aa:bb:cc:00:00:01", IP: netip.MustParseAddr("192.168.1.50"), Hostname: "kid-tablet"},
+		{MAC: "aa:bb:cc:00:00:02", IP: netip.MustParseAddr("192.168.1.51"), Hostname: "*"},
+		{MAC: "", IP: netip.MustParseAddr("fd00::50"), Hostname: "kid-tablet"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("ParseLeases() = %+v, want %+v", entries, want)
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Fatalf("ParseLeases()[%d] = %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+}
+
+func TestLeaseTableReloadsChangedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dhcp.leases")
+	if err := os.WriteFile(path, []byte(testLeases), 0o644); err != nil {
+		t.Fatalf("write leases: %v", err)
+	}
+	table := NewLeaseTable(path)
+	now := time.Unix(1700000000, 0)
+	table.now = func() time.Time { return now }
+
+	if entry, ok := table.Lookup(netip.MustParseAddr("::ffff:192.168.1.50")); !ok || entry.MAC != "aa:bb:cc:00:00:01" {
+		t.Fatalf("Lookup(192.168.1.50) = %+v, %v, want kid-tablet lease", entry, ok)
+	}
+	if _, ok := table.Lookup(netip.MustParseAddr("192.168.1.60")); ok {
+		t.Fatal("Lookup(192.168.1.60) ok = true before the lease exists")
+	}
+
+	updated := testLeases + "1700000000 aa:bb:cc:00:00:03 192.168.1.60 new-phone *\n"
+	if err := os.WriteFile(path, []byte(updated), 0o644); err != nil {
+		t.Fatalf("rewrite leases: %v", err)
+	}
+	if _, ok := table.Lookup(netip.MustParseAddr("192.168.1.60")); ok {
+		t.Fatal("Lookup re-read the file within leaseCheckInterval")
+	}
+	now = now.Add(leaseCheckInterval)
+	if entry, ok := table.Lookup(netip.MustParseAddr("192.168.1.60")); !ok || entry.Hostname != "new-phone" {
+		t.Fatalf("Lookup(192.168.1.60) after change = %+v, %v, want new-phone", entry, ok)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("remove leases: %v", err)
+	}
+	now = now.Add(leaseCheckInterval)
+	if _, ok := table.Lookup(netip.MustParseAddr("192.168.1.50")); ok {
+		t.Fatal("Lookup ok = true after the lease file was removed")
+	}
+}
+
+func TestSourceSetMatchSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dhcp.leases")
+	if err := os.WriteFile(path, []byte(testLeases), 0o644); err != nil {
+		t.Fatalf("write leases: %v", err)
+	}
+	set, err := NewSourceSet([]string{"10.0.0.0/8", "192.168.2.7/32", "aa:bb:cc:00:00:01"}, NewLeaseTable(path))
+	if err != nil {
+		t.Fatalf("NewSourceSet() error = %v", err)
+	}
+	tests := []struct {
+		client string
+		want   bool
+	}{
+		{"10.1.2.3", true},
+		{"192.168.2.7", true},
+		{"192.168.2.8", false},
+		{"192.168.1.50", true}, // lease held by aa:bb:cc:00:00:01
+		{"192.168.1.51", false},
+	}
+	for _, tt := range tests {
+		if got := set.MatchSource(netip.MustParseAddr(tt.client)); got != tt.want {
+			t.Errorf("MatchSource(%s) = %v, want %v", tt.client, got, tt.want)
+		}
+	}
+	if set.MatchSource(netip.Addr{}) {
+		t.Fatal("MatchSource(invalid) = true, want false for clients without an IP")
+	}
+	if _, err = NewSourceSet([]string{"kids"}, nil); err == nil {
+		t.Fatal("NewSourceSet(group name) error = nil, want unexpanded entry rejected")
+	}
+}
+
+func TestClientGroupsLookup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dhcp.leases")
+	if err := os.WriteFile(path, []byte(testLeases), 0o644); err != nil {
+		t.Fatalf("write leases: %v", err)
+	}
+	leases := NewLeaseTable(path)
+	now := time.Unix(1700000000, 0)
+	leases.now = func() time.Time { return now }
+	groups, err := NewClientGroups(map[string][]string{
+		"lan":  {"192.168.0.0/16"},
+		"kids": {"kid-tablet"},
+		"iot":  {"192.168.1.51/32"},
+	}, leases)
+	if err != nil {
+		t.Fatalf("NewClientGroups() error = %v", err)
+	}
+	tests := []struct {
+		client string
+		want   string
+	}{
+		{"192.168.1.50", "kids"}, // lease hostname, and kids sorts before lan
+		{"fd00::50", "kids"},     // IPv6 lease without a MAC
+		{"192.168.1.51", "iot"},
+		{"192.168.3.1", "lan"},
+		{"10.0.0.1", ""},
+	}
+	for _, tt := range tests {
+		if got := groups.Lookup(netip.MustParseAddr(tt.client)); got != tt.want {
+			t.Errorf("Lookup(%s) = %q, want %q", tt.client, got, tt.want)
+		}
+	}
+
+	// The tablet renews under another name: it drops out of the group once the
+	// lease file changes.
+	renamed := strings.Replace(testLeases, "192.168.1.50 kid-tablet", "192.168.1.50 Guest-Phone", 1)
+	if err := os.WriteFile(path, []byte(renamed), 0o644); err != nil {
+		t.Fatalf("rewrite leases: %v", err)
+	}
+	now = now.Add(leaseCheckInterval)
+	if got := groups.Lookup(netip.MustParseAddr("192.168.1.50")); got != "lan" {
+		t.Fatalf("Lookup(192.168.1.50) after rename = %q, want lan", got)
+	}
+
+	var none *ClientGroups
+	if got := none.Lookup(netip.MustParseAddr("192.168.1.50")); got != "" {
+		t.Fatalf("nil Lookup = %q, want empty", got)
+	}
+	if _, err = NewClientGroups(map[string][]string{"kids": {"kid-tablet"}}, nil); err == nil {
+		t.Fatal("NewClientGroups(hostname without leases) error = nil")
+	}
+}
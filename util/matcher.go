@@ -3,6 +3,7 @@ package util
 import (
 	"bytes"
 	"fmt"
+	"net/netip"
 	"regexp"
 	"strings"
 
@@ -19,8 +20,10 @@ type QueryTypeMatcher interface {
 	MatchQueryType(queryType uint16) bool
 }
 
+// SourceMatcher decides by the querying client's address. An invalid
+// address (no peer IP, e.g. /api/query) never matches.
 type SourceMatcher interface {
-	MatchQueryType(queryType uint16) bool
+	MatchSource(client netip.Addr) bool
 }
 
 var AcceptAll = acceptAll{}
@@ -0,0 +1,109 @@
+package util
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"dns-switchy/config"
+)
+
+// SourceSet matches clients by address prefix or, through the lease file, by
+// the MAC address or hostname holding the client's DHCP lease.
+type SourceSet struct {
+	prefixes *IPSet
+	macs     map[string]struct{}
+	hosts    map[string]struct{}
+	leases   *LeaseTable
+	entries  []string
+}
+
+// NewSourceSet builds a matcher from normalised `source:` entries (CIDR, IP,
+// MAC or lease hostname; group names are already expanded by
+// config.ParseConfig). Hostnames need a lease table to resolve against.
+func NewSourceSet(entries []string, leases *LeaseTable) (*SourceSet, error) {
+	s := &SourceSet{macs: make(map[string]struct{}), hosts: make(map[string]struct{}), leases: leases, entries: entries}
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		if p, err := config.ParsePrefix(entry); err == nil {
+			prefixes = append(prefixes, p)
+		} else if mac, ok := config.ParseMAC(entry); ok {
+			s.macs[mac] = struct{}{}
+		} else if host, ok := config.ParseLeaseHostname(entry); ok && leases != nil {
+			s.hosts[host] = struct{}{}
+		} else {
+			return nil, fmt.Errorf("invalid source %q", entry)
+		}
+	}
+	s.prefixes = NewIPSet(prefixes)
+	return s, nil
+}
+
+func (s *SourceSet) MatchSource(client netip.Addr) bool {
+	if !client.IsValid() {
+		return false
+	}
+	if s.prefixes.Contains(client) {
+		return true
+	}
+	if len(s.macs) == 0 && len(s.hosts) == 0 {
+		return false
+	}
+	lease, ok := s.leases.Lookup(client)
+	if !ok {
+		return false
+	}
+	if _, ok = s.macs[lease.MAC]; ok {
+		return true
+	}
+	_, ok = s.hosts[strings.ToLower(lease.Hostname)]
+	return ok
+}
+
+func (s *SourceSet) String() string {
+	return fmt.Sprintf("SourceSet(%s)", strings.Join(s.entries, ","))
+}
+
+// ClientGroups names the device class of a client from the top-level
+// `clients:` map, for the query log and /api/query. A nil *ClientGroups
+// names nobody.
+type ClientGroups struct {
+	names []string
+	sets  []*SourceSet
+}
+
+// NewClientGroups compiles the normalised `clients:` map. Groups are tried in
+// name order, so a client in several groups is always attributed to the same
+// one.
+func NewClientGroups(groups map[string][]string, leases *LeaseTable) (*ClientGroups, error) {
+	if len(groups) == 0 {
+		return nil, nil
+	}
+	g := &ClientGroups{names: make([]string, 0, len(groups))}
+	for name := range groups {
+		g.names = append(g.names, name)
+	}
+	sort.Strings(g.names)
+	for _, name := range g.names {
+		set, err := NewSourceSet(groups[name], leases)
+		if err != nil {
+			return nil, fmt.Errorf("clients.%s: %w", name, err)
+		}
+		g.sets = append(g.sets, set)
+	}
+	return g, nil
+}
+
+// Lookup returns the name of the first group containing client, or "".
+func (g *ClientGroups) Lookup(client netip.Addr) string {
+	if g == nil {
+		return ""
+	}
+	for i, set := range g.sets {
+		if set.MatchSource(client) {
+			return g.names[i]
+		}
+	}
+	return ""
+}